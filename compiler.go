@@ -7,6 +7,7 @@ import (
 	"go/constant"
 	"go/token"
 	"go/types"
+	"math"
 	"os"
 	"path/filepath"
 	"runtime"
@@ -18,6 +19,7 @@ import (
 	"golang.org/x/tools/go/loader"
 	"golang.org/x/tools/go/ssa"
 	"golang.org/x/tools/go/ssa/ssautil"
+	"golang.org/x/tools/go/types/typeutil"
 )
 
 func init() {
@@ -30,8 +32,10 @@ func init() {
 
 type Compiler struct {
 	dumpSSA         bool
+	printAllocs     bool
 	debug           bool
 	triple          string
+	maxStackAlloc   uint64 // see stackAllocBudget
 	mod             llvm.Module
 	ctx             llvm.Context
 	builder         llvm.Builder
@@ -55,21 +59,49 @@ type Compiler struct {
 	coroFreeFunc    llvm.Value
 	initFuncs       []llvm.Value
 	deferFuncs      []*Function
+	deferFuncPtrs   map[llvm.Type]llvm.Value   // $defer wrappers of function pointers, by function type
+	deferBuiltins   []*deferBuiltin            // $defer wrappers of builtins
+	mapKeyFuncs     typeutil.Map               // *mapKeyFuncs by map key type, see getMapKeyFuncs
+	mapKeyFuncsList []*mapKeyFuncs             // same as mapKeyFuncs, in creation order
+	localTypes      map[*types.Named]llvm.Type // named struct types declared inside a function
+	invokeFuncs     map[llvm.Value]llvm.Value  // $invoke wrappers of methods, see getInvokeFunc
 	ir              *Program
 }
 
 type Frame struct {
-	fn           *Function
-	params       map[*ssa.Parameter]int   // arguments to the function
-	locals       map[ssa.Value]llvm.Value // local variables
-	blocks       map[*ssa.BasicBlock]llvm.BasicBlock
-	phis         []Phi
-	blocking     bool
-	taskHandle   llvm.Value
-	cleanupBlock llvm.BasicBlock
-	suspendBlock llvm.BasicBlock
-	deferPtr     llvm.Value
-	difunc       llvm.Metadata
+	fn             *Function
+	params         map[*ssa.Parameter]int   // arguments to the function
+	locals         map[ssa.Value]llvm.Value // local variables
+	blocks         map[*ssa.BasicBlock]llvm.BasicBlock
+	blockExits     map[*ssa.BasicBlock]llvm.BasicBlock // last LLVM basic block of each SSA block
+	phis           []Phi
+	blocking       bool
+	taskHandle     llvm.Value
+	cleanupBlock   llvm.BasicBlock
+	suspendBlock   llvm.BasicBlock
+	deferPtr       llvm.Value
+	deferFrame     llvm.Value       // runtime.deferFrame, if panics can be recovered in this function
+	stackAllocSize uint64           // total size of the objects put on the stack by emitAlloc
+	canRecover     llvm.Value       // whether this function was called directly by a deferred call, if it calls recover()
+	blockingDefers []*blockingDefer // deferred calls of blocking functions, see emitRunDefers
+	difunc         llvm.Metadata
+}
+
+// A deferred call of a builtin. The arguments are evaluated at the defer
+// statement and stored in the defer struct, after the runtime._defer fields.
+// The wrapper loads them and calls the builtin.
+type deferBuiltin struct {
+	wrapper llvm.Value
+	name    string
+	args    []ssa.Value
+}
+
+// A deferred call of a blocking function, in a blocking function. It cannot be
+// called from runtime.rundefers, as the coroutine must wait for it, so it is
+// called by the function itself in emitRunDefers.
+type blockingDefer struct {
+	call        *ssa.CallCommon
+	contextType llvm.Type // the defer struct
 }
 
 type Phi struct {
@@ -77,15 +109,27 @@ type Phi struct {
 	llvm llvm.Value
 }
 
+// Hash and equality functions of a map key type that can't be hashed and
+// compared as plain binary data.
+type mapKeyFuncs struct {
+	typ   types.Type
+	hash  llvm.Value
+	equal llvm.Value
+}
+
 var cgoWrapperError = errors.New("tinygo internal: cgo wrapper")
 
-func NewCompiler(pkgName, triple string, dumpSSA bool) (*Compiler, error) {
+func NewCompiler(pkgName, triple string, dumpSSA, printAllocs bool) (*Compiler, error) {
 	c := &Compiler{
-		dumpSSA: dumpSSA,
-		debug:   true, // TODO: make configurable
-		triple:  triple,
-		difiles: make(map[string]llvm.Metadata),
-		ditypes: make(map[string]llvm.Metadata),
+		dumpSSA:       dumpSSA,
+		printAllocs:   printAllocs,
+		debug:         true, // TODO: make configurable
+		triple:        triple,
+		difiles:       make(map[string]llvm.Metadata),
+		ditypes:       make(map[string]llvm.Metadata),
+		deferFuncPtrs: make(map[llvm.Type]llvm.Value),
+		localTypes:    make(map[*types.Named]llvm.Type),
+		invokeFuncs:   make(map[llvm.Value]llvm.Value),
 	}
 
 	target, err := llvm.GetTargetFromTriple(triple)
@@ -94,6 +138,7 @@ func NewCompiler(pkgName, triple string, dumpSSA bool) (*Compiler, error) {
 	}
 	c.machine = target.CreateTargetMachine(triple, "", "", llvm.CodeGenLevelDefault, llvm.RelocPIC, llvm.CodeModelDefault)
 	c.targetData = c.machine.CreateTargetData()
+	c.maxStackAlloc = stackAllocBudget(triple)
 
 	c.mod = llvm.NewModule(pkgName)
 	c.mod.SetTarget(triple)
@@ -364,23 +409,115 @@ func (c *Compiler) Parse(mainPath string, buildTags []string) error {
 			}
 			valueTypes = append(valueTypes, llvmType)
 		}
+		needsContext := c.ir.FunctionNeedsContext(fn)
+		if needsContext {
+			// The closure context follows the parameters.
+			valueTypes = append(valueTypes, c.i8ptrType)
+		}
 		contextType := llvm.StructType(valueTypes, false)
 		contextPtr := c.builder.CreateBitCast(deferRawPtr, llvm.PointerType(contextType, 0), "context")
 
 		// Extract the params from the struct.
 		forwardParams := []llvm.Value{}
 		zero := llvm.ConstInt(llvm.Int32Type(), 0, false)
-		for i := range fn.fn.Params {
+		for i := range valueTypes[2:] {
 			gep := c.builder.CreateGEP(contextPtr, []llvm.Value{zero, llvm.ConstInt(llvm.Int32Type(), uint64(i+2), false)}, "gep")
 			forwardParam := c.builder.CreateLoad(gep, "param")
 			forwardParams = append(forwardParams, forwardParam)
 		}
 
 		// Call real function (of which this is a wrapper).
+		if fn.CallsRecover() {
+			c.emitSetDeferredFunc(fn.llvmFn)
+		}
 		c.builder.CreateCall(fn.llvmFn, forwardParams, "")
 		c.builder.CreateRetVoid()
 	}
 
+	// Create wrappers of deferred calls through function pointers. These work
+	// like the wrappers above, except that the function to call is the first
+	// value in the struct.
+	for fnPtrType, llvmFn := range c.deferFuncPtrs {
+		entry := c.ctx.AddBasicBlock(llvmFn, "entry")
+		c.builder.SetInsertPointAtEnd(entry)
+		deferRawPtr := llvmFn.Param(0)
+
+		// Get the real param type and cast to it.
+		valueTypes := []llvm.Type{llvmFn.Type(), deferRawPtr.Type(), fnPtrType}
+		valueTypes = append(valueTypes, fnPtrType.ElementType().ParamTypes()...)
+		contextType := llvm.StructType(valueTypes, false)
+		contextPtr := c.builder.CreateBitCast(deferRawPtr, llvm.PointerType(contextType, 0), "context")
+
+		// Extract the function pointer and params from the struct.
+		fields := []llvm.Value{}
+		zero := llvm.ConstInt(llvm.Int32Type(), 0, false)
+		for i := range valueTypes[2:] {
+			gep := c.builder.CreateGEP(contextPtr, []llvm.Value{zero, llvm.ConstInt(llvm.Int32Type(), uint64(i+2), false)}, "gep")
+			fields = append(fields, c.builder.CreateLoad(gep, "param"))
+		}
+
+		// Call the function pointer. It may call recover(), so tell it that
+		// it is called directly by a deferred call.
+		c.emitSetDeferredFunc(fields[0])
+		c.builder.CreateCall(fields[0], fields[1:], "")
+		c.builder.CreateRetVoid()
+	}
+
+	// Create wrappers of deferred calls of builtins. The arguments follow the
+	// runtime._defer fields in the struct. They are made available as the
+	// values of the SSA arguments, so that the builtin can be emitted as usual.
+	for _, d := range c.deferBuiltins {
+		entry := c.ctx.AddBasicBlock(d.wrapper, "entry")
+		c.builder.SetInsertPointAtEnd(entry)
+		deferRawPtr := d.wrapper.Param(0)
+
+		// Get the real param type and cast to it.
+		valueTypes := []llvm.Type{d.wrapper.Type(), deferRawPtr.Type()}
+		for _, arg := range d.args {
+			llvmType, err := c.getLLVMType(arg.Type())
+			if err != nil {
+				return err
+			}
+			valueTypes = append(valueTypes, llvmType)
+		}
+		contextType := llvm.StructType(valueTypes, false)
+		contextPtr := c.builder.CreateBitCast(deferRawPtr, llvm.PointerType(contextType, 0), "context")
+
+		// Extract the params from the struct. A deferred recover() is not
+		// called by a deferred function, so it never recovers.
+		frame := &Frame{
+			locals:     make(map[ssa.Value]llvm.Value),
+			canRecover: llvm.ConstInt(llvm.Int1Type(), 0, false),
+		}
+		zero := llvm.ConstInt(llvm.Int32Type(), 0, false)
+		for i, arg := range d.args {
+			gep := c.builder.CreateGEP(contextPtr, []llvm.Value{zero, llvm.ConstInt(llvm.Int32Type(), uint64(i+2), false)}, "gep")
+			frame.locals[arg] = c.builder.CreateLoad(gep, "param")
+		}
+
+		// Call the builtin.
+		_, err := c.parseBuiltin(frame, d.args, d.name)
+		if err != nil {
+			return err
+		}
+		c.builder.CreateRetVoid()
+	}
+
+	// Create the hash and equality functions of map keys that can't be hashed
+	// and compared as plain binary data.
+	for _, funcs := range c.mapKeyFuncsList {
+		err := c.parseMapKeyFuncs(funcs)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Create the functions that compare and hash interface values.
+	err = c.parseInterfaceValueFuncs()
+	if err != nil {
+		return err
+	}
+
 	// After all packages are imported, add a synthetic initializer function
 	// that calls the initializer of each package.
 	initFn := c.mod.NamedFunction("runtime.initAll")
@@ -392,6 +529,32 @@ func (c *Compiler) Parse(mainPath string, buildTags []string) error {
 	}
 	c.builder.CreateRetVoid()
 
+	// Add a body to runtime.callFinalizer, which calls a finalizer function
+	// pointer with the object and a context parameter. Functions that don't
+	// need a context simply ignore it.
+	callFinalizer := c.mod.NamedFunction("runtime.callFinalizer")
+	callFinalizer.SetLinkage(llvm.InternalLinkage)
+	block = c.ctx.AddBasicBlock(callFinalizer, "entry")
+	c.builder.SetInsertPointAtEnd(block)
+	finalizerType := llvm.FunctionType(llvm.VoidType(), []llvm.Type{c.i8ptrType, c.i8ptrType}, false)
+	finalizer := c.builder.CreateBitCast(callFinalizer.Param(0), llvm.PointerType(finalizerType, 0), "finalizer")
+	c.builder.CreateCall(finalizer, []llvm.Value{callFinalizer.Param(1), callFinalizer.Param(2)}, "")
+	c.builder.CreateRetVoid()
+
+	// Add a body to runtime.deferLongjmp, which jumps back into the function of
+	// a defer frame after a recovered panic.
+	deferLongjmp := c.mod.NamedFunction("runtime.deferLongjmp")
+	deferLongjmp.SetLinkage(llvm.InternalLinkage)
+	block = c.ctx.AddBasicBlock(deferLongjmp, "entry")
+	c.builder.SetInsertPointAtEnd(block)
+	if c.supportsRecover() {
+		// The jump buffer is the first field of runtime.deferFrame.
+		jumpBuffer := c.builder.CreateBitCast(deferLongjmp.Param(0), c.i8ptrType, "jumpBuffer")
+		longjmpType := llvm.FunctionType(llvm.VoidType(), []llvm.Type{c.i8ptrType}, false)
+		c.builder.CreateCall(c.getIntrinsic("llvm.eh.sjlj.longjmp", longjmpType), []llvm.Value{jumpBuffer}, "")
+	}
+	c.builder.CreateUnreachable()
+
 	// Adjust main function.
 	realMain := c.mod.NamedFunction(c.ir.mainPkg.Pkg.Path() + ".main")
 	if c.ir.NeedsScheduler() {
@@ -423,8 +586,8 @@ func (c *Compiler) Parse(mainPath string, buildTags []string) error {
 	rangeType := c.mod.GetTypeByName("runtime.methodSetRange")
 	for _, meta := range dynamicTypes {
 		rangeValues := []llvm.Value{
-			llvm.ConstInt(llvm.Int16Type(), uint64(startIndex), false),
-			llvm.ConstInt(llvm.Int16Type(), uint64(len(meta.Methods)), false),
+			llvm.ConstInt(c.uintptrType, uint64(startIndex), false),
+			llvm.ConstInt(c.uintptrType, uint64(len(meta.Methods)), false),
 		}
 		rangeValue := llvm.ConstNamedStruct(rangeType, rangeValues)
 		ranges = append(ranges, rangeValue)
@@ -438,10 +601,10 @@ func (c *Compiler) Parse(mainPath string, buildTags []string) error {
 			if f.llvmFn.IsNil() {
 				return errors.New("cannot find function: " + f.LinkName())
 			}
-			fn := llvm.ConstBitCast(f.llvmFn, c.i8ptrType)
+			fn := llvm.ConstBitCast(c.getInvokeFunc(f), c.i8ptrType)
 			funcPointers = append(funcPointers, fn)
 			signatureNum := c.ir.MethodNum(method.Obj().(*types.Func))
-			signature := llvm.ConstInt(llvm.Int16Type(), uint64(signatureNum), false)
+			signature := llvm.ConstInt(c.uintptrType, uint64(signatureNum), false)
 			signatures = append(signatures, signature)
 		}
 		startIndex += len(meta.Methods)
@@ -452,24 +615,25 @@ func (c *Compiler) Parse(mainPath string, buildTags []string) error {
 	interfaceLengths := make([]llvm.Value, len(interfaceTypes))
 	interfaceMethods := make([]llvm.Value, 0)
 	for i, itfType := range interfaceTypes {
-		if itfType.Type.NumMethods() > 0xff {
-			return errors.New("too many methods for interface " + itfType.Type.String())
-		}
-		interfaceIndex[i] = llvm.ConstInt(llvm.Int16Type(), uint64(i), false)
-		interfaceLengths[i] = llvm.ConstInt(llvm.Int8Type(), uint64(itfType.Type.NumMethods()), false)
+		interfaceIndex[i] = llvm.ConstInt(c.uintptrType, uint64(len(interfaceMethods)), false)
+		interfaceLengths[i] = llvm.ConstInt(c.uintptrType, uint64(itfType.Type.NumMethods()), false)
 		funcs := make([]*types.Func, itfType.Type.NumMethods())
 		for i := range funcs {
 			funcs[i] = itfType.Type.Method(i)
 		}
 		c.ir.SortFuncs(funcs)
 		for _, f := range funcs {
-			id := llvm.ConstInt(llvm.Int16Type(), uint64(c.ir.MethodNum(f)), false)
+			id := llvm.ConstInt(c.uintptrType, uint64(c.ir.MethodNum(f)), false)
 			interfaceMethods = append(interfaceMethods, id)
 		}
 	}
 
-	if len(ranges) >= 1<<16 {
-		return errors.New("method call numbers do not fit in a 16-bit integer")
+	// Typecodes, method numbers and indices into these tables are all stored
+	// as uintptr values. Check that they fit, which mainly matters for AVR.
+	for _, n := range []int{len(c.ir.AllTypes()), c.ir.NumMethods(), len(interfaceTypes), len(signatures), len(interfaceMethods)} {
+		if uint64(n) > c.maxTypecode() {
+			return errors.New("interface typecodes or method numbers do not fit in a uintptr")
+		}
 	}
 
 	// Replace the pre-created arrays with the generated arrays.
@@ -489,7 +653,7 @@ func (c *Compiler) Parse(mainPath string, buildTags []string) error {
 	funcArrayOldGlobal.ReplaceAllUsesWith(llvm.ConstBitCast(funcArrayNewGlobal, funcArrayOldGlobal.Type()))
 	funcArrayOldGlobal.EraseFromParentAsGlobal()
 	funcArrayNewGlobal.SetName("runtime.methodSetFunctions")
-	signatureArray := llvm.ConstArray(llvm.Int16Type(), signatures)
+	signatureArray := llvm.ConstArray(c.uintptrType, signatures)
 	signatureArrayNewGlobal := llvm.AddGlobal(c.mod, signatureArray.Type(), "runtime.methodSetSignatures.tmp")
 	signatureArrayNewGlobal.SetInitializer(signatureArray)
 	signatureArrayNewGlobal.SetLinkage(llvm.InternalLinkage)
@@ -497,7 +661,7 @@ func (c *Compiler) Parse(mainPath string, buildTags []string) error {
 	signatureArrayOldGlobal.ReplaceAllUsesWith(llvm.ConstBitCast(signatureArrayNewGlobal, signatureArrayOldGlobal.Type()))
 	signatureArrayOldGlobal.EraseFromParentAsGlobal()
 	signatureArrayNewGlobal.SetName("runtime.methodSetSignatures")
-	interfaceIndexArray := llvm.ConstArray(llvm.Int16Type(), interfaceIndex)
+	interfaceIndexArray := llvm.ConstArray(c.uintptrType, interfaceIndex)
 	interfaceIndexArrayNewGlobal := llvm.AddGlobal(c.mod, interfaceIndexArray.Type(), "runtime.interfaceIndex.tmp")
 	interfaceIndexArrayNewGlobal.SetInitializer(interfaceIndexArray)
 	interfaceIndexArrayNewGlobal.SetLinkage(llvm.InternalLinkage)
@@ -505,7 +669,7 @@ func (c *Compiler) Parse(mainPath string, buildTags []string) error {
 	interfaceIndexArrayOldGlobal.ReplaceAllUsesWith(llvm.ConstBitCast(interfaceIndexArrayNewGlobal, interfaceIndexArrayOldGlobal.Type()))
 	interfaceIndexArrayOldGlobal.EraseFromParentAsGlobal()
 	interfaceIndexArrayNewGlobal.SetName("runtime.interfaceIndex")
-	interfaceLengthsArray := llvm.ConstArray(llvm.Int8Type(), interfaceLengths)
+	interfaceLengthsArray := llvm.ConstArray(c.uintptrType, interfaceLengths)
 	interfaceLengthsArrayNewGlobal := llvm.AddGlobal(c.mod, interfaceLengthsArray.Type(), "runtime.interfaceLengths.tmp")
 	interfaceLengthsArrayNewGlobal.SetInitializer(interfaceLengthsArray)
 	interfaceLengthsArrayNewGlobal.SetLinkage(llvm.InternalLinkage)
@@ -513,7 +677,7 @@ func (c *Compiler) Parse(mainPath string, buildTags []string) error {
 	interfaceLengthsArrayOldGlobal.ReplaceAllUsesWith(llvm.ConstBitCast(interfaceLengthsArrayNewGlobal, interfaceLengthsArrayOldGlobal.Type()))
 	interfaceLengthsArrayOldGlobal.EraseFromParentAsGlobal()
 	interfaceLengthsArrayNewGlobal.SetName("runtime.interfaceLengths")
-	interfaceMethodsArray := llvm.ConstArray(llvm.Int16Type(), interfaceMethods)
+	interfaceMethodsArray := llvm.ConstArray(c.uintptrType, interfaceMethods)
 	interfaceMethodsArrayNewGlobal := llvm.AddGlobal(c.mod, interfaceMethodsArray.Type(), "runtime.interfaceMethods.tmp")
 	interfaceMethodsArrayNewGlobal.SetInitializer(interfaceMethodsArray)
 	interfaceMethodsArrayNewGlobal.SetLinkage(llvm.InternalLinkage)
@@ -522,7 +686,7 @@ func (c *Compiler) Parse(mainPath string, buildTags []string) error {
 	interfaceMethodsArrayOldGlobal.EraseFromParentAsGlobal()
 	interfaceMethodsArrayNewGlobal.SetName("runtime.interfaceMethods")
 
-	c.mod.NamedGlobal("runtime.firstTypeWithMethods").SetInitializer(llvm.ConstInt(llvm.Int16Type(), uint64(c.ir.FirstDynamicType()), false))
+	c.mod.NamedGlobal("runtime.firstTypeWithMethods").SetInitializer(llvm.ConstInt(c.uintptrType, uint64(c.ir.FirstDynamicType()), false))
 
 	// see: https://reviews.llvm.org/D18355
 	c.mod.AddNamedMetadataOperand("llvm.module.flags",
@@ -583,11 +747,31 @@ func (c *Compiler) getLLVMType(goType types.Type) (llvm.Type, error) {
 	case *types.Map:
 		return llvm.PointerType(c.mod.GetTypeByName("runtime.hashmap"), 0), nil
 	case *types.Named:
-		if _, ok := typ.Underlying().(*types.Struct); ok {
-			llvmType := c.mod.GetTypeByName(typ.Obj().Pkg().Path() + "." + typ.Obj().Name())
-			if llvmType.IsNil() {
-				return llvm.Type{}, errors.New("type not found: " + typ.Obj().Pkg().Path() + "." + typ.Obj().Name())
+		if st, ok := typ.Underlying().(*types.Struct); ok {
+			name := typ.Obj().Pkg().Path() + "." + typ.Obj().Name()
+			if typ.Obj().Parent() == typ.Obj().Pkg().Scope() {
+				// Package-level types are all declared at the start of Parse.
+				llvmType := c.mod.GetTypeByName(name)
+				if llvmType.IsNil() {
+					return llvm.Type{}, errors.New("type not found: " + name)
+				}
+				return llvmType, nil
+			}
+			// This type is declared inside a function, so it isn't a package
+			// member. Types in different functions may have the same name, so
+			// they are looked up by their *types.Named instead of by name.
+			if llvmType, ok := c.localTypes[typ]; ok {
+				return llvmType, nil
 			}
+			// Create an opaque struct first, so that the struct body may refer
+			// to itself (for example, in a linked list).
+			llvmType := c.ctx.StructCreateNamed(name)
+			c.localTypes[typ] = llvmType
+			underlying, err := c.getLLVMType(st)
+			if err != nil {
+				return llvm.Type{}, err
+			}
+			llvmType.StructSetBody(underlying.StructElementTypes(), false)
 			return llvmType, nil
 		}
 		return c.getLLVMType(typ.Underlying())
@@ -701,6 +885,9 @@ func getZeroValue(typ llvm.Type) (llvm.Value, error) {
 		return llvm.ConstInt(typ, 0, false), nil
 	case llvm.PointerTypeKind:
 		return llvm.ConstPointerNull(typ), nil
+	case llvm.VectorTypeKind:
+		// Complex numbers.
+		return llvm.ConstNull(typ), nil
 	case llvm.StructTypeKind:
 		types := typ.StructElementTypes()
 		vals := make([]llvm.Value, len(types))
@@ -797,50 +984,42 @@ func isCGoInternal(name string) bool {
 
 func (c *Compiler) parseFuncDecl(f *Function) (*Frame, error) {
 	frame := &Frame{
-		fn:       f,
-		params:   make(map[*ssa.Parameter]int),
-		locals:   make(map[ssa.Value]llvm.Value),
-		blocks:   make(map[*ssa.BasicBlock]llvm.BasicBlock),
-		blocking: c.ir.IsBlocking(f),
+		fn:         f,
+		params:     make(map[*ssa.Parameter]int),
+		locals:     make(map[ssa.Value]llvm.Value),
+		blocks:     make(map[*ssa.BasicBlock]llvm.BasicBlock),
+		blockExits: make(map[*ssa.BasicBlock]llvm.BasicBlock),
+		blocking:   c.ir.IsBlocking(f),
+	}
+
+	resultType, err := c.getResultType(f.fn.Signature)
+	if err != nil {
+		return nil, err
 	}
 
 	var retType llvm.Type
+	var paramTypes []llvm.Type
 	if frame.blocking {
-		if f.fn.Signature.Results() != nil {
-			return nil, errors.New("todo: return values in blocking function")
-		}
+		// Blocking functions return their coroutine handle. Results are
+		// stored in a slot provided by the caller instead.
 		retType = c.i8ptrType
-	} else if f.fn.Signature.Results() == nil {
-		retType = llvm.VoidType()
-	} else if f.fn.Signature.Results().Len() == 1 {
-		var err error
-		retType, err = c.getLLVMType(f.fn.Signature.Results().At(0).Type())
-		if err != nil {
-			return nil, err
+		paramTypes = append(paramTypes, c.i8ptrType) // parent coroutine
+		if !resultType.IsNil() {
+			paramTypes = append(paramTypes, llvm.PointerType(resultType, 0)) // result slot
 		}
+	} else if resultType.IsNil() {
+		retType = llvm.VoidType()
 	} else {
-		results := make([]llvm.Type, 0, f.fn.Signature.Results().Len())
-		for i := 0; i < f.fn.Signature.Results().Len(); i++ {
-			typ, err := c.getLLVMType(f.fn.Signature.Results().At(i).Type())
-			if err != nil {
-				return nil, err
-			}
-			results = append(results, typ)
-		}
-		retType = llvm.StructType(results, false)
+		retType = resultType
 	}
 
-	var paramTypes []llvm.Type
-	if frame.blocking {
-		paramTypes = append(paramTypes, c.i8ptrType) // parent coroutine
-	}
-	for i, param := range f.fn.Params {
+	for _, param := range f.fn.Params {
 		paramType, err := c.getLLVMType(param.Type())
 		if err != nil {
 			return nil, err
 		}
+		frame.params[param] = len(paramTypes)
 		paramTypes = append(paramTypes, paramType)
-		frame.params[param] = i
 	}
 
 	if c.ir.FunctionNeedsContext(f) {
@@ -855,6 +1034,13 @@ func (c *Compiler) parseFuncDecl(f *Function) (*Frame, error) {
 	frame.fn.llvmFn = c.mod.NamedFunction(name)
 	if frame.fn.llvmFn.IsNil() {
 		frame.fn.llvmFn = llvm.AddFunction(c.mod, name, fnType)
+	} else if frame.fn.llvmFn.Type().ElementType() != fnType && len(f.fn.Blocks) == 0 {
+		// This is a declaration of a function that is implemented in the
+		// runtime with //go:linkname, but with a different type: for example
+		// time.startTimer takes a *time.runtimeTimer while the runtime uses
+		// its own mirror of that struct. The types are compatible, so call the
+		// runtime function through a bitcast.
+		frame.fn.llvmFn = llvm.ConstBitCast(frame.fn.llvmFn, llvm.PointerType(fnType, 0))
 	}
 
 	if c.debug && f.fn.Syntax() != nil && len(f.fn.Blocks) != 0 {
@@ -897,6 +1083,76 @@ func (c *Compiler) parseFuncDecl(f *Function) (*Frame, error) {
 	return frame, nil
 }
 
+// Return the highest number that fits in a typecode, method number or interface
+// number. These have the size of a uintptr, so are 16-bit on AVR.
+func (c *Compiler) maxTypecode() uint64 {
+	bits := c.targetData.TypeSizeInBits(c.uintptrType)
+	if bits >= 64 {
+		return math.MaxUint64
+	}
+	return 1<<bits - 1
+}
+
+// Return the function to put in the method table for this method. Interface
+// method calls pass the receiver as the i8* value of the interface, so methods
+// with a receiver that is not a pointer (including promoted methods of embedded
+// structs) get an $invoke wrapper that extracts the receiver from it and calls
+// the real method.
+//
+// Blocking methods are called as coroutines (see emitDynamicCoroutineCall).
+// Their receiver follows the parent coroutine and result slot parameters, and
+// their wrapper simply returns the coroutine handle of the real method.
+func (c *Compiler) getInvokeFunc(f *Function) llvm.Value {
+	fnType := f.llvmFn.Type().ElementType()
+	receiverIndex := 0
+	if c.ir.IsBlocking(f) {
+		receiverIndex = 1 // parent coroutine
+		if f.fn.Signature.Results().Len() != 0 {
+			receiverIndex = 2 // result slot
+		}
+	}
+	if fnType.ParamTypesCount() <= receiverIndex || fnType.ParamTypes()[receiverIndex].TypeKind() == llvm.PointerTypeKind {
+		return f.llvmFn
+	}
+	if wrapper, ok := c.invokeFuncs[f.llvmFn]; ok {
+		return wrapper
+	}
+
+	paramTypes := fnType.ParamTypes()
+	receiverType := paramTypes[receiverIndex]
+	paramTypes[receiverIndex] = c.i8ptrType
+	wrapperType := llvm.FunctionType(fnType.ReturnType(), paramTypes, false)
+	wrapper := llvm.AddFunction(c.mod, f.LinkName()+"$invoke", wrapperType)
+	wrapper.SetLinkage(llvm.InternalLinkage)
+	c.invokeFuncs[f.llvmFn] = wrapper
+
+	entry := c.ctx.AddBasicBlock(wrapper, "entry")
+	c.builder.SetInsertPointAtEnd(entry)
+	receiverPtr := c.getInterfaceValuePtr(wrapper.Param(receiverIndex), receiverType)
+	params := append([]llvm.Value{}, wrapper.Params()[:receiverIndex]...)
+	params = append(params, c.builder.CreateLoad(receiverPtr, "receiver"))
+	params = append(params, wrapper.Params()[receiverIndex+1:]...)
+	if f.CallsRecover() {
+		// This wrapper is transparent for recover(): when it is called by a
+		// deferred call, so is the method.
+		direct := c.builder.CreateCall(c.mod.NamedFunction("runtime.isDeferredCall"), []llvm.Value{c.builder.CreateBitCast(wrapper, c.i8ptrType, "")}, "recover.direct")
+		setBlock := c.ctx.AddBasicBlock(wrapper, "recover.direct")
+		callBlock := c.ctx.AddBasicBlock(wrapper, "call")
+		c.builder.CreateCondBr(direct, setBlock, callBlock)
+		c.builder.SetInsertPointAtEnd(setBlock)
+		c.emitSetDeferredFunc(f.llvmFn)
+		c.builder.CreateBr(callBlock)
+		c.builder.SetInsertPointAtEnd(callBlock)
+	}
+	result := c.builder.CreateCall(f.llvmFn, params, "")
+	if fnType.ReturnType().TypeKind() == llvm.VoidTypeKind {
+		c.builder.CreateRetVoid()
+	} else {
+		c.builder.CreateRet(result)
+	}
+	return wrapper
+}
+
 // Create a new global hashmap bucket, for map initialization.
 func (c *Compiler) initMapNewBucket(mapType *types.Map) (llvm.Value, uint64, uint64, error) {
 	llvmKeyType, err := c.getLLVMType(mapType.Key().Underlying())
@@ -925,6 +1181,399 @@ func (c *Compiler) initMapNewBucket(mapType *types.Map) (llvm.Value, uint64, uin
 	return bucket, keySize, valueSize, nil
 }
 
+// Return which runtime hashmap functions to use for the given key type:
+// "String" for string keys (like runtime.hashmapStringSet), "Binary" for keys
+// that can be hashed and compared as plain binary data, and "Generic" for all
+// other keys.
+func (c *Compiler) getMapKeyKind(keyType types.Type) (string, error) {
+	if typ, ok := keyType.Underlying().(*types.Basic); ok && typ.Kind() == types.String {
+		return "String", nil
+	}
+	binary, err := c.isBinaryKey(keyType)
+	if err != nil {
+		return "", err
+	}
+	if binary {
+		return "Binary", nil
+	}
+	return "Generic", nil
+}
+
+// Return true if values of this type can be hashed and compared as plain
+// binary data. This is not the case for strings (which contain a pointer),
+// floats (+0 equals -0 and NaN is not equal to itself), interfaces, and structs
+// with padding or blank fields (which may contain anything).
+func (c *Compiler) isBinaryKey(typ types.Type) (bool, error) {
+	switch typ := typ.Underlying().(type) {
+	case *types.Basic:
+		return typ.Info()&(types.IsBoolean|types.IsInteger) != 0 || typ.Kind() == types.UnsafePointer, nil
+	case *types.Pointer, *types.Chan:
+		return true, nil
+	case *types.Array:
+		return c.isBinaryKey(typ.Elem())
+	case *types.Struct:
+		llvmType, err := c.getLLVMType(typ)
+		if err != nil {
+			return false, err
+		}
+		fieldsSize := uint64(0)
+		for i := 0; i < typ.NumFields(); i++ {
+			if typ.Field(i).Name() == "_" {
+				return false, nil
+			}
+			binary, err := c.isBinaryKey(typ.Field(i).Type())
+			if err != nil || !binary {
+				return false, err
+			}
+			fieldsSize += c.targetData.TypeAllocSize(llvmType.StructElementTypes()[i])
+		}
+		return fieldsSize == c.targetData.TypeAllocSize(llvmType), nil
+	default:
+		return false, nil
+	}
+}
+
+// Store a map key in a stack allocation and return a pointer (as i8*) to it.
+func (c *Compiler) emitMapKeyPtr(frame *Frame, key llvm.Value) llvm.Value {
+	keyAlloca := c.createEntryBlockAlloca(key.Type(), "hashmap.key")
+	c.builder.CreateStore(key, keyAlloca)
+	return c.builder.CreateBitCast(keyAlloca, c.i8ptrType, "hashmap.keyptr")
+}
+
+// Call the runtime hashmap function for the given operation ("Set", "Get",
+// "Delete" or "Next") and key kind (see getMapKeyKind). Generic keys also pass
+// the equality and hash functions of the key type.
+func (c *Compiler) emitMapCall(op, keyKind string, keyType types.Type, params []llvm.Value, name string) (llvm.Value, error) {
+	fn := c.mod.NamedFunction("runtime.hashmap" + keyKind + op)
+	if keyKind == "Generic" {
+		funcs, err := c.getMapKeyFuncs(keyType)
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		params = append(params, c.createFuncValue(funcs.equal, fn.Param(len(params)).Type()))
+		params = append(params, c.createFuncValue(funcs.hash, fn.Param(len(params)).Type()))
+	}
+	return c.builder.CreateCall(fn, params, name), nil
+}
+
+// Return the hash and equality functions of a map key type. Only the
+// declarations are created here: the bodies are added at the end of Parse.
+//
+// Key types are looked up by identity, not by name: named types declared in
+// different functions may have the same name but a different layout.
+func (c *Compiler) getMapKeyFuncs(keyType types.Type) (*mapKeyFuncs, error) {
+	if funcs := c.mapKeyFuncs.At(keyType); funcs != nil {
+		return funcs.(*mapKeyFuncs), nil
+	}
+	name := keyType.String()
+	hashType := llvm.FunctionType(llvm.Int32Type(), []llvm.Type{c.i8ptrType, c.uintptrType}, false)
+	equalType := llvm.FunctionType(llvm.Int1Type(), []llvm.Type{c.i8ptrType, c.i8ptrType, c.uintptrType}, false)
+	funcs := &mapKeyFuncs{
+		typ:   keyType,
+		hash:  llvm.AddFunction(c.mod, name+"$hash", hashType),
+		equal: llvm.AddFunction(c.mod, name+"$equal", equalType),
+	}
+	funcs.hash.SetLinkage(llvm.InternalLinkage)
+	funcs.equal.SetLinkage(llvm.InternalLinkage)
+	c.mapKeyFuncs.Set(keyType, funcs)
+	c.mapKeyFuncsList = append(c.mapKeyFuncsList, funcs)
+	return funcs, nil
+}
+
+// Create the body of the hash and equality functions of a map key type, see
+// getMapKeyFuncs.
+func (c *Compiler) parseMapKeyFuncs(funcs *mapKeyFuncs) error {
+	llvmType, err := c.getLLVMType(funcs.typ)
+	if err != nil {
+		return err
+	}
+
+	entry := c.ctx.AddBasicBlock(funcs.hash, "entry")
+	c.builder.SetInsertPointAtEnd(entry)
+	key := c.builder.CreateBitCast(funcs.hash.Param(0), llvm.PointerType(llvmType, 0), "key")
+	hash, err := c.emitKeyHash(funcs.typ, key, llvm.ConstInt(llvm.Int32Type(), 2166136261, false)) // FNV offset basis
+	if err != nil {
+		return err
+	}
+	c.builder.CreateRet(hash)
+
+	entry = c.ctx.AddBasicBlock(funcs.equal, "entry")
+	c.builder.SetInsertPointAtEnd(entry)
+	x := c.builder.CreateBitCast(funcs.equal.Param(0), llvm.PointerType(llvmType, 0), "x")
+	y := c.builder.CreateBitCast(funcs.equal.Param(1), llvm.PointerType(llvmType, 0), "y")
+	result, err := c.emitKeyEqual(funcs.typ, x, y)
+	if err != nil {
+		return err
+	}
+	c.builder.CreateRet(result)
+	return nil
+}
+
+// Create the bodies of runtime.interfaceValueEqual and
+// runtime.interfaceValueHash. They switch over the typecodes of all types that
+// are put in an interface, and compare or hash the value like a map key of that
+// type.
+func (c *Compiler) parseInterfaceValueFuncs() error {
+	equalFn := c.mod.NamedFunction("runtime.interfaceValueEqual")
+	hashFn := c.mod.NamedFunction("runtime.interfaceValueHash")
+	for _, fn := range []llvm.Value{equalFn, hashFn} {
+		fn.SetLinkage(llvm.InternalLinkage)
+		entry := c.ctx.AddBasicBlock(fn, "entry")
+		uncomparable := c.ctx.AddBasicBlock(fn, "uncomparable")
+		c.builder.SetInsertPointAtEnd(uncomparable)
+		c.builder.CreateCall(c.mod.NamedFunction("runtime.interfaceUncomparable"), nil, "")
+		c.builder.CreateUnreachable()
+
+		c.builder.SetInsertPointAtEnd(entry)
+		typecode := fn.Param(0)
+		sw := c.builder.CreateSwitch(typecode, uncomparable, 0)
+		for typecodeNum, typ := range c.ir.AllTypes() {
+			if typ == nil || !types.Comparable(typ) {
+				continue
+			}
+			llvmType, err := c.getLLVMType(typ)
+			if err != nil {
+				return err
+			}
+			block := c.ctx.AddBasicBlock(fn, "typecode")
+			sw.AddCase(llvm.ConstInt(typecode.Type(), uint64(typecodeNum), false), block)
+			c.builder.SetInsertPointAtEnd(block)
+			if fn == equalFn {
+				x := c.getInterfaceValuePtr(fn.Param(1), llvmType)
+				y := c.getInterfaceValuePtr(fn.Param(2), llvmType)
+				result, err := c.emitKeyEqual(typ, x, y)
+				if err != nil {
+					return err
+				}
+				c.builder.CreateRet(result)
+			} else {
+				value := c.getInterfaceValuePtr(fn.Param(1), llvmType)
+				hash, err := c.emitKeyHash(typ, value, llvm.ConstInt(llvm.Int32Type(), 2166136261, false)) // FNV offset basis
+				if err != nil {
+					return err
+				}
+				c.builder.CreateRet(hash)
+			}
+		}
+	}
+	return nil
+}
+
+// Return a pointer to the value of an interface with the given dynamic type.
+// Values that don't fit in the interface are already stored behind a pointer,
+// others are stored directly in the interface (see parseMakeInterface).
+func (c *Compiler) getInterfaceValuePtr(value llvm.Value, llvmType llvm.Type) llvm.Value {
+	if c.targetData.TypeAllocSize(llvmType) > c.targetData.TypeAllocSize(c.i8ptrType) {
+		return c.builder.CreateBitCast(value, llvm.PointerType(llvmType, 0), "")
+	}
+	mem := c.createEntryBlockAlloca(c.i8ptrType, "interface.value")
+	c.builder.CreateStore(value, mem)
+	return c.builder.CreateBitCast(mem, llvm.PointerType(llvmType, 0), "")
+}
+
+// Create a function value of the given LLVM type (a function pointer or a
+// closure) from a function without context parameter. Like with
+// runtime.callFinalizer, the context is simply ignored when it is passed.
+func (c *Compiler) createFuncValue(fn llvm.Value, typ llvm.Type) llvm.Value {
+	if typ.TypeKind() == llvm.StructTypeKind {
+		// closure: {context, function pointer}
+		fnPtr := llvm.ConstBitCast(fn, typ.Subtypes()[1])
+		return llvm.ConstStruct([]llvm.Value{llvm.ConstPointerNull(c.i8ptrType), fnPtr}, false)
+	}
+	return llvm.ConstBitCast(fn, typ)
+}
+
+// Compare two map keys (or interface values) of the given type, stored at the
+// pointers x and y. Returns an i1.
+func (c *Compiler) emitKeyEqual(typ types.Type, x, y llvm.Value) (llvm.Value, error) {
+	binary, err := c.isBinaryKey(typ)
+	if err != nil {
+		return llvm.Value{}, err
+	}
+	switch typ.Underlying().(type) {
+	case *types.Array, *types.Struct:
+		if binary {
+			// Compare the whole array or struct at once.
+			size := llvm.ConstInt(c.uintptrType, c.targetData.TypeAllocSize(x.Type().ElementType()), false)
+			xPtr := c.builder.CreateBitCast(x, c.i8ptrType, "")
+			yPtr := c.builder.CreateBitCast(y, c.i8ptrType, "")
+			return c.builder.CreateCall(c.mod.NamedFunction("runtime.memequal"), []llvm.Value{xPtr, yPtr, size}, ""), nil
+		}
+	}
+
+	switch typ := typ.Underlying().(type) {
+	case *types.Basic:
+		xValue := c.builder.CreateLoad(x, "")
+		yValue := c.builder.CreateLoad(y, "")
+		if typ.Kind() == types.String {
+			return c.builder.CreateCall(c.mod.NamedFunction("runtime.stringEqual"), []llvm.Value{xValue, yValue}, ""), nil
+		} else if typ.Info()&types.IsFloat != 0 {
+			return c.builder.CreateFCmp(llvm.FloatOEQ, xValue, yValue, ""), nil
+		} else if typ.Info()&types.IsComplex != 0 {
+			cmp := c.builder.CreateFCmp(llvm.FloatOEQ, xValue, yValue, "")
+			realEqual := c.builder.CreateExtractElement(cmp, llvm.ConstInt(llvm.Int32Type(), 0, false), "")
+			imagEqual := c.builder.CreateExtractElement(cmp, llvm.ConstInt(llvm.Int32Type(), 1, false), "")
+			return c.builder.CreateAnd(realEqual, imagEqual, ""), nil
+		} else if binary {
+			return c.builder.CreateICmp(llvm.IntEQ, xValue, yValue, ""), nil
+		} else {
+			return llvm.Value{}, errors.New("todo: map key type: " + typ.String())
+		}
+	case *types.Pointer, *types.Chan:
+		xValue := c.builder.CreateLoad(x, "")
+		yValue := c.builder.CreateLoad(y, "")
+		return c.builder.CreateICmp(llvm.IntEQ, xValue, yValue, ""), nil
+	case *types.Interface:
+		xValue := c.builder.CreateLoad(x, "")
+		yValue := c.builder.CreateLoad(y, "")
+		return c.builder.CreateCall(c.mod.NamedFunction("runtime.interfaceEqual"), []llvm.Value{xValue, yValue}, ""), nil
+	case *types.Struct:
+		result := llvm.ConstInt(llvm.Int1Type(), 1, false)
+		zero := llvm.ConstInt(llvm.Int32Type(), 0, false)
+		for i := 0; i < typ.NumFields(); i++ {
+			if typ.Field(i).Name() == "_" {
+				continue // blank fields are ignored in comparisons
+			}
+			index := llvm.ConstInt(llvm.Int32Type(), uint64(i), false)
+			xField := c.builder.CreateGEP(x, []llvm.Value{zero, index}, "")
+			yField := c.builder.CreateGEP(y, []llvm.Value{zero, index}, "")
+			fieldEqual, err := c.emitKeyEqual(typ.Field(i).Type(), xField, yField)
+			if err != nil {
+				return llvm.Value{}, err
+			}
+			result = c.builder.CreateAnd(result, fieldEqual, "")
+		}
+		return result, nil
+	case *types.Array:
+		// Compare the elements one by one, until a difference is found.
+		if typ.Len() == 0 {
+			return llvm.ConstInt(llvm.Int1Type(), 1, false), nil
+		}
+		fn := c.builder.GetInsertBlock().Parent()
+		prevBlock := c.builder.GetInsertBlock()
+		loopBlock := c.ctx.AddBasicBlock(fn, "keyequal.loop")
+		nextBlock := c.ctx.AddBasicBlock(fn, "keyequal.next")
+		doneBlock := c.ctx.AddBasicBlock(fn, "keyequal.done")
+		c.builder.CreateBr(loopBlock)
+
+		c.builder.SetInsertPointAtEnd(loopBlock)
+		index := c.builder.CreatePHI(c.uintptrType, "")
+		zero := llvm.ConstInt(c.uintptrType, 0, false)
+		xElem := c.builder.CreateGEP(x, []llvm.Value{zero, index}, "")
+		yElem := c.builder.CreateGEP(y, []llvm.Value{zero, index}, "")
+		elemEqual, err := c.emitKeyEqual(typ.Elem(), xElem, yElem)
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		loopExit := c.builder.GetInsertBlock()
+		c.builder.CreateCondBr(elemEqual, nextBlock, doneBlock)
+
+		c.builder.SetInsertPointAtEnd(nextBlock)
+		nextIndex := c.builder.CreateAdd(index, llvm.ConstInt(c.uintptrType, 1, false), "")
+		length := llvm.ConstInt(c.uintptrType, uint64(typ.Len()), false)
+		more := c.builder.CreateICmp(llvm.IntULT, nextIndex, length, "")
+		c.builder.CreateCondBr(more, loopBlock, doneBlock)
+		index.AddIncoming([]llvm.Value{zero, nextIndex}, []llvm.BasicBlock{prevBlock, nextBlock})
+
+		c.builder.SetInsertPointAtEnd(doneBlock)
+		result := c.builder.CreatePHI(llvm.Int1Type(), "")
+		result.AddIncoming([]llvm.Value{
+			llvm.ConstInt(llvm.Int1Type(), 0, false),
+			llvm.ConstInt(llvm.Int1Type(), 1, false),
+		}, []llvm.BasicBlock{loopExit, nextBlock})
+		return result, nil
+	default:
+		return llvm.Value{}, errors.New("todo: map key type: " + typ.String())
+	}
+}
+
+// Hash a map key (or interface value) of the given type stored at ptr, and mix
+// it into the given hash. Returns the new hash.
+func (c *Compiler) emitKeyHash(typ types.Type, ptr, hash llvm.Value) (llvm.Value, error) {
+	binary, err := c.isBinaryKey(typ)
+	if err != nil {
+		return llvm.Value{}, err
+	}
+	var valueHash llvm.Value
+	if binary {
+		size := llvm.ConstInt(c.uintptrType, c.targetData.TypeAllocSize(ptr.Type().ElementType()), false)
+		bytes := c.builder.CreateBitCast(ptr, c.i8ptrType, "")
+		valueHash = c.builder.CreateCall(c.mod.NamedFunction("runtime.hashmapHash"), []llvm.Value{bytes, size}, "")
+	} else {
+		switch typ := typ.Underlying().(type) {
+		case *types.Basic:
+			switch typ.Kind() {
+			case types.String:
+				value := c.builder.CreateLoad(ptr, "")
+				valueHash = c.builder.CreateCall(c.mod.NamedFunction("runtime.hashmapStringHash"), []llvm.Value{value}, "")
+			case types.Float32, types.Float64, types.Complex64, types.Complex128:
+				// runtime.hashmap{Float,Complex}{32,64,128}Hash
+				name := "runtime.hashmap" + strings.Title(typ.Name()) + "Hash"
+				fn := c.mod.NamedFunction(name)
+				size := llvm.ConstInt(c.uintptrType, c.targetData.TypeAllocSize(ptr.Type().ElementType()), false)
+				bytes := c.builder.CreateBitCast(ptr, c.i8ptrType, "")
+				valueHash = c.builder.CreateCall(fn, []llvm.Value{bytes, size}, "")
+			default:
+				return llvm.Value{}, errors.New("todo: map key type: " + typ.String())
+			}
+		case *types.Interface:
+			value := c.builder.CreateLoad(ptr, "")
+			valueHash = c.builder.CreateCall(c.mod.NamedFunction("runtime.interfaceHash"), []llvm.Value{value}, "")
+		case *types.Struct:
+			zero := llvm.ConstInt(llvm.Int32Type(), 0, false)
+			for i := 0; i < typ.NumFields(); i++ {
+				if typ.Field(i).Name() == "_" {
+					continue // blank fields are ignored in comparisons
+				}
+				index := llvm.ConstInt(llvm.Int32Type(), uint64(i), false)
+				field := c.builder.CreateGEP(ptr, []llvm.Value{zero, index}, "")
+				hash, err = c.emitKeyHash(typ.Field(i).Type(), field, hash)
+				if err != nil {
+					return llvm.Value{}, err
+				}
+			}
+			return hash, nil
+		case *types.Array:
+			// Hash the elements one by one.
+			if typ.Len() == 0 {
+				return hash, nil
+			}
+			fn := c.builder.GetInsertBlock().Parent()
+			prevBlock := c.builder.GetInsertBlock()
+			loopBlock := c.ctx.AddBasicBlock(fn, "keyhash.loop")
+			doneBlock := c.ctx.AddBasicBlock(fn, "keyhash.done")
+			c.builder.CreateBr(loopBlock)
+
+			c.builder.SetInsertPointAtEnd(loopBlock)
+			index := c.builder.CreatePHI(c.uintptrType, "")
+			loopHash := c.builder.CreatePHI(llvm.Int32Type(), "")
+			zero := llvm.ConstInt(c.uintptrType, 0, false)
+			elem := c.builder.CreateGEP(ptr, []llvm.Value{zero, index}, "")
+			nextHash, err := c.emitKeyHash(typ.Elem(), elem, loopHash)
+			if err != nil {
+				return llvm.Value{}, err
+			}
+			nextIndex := c.builder.CreateAdd(index, llvm.ConstInt(c.uintptrType, 1, false), "")
+			length := llvm.ConstInt(c.uintptrType, uint64(typ.Len()), false)
+			more := c.builder.CreateICmp(llvm.IntULT, nextIndex, length, "")
+			loopExit := c.builder.GetInsertBlock()
+			c.builder.CreateCondBr(more, loopBlock, doneBlock)
+			index.AddIncoming([]llvm.Value{zero, nextIndex}, []llvm.BasicBlock{prevBlock, loopExit})
+			loopHash.AddIncoming([]llvm.Value{hash, nextHash}, []llvm.BasicBlock{prevBlock, loopExit})
+
+			c.builder.SetInsertPointAtEnd(doneBlock)
+			return nextHash, nil
+		default:
+			return llvm.Value{}, errors.New("todo: map key type: " + typ.String())
+		}
+	}
+
+	// Mix the hash of this value into the hash, like FNV-1a does with every
+	// byte.
+	hash = c.builder.CreateXor(hash, valueHash, "")
+	return c.builder.CreateMul(hash, llvm.ConstInt(llvm.Int32Type(), 16777619, false), ""), nil // FNV prime
+}
+
 func (c *Compiler) parseGlobalInitializer(g *Global) error {
 	if g.IsExtern() {
 		return nil
@@ -990,7 +1639,7 @@ func (c *Compiler) getInterpretedValue(value Value) (llvm.Value, error) {
 			}
 			underlying = elem
 		}
-		return c.parseMakeInterface(underlying, value.Type, true)
+		return c.parseMakeInterface(nil, nil, underlying, value.Type, true)
 
 	case *MapValue:
 		// Create initial bucket.
@@ -1041,7 +1690,7 @@ func (c *Compiler) getInterpretedValue(value Value) (llvm.Value, error) {
 
 		// Create the hashmap itself.
 		zero := llvm.ConstInt(llvm.Int32Type(), 0, false)
-		bucketPtr := llvm.ConstInBoundsGEP(bucketGlobal, []llvm.Value{zero})
+		bucketPtr := llvm.ConstInBoundsGEP(firstBucketGlobal, []llvm.Value{zero})
 		hashmapType := c.mod.GetTypeByName("runtime.hashmap")
 		hashmap := llvm.ConstNamedStruct(hashmapType, []llvm.Value{
 			llvm.ConstPointerNull(llvm.PointerType(hashmapType, 0)),  // next
@@ -1050,6 +1699,7 @@ func (c *Compiler) getInterpretedValue(value Value) (llvm.Value, error) {
 			llvm.ConstInt(llvm.Int8Type(), keySize, false),           // keySize
 			llvm.ConstInt(llvm.Int8Type(), valueSize, false),         // valueSize
 			llvm.ConstInt(llvm.Int8Type(), 0, false),                 // bucketBits
+			llvm.ConstInt(c.uintptrType, 0, false),                   // evacuated
 		})
 
 		// Create a pointer to this hashmap.
@@ -1172,6 +1822,52 @@ func (c *Compiler) getInterpretedValue(value Value) (llvm.Value, error) {
 	}
 }
 
+// Return the LLVM type of the results of a function: the type of the result
+// for a single result, a struct of all results for multiple results, or a nil
+// type if there are no results.
+func (c *Compiler) getResultType(sig *types.Signature) (llvm.Type, error) {
+	switch sig.Results().Len() {
+	case 0:
+		return llvm.Type{}, nil
+	case 1:
+		return c.getLLVMType(sig.Results().At(0).Type())
+	default:
+		results := make([]llvm.Type, 0, sig.Results().Len())
+		for i := 0; i < sig.Results().Len(); i++ {
+			typ, err := c.getLLVMType(sig.Results().At(i).Type())
+			if err != nil {
+				return llvm.Type{}, err
+			}
+			results = append(results, typ)
+		}
+		return llvm.StructType(results, false), nil
+	}
+}
+
+// Evaluate the results of a return instruction as a single value, see
+// getResultType. Multiple return values are put in a struct.
+func (c *Compiler) parseResults(frame *Frame, results []ssa.Value) (llvm.Value, error) {
+	if len(results) == 1 {
+		return c.parseExpr(frame, results[0])
+	}
+	resultType, err := c.getResultType(frame.fn.fn.Signature)
+	if err != nil {
+		return llvm.Value{}, err
+	}
+	retVal, err := getZeroValue(resultType)
+	if err != nil {
+		return llvm.Value{}, err
+	}
+	for i, result := range results {
+		val, err := c.parseExpr(frame, result)
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		retVal = c.builder.CreateInsertValue(retVal, val, i, "")
+	}
+	return retVal, nil
+}
+
 func (c *Compiler) parseFunc(frame *Frame) error {
 	if c.dumpSSA {
 		fmt.Printf("\nfunc %s:\n", frame.fn.fn)
@@ -1227,7 +1923,7 @@ func (c *Compiler) parseFunc(frame *Frame) error {
 			panic("free variables on function without context")
 		}
 		c.builder.SetInsertPointAtEnd(entryBlock)
-		context := frame.fn.llvmFn.Param(len(frame.fn.fn.Params))
+		context := frame.fn.llvmFn.Param(frame.fn.llvmFn.ParamsCount() - 1)
 
 		// Determine the context type. It's a struct containing all variables.
 		freeVarTypes := make([]llvm.Type, 0, len(frame.fn.fn.FreeVars))
@@ -1270,11 +1966,24 @@ func (c *Compiler) parseFunc(frame *Frame) error {
 
 	c.builder.SetInsertPointAtEnd(entryBlock)
 
-	if frame.fn.fn.Recover != nil {
-		// Create defer list pointer.
-		deferType := llvm.PointerType(c.mod.GetTypeByName("runtime._defer"), 0)
-		frame.deferPtr = c.builder.CreateAlloca(deferType, "deferPtr")
-		c.builder.CreateStore(llvm.ConstPointerNull(deferType), frame.deferPtr)
+	if frame.fn.CallsRecover() {
+		// recover() only stops a panic when called directly by a deferred
+		// function. Check this before anything else is called.
+		fnPtr := c.builder.CreateBitCast(frame.fn.llvmFn, c.i8ptrType, "")
+		frame.canRecover = c.builder.CreateCall(c.mod.NamedFunction("runtime.isDeferredCall"), []llvm.Value{fnPtr}, "recover.direct")
+	}
+
+	if frame.fn.fn.Recover != nil {
+		if !frame.blocking && c.supportsRecover() {
+			// Create a defer frame, which contains the defer list pointer.
+			c.emitDeferFrame(frame)
+		} else {
+			// Create defer list pointer. These deferred calls are not run
+			// on a panic.
+			deferType := llvm.PointerType(c.mod.GetTypeByName("runtime._defer"), 0)
+			frame.deferPtr = c.builder.CreateAlloca(deferType, "deferPtr")
+			c.builder.CreateStore(llvm.ConstPointerNull(deferType), frame.deferPtr)
+		}
 	}
 
 	if frame.blocking {
@@ -1295,13 +2004,23 @@ func (c *Compiler) parseFunc(frame *Frame) error {
 		}
 		data := c.builder.CreateCall(c.allocFunc, []llvm.Value{size}, "task.data")
 		frame.taskHandle = c.builder.CreateCall(c.coroBeginFunc, []llvm.Value{id, data}, "task.handle")
+		if c.debug {
+			// Store the function name and the calling coroutine in the task
+			// state, so that the call stack of each goroutine can be printed
+			// when the scheduler detects a deadlock.
+			zero := llvm.ConstInt(llvm.Int32Type(), 0, false)
+			namePtr := c.builder.CreateGEP(taskState, []llvm.Value{zero, llvm.ConstInt(llvm.Int32Type(), 5, false)}, "task.state.function")
+			c.builder.CreateStore(c.createConstString(frame.fn.fn.RelString(nil)), namePtr)
+			parentPtr := c.builder.CreateGEP(taskState, []llvm.Value{zero, llvm.ConstInt(llvm.Int32Type(), 6, false)}, "task.state.parent")
+			c.builder.CreateStore(frame.fn.llvmFn.FirstParam(), parentPtr)
+		}
 
 		// Coroutine cleanup. Free resources associated with this coroutine.
 		c.builder.SetInsertPointAtEnd(frame.cleanupBlock)
 		mem := c.builder.CreateCall(c.coroFreeFunc, []llvm.Value{id, frame.taskHandle}, "task.data.free")
 		c.builder.CreateCall(c.freeFunc, []llvm.Value{mem}, "")
 		// re-insert parent coroutine
-		c.builder.CreateCall(c.mod.NamedFunction("runtime.yieldToScheduler"), []llvm.Value{frame.fn.llvmFn.FirstParam()}, "")
+		c.builder.CreateCall(c.mod.NamedFunction("runtime.activateTask"), []llvm.Value{frame.fn.llvmFn.FirstParam()}, "")
 		c.builder.CreateBr(frame.suspendBlock)
 
 		// Coroutine suspend. A call to llvm.coro.suspend() will branch here.
@@ -1332,6 +2051,9 @@ func (c *Compiler) parseFunc(frame *Frame) error {
 		if frame.fn.fn.Name() == "init" && len(block.Instrs) == 0 {
 			c.builder.CreateRetVoid()
 		}
+		// Instructions like a suspend point may have split the block, so
+		// remember where it ends for the phi nodes below.
+		frame.blockExits[block] = c.builder.GetInsertBlock()
 	}
 
 	// Resolve phi nodes
@@ -1342,7 +2064,7 @@ func (c *Compiler) parseFunc(frame *Frame) error {
 			if err != nil {
 				return err
 			}
-			llvmBlock := frame.blocks[block.Preds[i]]
+			llvmBlock := frame.blockExits[block.Preds[i]]
 			phi.llvm.AddIncoming([]llvm.Value{llvmVal}, []llvm.BasicBlock{llvmBlock})
 		}
 	}
@@ -1368,40 +2090,172 @@ func (c *Compiler) parseInstr(frame *Frame, instr ssa.Instruction) error {
 	case *ssa.DebugRef:
 		return nil // ignore
 	case *ssa.Defer:
-		if _, ok := instr.Call.Value.(*ssa.Function); !ok || instr.Call.IsInvoke() {
-			return errors.New("todo: non-direct function calls in defer")
-		}
-		fn := c.ir.GetFunction(instr.Call.Value.(*ssa.Function))
-
 		// The pointer to the previous defer struct, which we will replace to
 		// make a linked list.
 		next := c.builder.CreateLoad(frame.deferPtr, "defer.next")
 
-		// Try to find the wrapper $defer function.
-		deferName := fn.LinkName() + "$defer"
-		callback := c.mod.NamedFunction(deferName)
-		if callback.IsNil() {
-			// Not found, have to add it.
+		// The values that must be stored in the defer struct, after the
+		// runtime._defer fields. Everything that is needed for the call
+		// (function pointers, closure contexts, interface receivers and
+		// parameters) is evaluated now, at the point of the defer statement.
+		var callback llvm.Value
+		var values []llvm.Value
+		var blockingSite *blockingDefer
+		if c.isBlockingCall(&instr.Call) {
+			// Only blocking functions can defer a blocking call. It is made by
+			// this function when running its deferred calls, which finds it
+			// by the index that follows the runtime._defer fields. The
+			// callback is nil to tell it apart from other deferred calls.
+			var params []llvm.Value
+			var err error
+			if fn := instr.Call.StaticCallee(); fn != nil {
+				params, err = c.parseDeferParams(frame, instr.Call.Args)
+				if err != nil {
+					return err
+				}
+				if c.ir.FunctionNeedsContext(c.ir.GetFunction(fn)) {
+					context := llvm.ConstPointerNull(c.i8ptrType)
+					if mkClosure, ok := instr.Call.Value.(*ssa.MakeClosure); ok {
+						// closure is {context, function pointer}
+						closure, err := c.parseExpr(frame, mkClosure)
+						if err != nil {
+							return err
+						}
+						context = c.builder.CreateExtractValue(closure, 0, "")
+					}
+					params = append(params, context)
+				}
+			} else {
+				fnPtr, fnParams, err := c.parseDynamicCoroutineCall(frame, &instr.Call)
+				if err != nil {
+					return err
+				}
+				params = append([]llvm.Value{fnPtr}, fnParams...)
+			}
+			index := llvm.ConstInt(llvm.Int32Type(), uint64(len(frame.blockingDefers)), false)
+			values = append([]llvm.Value{index}, params...)
 			deferFuncType := llvm.FunctionType(llvm.VoidType(), []llvm.Type{next.Type()}, false)
-			callback = llvm.AddFunction(c.mod, deferName, deferFuncType)
-			c.deferFuncs = append(c.deferFuncs, fn)
-		}
+			callback = llvm.ConstPointerNull(llvm.PointerType(deferFuncType, 0))
+			blockingSite = &blockingDefer{call: &instr.Call}
+			frame.blockingDefers = append(frame.blockingDefers, blockingSite)
+		} else if instr.Call.IsInvoke() {
+			// Interface method call. Look up the method now and call it
+			// through a function pointer when the deferred calls are run.
+			itf, err := c.parseExpr(frame, instr.Call.Value)
+			if err != nil {
+				return err
+			}
+			llvmFnType, err := c.getLLVMType(instr.Call.Method.Type())
+			if err != nil {
+				return err
+			}
+			needsContext := c.ir.SignatureNeedsContext(instr.Call.Method.Type().(*types.Signature))
+			if needsContext {
+				// See parseCall: an interface call is never a closure call.
+				llvmFnType = llvmFnType.Subtypes()[1]
+			}
+			methodNum := llvm.ConstInt(c.uintptrType, uint64(c.ir.MethodNum(instr.Call.Method)), false)
+			fnPtr := c.builder.CreateCall(c.mod.NamedFunction("runtime.interfaceMethod"), []llvm.Value{itf, methodNum}, "invoke.func")
+			fnPtr = c.builder.CreateBitCast(fnPtr, llvmFnType, "invoke.func.cast")
+			receiver := c.builder.CreateExtractValue(itf, 1, "invoke.func.receiver")
+			values = append(values, fnPtr, receiver)
+			params, err := c.parseDeferParams(frame, instr.Call.Args)
+			if err != nil {
+				return err
+			}
+			values = append(values, params...)
+			if needsContext {
+				values = append(values, llvm.ConstPointerNull(c.i8ptrType))
+			}
+			callback = c.getDeferFuncPtrWrapper(fnPtr.Type(), next.Type())
+		} else if fn := instr.Call.StaticCallee(); fn != nil {
+			// Direct function call, possibly to a closure.
+			targetFunc := c.ir.GetFunction(fn)
+			if frame.blocking && targetFunc.CallsRecover() {
+				// Blocking functions have no defer frame, so a panic never
+				// runs their deferred calls and there is nothing to recover.
+				return errors.New("todo: recover in a deferred call of blocking function " + frame.fn.LinkName())
+			}
+			params, err := c.parseDeferParams(frame, instr.Call.Args)
+			if err != nil {
+				return err
+			}
+			values = append(values, params...)
+			if c.ir.FunctionNeedsContext(targetFunc) {
+				context := llvm.ConstPointerNull(c.i8ptrType)
+				if mkClosure, ok := instr.Call.Value.(*ssa.MakeClosure); ok {
+					// closure is {context, function pointer}
+					closure, err := c.parseExpr(frame, mkClosure)
+					if err != nil {
+						return err
+					}
+					context = c.builder.CreateExtractValue(closure, 0, "")
+				}
+				values = append(values, context)
+			}
 
-		// Collect all values to be put in the struct (starting with
-		// runtime._defer fields).
-		values := []llvm.Value{callback, next}
-		valueTypes := []llvm.Type{callback.Type(), next.Type()}
-		for _, param := range instr.Call.Args {
-			llvmParam, err := c.parseExpr(frame, param)
+			// Try to find the wrapper $defer function.
+			deferName := targetFunc.LinkName() + "$defer"
+			callback = c.mod.NamedFunction(deferName)
+			if callback.IsNil() {
+				// Not found, have to add it.
+				deferFuncType := llvm.FunctionType(llvm.VoidType(), []llvm.Type{next.Type()}, false)
+				callback = llvm.AddFunction(c.mod, deferName, deferFuncType)
+				c.deferFuncs = append(c.deferFuncs, targetFunc)
+			}
+		} else if builtin, ok := instr.Call.Value.(*ssa.Builtin); ok {
+			// Builtin, which is called from a wrapper with the arguments
+			// evaluated here.
+			params, err := c.parseDeferParams(frame, instr.Call.Args)
+			if err != nil {
+				return err
+			}
+			values = append(values, params...)
+			deferFuncType := llvm.FunctionType(llvm.VoidType(), []llvm.Type{next.Type()}, false)
+			callback = llvm.AddFunction(c.mod, frame.fn.LinkName()+"$defer."+builtin.Name(), deferFuncType)
+			callback.SetLinkage(llvm.InternalLinkage)
+			c.deferBuiltins = append(c.deferBuiltins, &deferBuiltin{
+				wrapper: callback,
+				name:    builtin.Name(),
+				args:    instr.Call.Args,
+			})
+		} else {
+			// Function pointer, which may be a closure or bound method.
+			fnPtr, err := c.parseExpr(frame, instr.Call.Value)
+			if err != nil {
+				return err
+			}
+			var context llvm.Value
+			if c.ir.SignatureNeedsContext(instr.Call.Signature()) {
+				// closure: {context, function pointer}
+				context = c.builder.CreateExtractValue(fnPtr, 0, "")
+				fnPtr = c.builder.CreateExtractValue(fnPtr, 1, "")
+			}
+			values = append(values, fnPtr)
+			params, err := c.parseDeferParams(frame, instr.Call.Args)
 			if err != nil {
 				return err
 			}
-			values = append(values, llvmParam)
-			valueTypes = append(valueTypes, llvmParam.Type())
+			values = append(values, params...)
+			if !context.IsNil() {
+				values = append(values, context)
+			}
+			callback = c.getDeferFuncPtrWrapper(fnPtr.Type(), next.Type())
+		}
+
+		// Collect all values to be put in the struct (starting with
+		// runtime._defer fields).
+		values = append([]llvm.Value{callback, next}, values...)
+		valueTypes := make([]llvm.Type, len(values))
+		for i, value := range values {
+			valueTypes[i] = value.Type()
 		}
 
 		// Make a struct out of it.
 		contextType := llvm.StructType(valueTypes, false)
+		if blockingSite != nil {
+			blockingSite.contextType = contextType
+		}
 		context, err := getZeroValue(contextType)
 		if err != nil {
 			return err
@@ -1410,8 +2264,17 @@ func (c *Compiler) parseInstr(frame *Frame, instr ssa.Instruction) error {
 			context = c.builder.CreateInsertValue(context, value, i, "")
 		}
 
-		// Put this struct in an alloca.
-		alloca := c.builder.CreateAlloca(contextType, "defer.alloca")
+		// Put this struct in an alloca. Coroutines allocate it on the heap
+		// instead, as it must survive suspend points (and there may be many
+		// of them when deferring in a loop).
+		var alloca llvm.Value
+		if frame.blocking {
+			size := llvm.ConstInt(c.uintptrType, c.targetData.TypeAllocSize(contextType), false)
+			buf := c.builder.CreateCall(c.allocFunc, []llvm.Value{size}, "defer.alloc")
+			alloca = c.builder.CreateBitCast(buf, llvm.PointerType(contextType, 0), "")
+		} else {
+			alloca = c.builder.CreateAlloca(contextType, "defer.alloca")
+		}
 		c.builder.CreateStore(context, alloca)
 
 		// Push it on top of the linked list by replacing deferPtr.
@@ -1420,13 +2283,9 @@ func (c *Compiler) parseInstr(frame *Frame, instr ssa.Instruction) error {
 		return nil
 
 	case *ssa.Go:
-		if instr.Common().Method != nil {
-			return errors.New("todo: go on method receiver")
-		}
-
 		// Execute non-blocking calls (including builtins) directly.
 		// parentHandle param is ignored.
-		if !c.ir.IsBlocking(c.ir.GetFunction(instr.Common().Value.(*ssa.Function))) {
+		if !c.isBlockingCall(instr.Common()) {
 			_, err := c.parseCall(frame, instr.Common(), llvm.Value{})
 			return err // probably nil
 		}
@@ -1467,31 +2326,19 @@ func (c *Compiler) parseInstr(frame *Frame, instr ssa.Instruction) error {
 		if err != nil {
 			return err
 		}
-		mapType := instr.Map.Type().Underlying().(*types.Map)
-		switch keyType := mapType.Key().Underlying().(type) {
-		case *types.Basic:
-			valueAlloca := c.builder.CreateAlloca(value.Type(), "hashmap.value")
-			c.builder.CreateStore(value, valueAlloca)
-			valuePtr := c.builder.CreateBitCast(valueAlloca, c.i8ptrType, "hashmap.valueptr")
-			if keyType.Kind() == types.String {
-				params := []llvm.Value{m, key, valuePtr}
-				fn := c.mod.NamedFunction("runtime.hashmapStringSet")
-				c.builder.CreateCall(fn, params, "")
-				return nil
-			} else if keyType.Info()&(types.IsBoolean|types.IsInteger) != 0 {
-				keyAlloca := c.builder.CreateAlloca(key.Type(), "hashmap.key")
-				c.builder.CreateStore(key, keyAlloca)
-				keyPtr := c.builder.CreateBitCast(keyAlloca, c.i8ptrType, "hashmap.keyptr")
-				params := []llvm.Value{m, keyPtr, valuePtr}
-				fn := c.mod.NamedFunction("runtime.hashmapBinarySet")
-				c.builder.CreateCall(fn, params, "")
-				return nil
-			} else {
-				return errors.New("todo: map update key type: " + keyType.String())
-			}
-		default:
-			return errors.New("todo: map update key type: " + keyType.String())
+		keyType := instr.Map.Type().Underlying().(*types.Map).Key()
+		keyKind, err := c.getMapKeyKind(keyType)
+		if err != nil {
+			return err
+		}
+		valueAlloca := c.createEntryBlockAlloca(value.Type(), "hashmap.value")
+		c.builder.CreateStore(value, valueAlloca)
+		valuePtr := c.builder.CreateBitCast(valueAlloca, c.i8ptrType, "hashmap.valueptr")
+		if keyKind != "String" {
+			key = c.emitMapKeyPtr(frame, key)
 		}
+		_, err = c.emitMapCall("Set", keyKind, keyType, []llvm.Value{m, key, valuePtr}, "")
+		return err
 	case *ssa.Panic:
 		value, err := c.parseExpr(frame, instr.X)
 		if err != nil {
@@ -1503,7 +2350,21 @@ func (c *Compiler) parseInstr(frame *Frame, instr ssa.Instruction) error {
 	case *ssa.Return:
 		if frame.blocking {
 			if len(instr.Results) != 0 {
-				return errors.New("todo: return values from blocking function")
+				// Store the results in the slot provided by the caller. It
+				// is nil when the function was started as a goroutine.
+				retVal, err := c.parseResults(frame, instr.Results)
+				if err != nil {
+					return err
+				}
+				slot := frame.fn.llvmFn.Param(1)
+				hasSlot := c.builder.CreateICmp(llvm.IntNE, slot, llvm.ConstPointerNull(slot.Type()), "result.hasSlot")
+				storeBlock := c.ctx.InsertBasicBlock(llvm.NextBasicBlock(c.builder.GetInsertBlock()), "result.store")
+				doneBlock := c.ctx.InsertBasicBlock(llvm.NextBasicBlock(storeBlock), "result.done")
+				c.builder.CreateCondBr(hasSlot, storeBlock, doneBlock)
+				c.builder.SetInsertPointAtEnd(storeBlock)
+				c.builder.CreateStore(retVal, slot)
+				c.builder.CreateBr(doneBlock)
+				c.builder.SetInsertPointAtEnd(doneBlock)
 			}
 			// Final suspend.
 			continuePoint := c.builder.CreateCall(c.coroSuspendFunc, []llvm.Value{
@@ -1514,38 +2375,31 @@ func (c *Compiler) parseInstr(frame *Frame, instr ssa.Instruction) error {
 			sw.AddCase(llvm.ConstInt(llvm.Int8Type(), 1, false), frame.cleanupBlock)
 			return nil
 		} else {
+			if !frame.deferFrame.IsNil() {
+				// Remove the defer frame of this function from the stack.
+				c.builder.CreateCall(c.mod.NamedFunction("runtime.popDeferFrame"), []llvm.Value{frame.deferFrame}, "")
+			}
 			if len(instr.Results) == 0 {
 				c.builder.CreateRetVoid()
 				return nil
-			} else if len(instr.Results) == 1 {
-				val, err := c.parseExpr(frame, instr.Results[0])
-				if err != nil {
-					return err
-				}
-				c.builder.CreateRet(val)
-				return nil
 			} else {
-				// Multiple return values. Put them all in a struct.
-				retVal, err := getZeroValue(frame.fn.llvmFn.Type().ElementType().ReturnType())
+				retVal, err := c.parseResults(frame, instr.Results)
 				if err != nil {
 					return err
 				}
-				for i, result := range instr.Results {
-					val, err := c.parseExpr(frame, result)
-					if err != nil {
-						return err
-					}
-					retVal = c.builder.CreateInsertValue(retVal, val, i, "")
-				}
 				c.builder.CreateRet(retVal)
 				return nil
 			}
 		}
 	case *ssa.RunDefers:
-		deferData := c.builder.CreateLoad(frame.deferPtr, "")
+		if len(frame.blockingDefers) != 0 {
+			return c.emitRunDefers(frame)
+		}
 		fn := c.mod.NamedFunction("runtime.rundefers")
-		c.builder.CreateCall(fn, []llvm.Value{deferData}, "")
+		c.builder.CreateCall(fn, []llvm.Value{frame.deferPtr}, "")
 		return nil
+	case *ssa.Send:
+		return c.emitChanSend(frame, instr)
 	case *ssa.Store:
 		llvmAddr, err := c.parseExpr(frame, instr.Addr)
 		if err == cgoWrapperError {
@@ -1560,6 +2414,12 @@ func (c *Compiler) parseInstr(frame *Frame, instr ssa.Instruction) error {
 			return err
 		}
 		store := c.builder.CreateStore(llvmVal, llvmAddr)
+		if !frame.deferFrame.IsNil() && isAllocAddr(instr.Addr) {
+			// Make sure the value is stored in memory and not kept in a
+			// register, so that it is still visible after a recovered panic
+			// (for example, the values of named results).
+			store.SetVolatile(true)
+		}
 		valType := instr.Addr.Type().(*types.Pointer).Elem()
 		if valType, ok := valType.(*types.Named); ok && valType.Obj().Name() == "__volatile" {
 			// Magic type name to make this store volatile, for memory-mapped
@@ -1574,17 +2434,94 @@ func (c *Compiler) parseInstr(frame *Frame, instr ssa.Instruction) error {
 
 func (c *Compiler) parseBuiltin(frame *Frame, args []ssa.Value, callName string) (llvm.Value, error) {
 	switch callName {
+	case "append":
+		src, err := c.parseExpr(frame, args[0])
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		if len(args) == 1 {
+			// append(src) without elements returns src unchanged.
+			return src, nil
+		}
+		elems, err := c.parseExpr(frame, args[1])
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		// The elements to append are either a slice, or a string in the case
+		// of append([]byte, string...). Both start with a pointer and length.
+		srcBuf := c.builder.CreateExtractValue(src, 0, "append.srcBuf")
+		srcPtr := c.builder.CreateBitCast(srcBuf, c.i8ptrType, "append.srcPtr")
+		srcLen := c.builder.CreateExtractValue(src, 1, "append.srcLen")
+		srcCap := c.builder.CreateExtractValue(src, 2, "append.srcCap")
+		elemsBuf := c.builder.CreateExtractValue(elems, 0, "append.elemsBuf")
+		elemsPtr := c.builder.CreateBitCast(elemsBuf, c.i8ptrType, "append.elemsPtr")
+		elemsLen := c.builder.CreateExtractValue(elems, 1, "append.elemsLen")
+		elemType := srcBuf.Type().ElementType()
+		elemSize := llvm.ConstInt(c.uintptrType, c.targetData.TypeAllocSize(elemType), false)
+		sliceAppend := c.mod.NamedFunction("runtime.sliceAppend")
+		result := c.builder.CreateCall(sliceAppend, []llvm.Value{srcPtr, elemsPtr, srcLen, srcCap, elemsLen, elemSize}, "append.new")
+		newPtr := c.builder.CreateExtractValue(result, 0, "append.newPtr")
+		newBuf := c.builder.CreateBitCast(newPtr, srcBuf.Type(), "append.newBuf")
+		newLen := c.builder.CreateExtractValue(result, 1, "append.newLen")
+		newCap := c.builder.CreateExtractValue(result, 2, "append.newCap")
+		newSlice := llvm.Undef(src.Type())
+		newSlice = c.builder.CreateInsertValue(newSlice, newBuf, 0, "")
+		newSlice = c.builder.CreateInsertValue(newSlice, newLen, 1, "")
+		newSlice = c.builder.CreateInsertValue(newSlice, newCap, 2, "")
+		return newSlice, nil
 	case "cap":
 		value, err := c.parseExpr(frame, args[0])
 		if err != nil {
 			return llvm.Value{}, err
 		}
-		switch args[0].Type().(type) {
+		switch typ := args[0].Type().Underlying().(type) {
 		case *types.Slice:
 			return c.builder.CreateExtractValue(value, 2, "cap"), nil
+		case *types.Array:
+			return llvm.ConstInt(c.intType, uint64(typ.Len()), false), nil
+		case *types.Pointer:
+			// pointer to array
+			arrayType := typ.Elem().Underlying().(*types.Array)
+			return llvm.ConstInt(c.intType, uint64(arrayType.Len()), false), nil
+		case *types.Chan:
+			return c.builder.CreateCall(c.mod.NamedFunction("runtime.chanCap"), []llvm.Value{value}, "cap"), nil
 		default:
 			return llvm.Value{}, errors.New("todo: cap: unknown type")
 		}
+	case "recover":
+		return c.builder.CreateCall(c.mod.NamedFunction("runtime._recover"), []llvm.Value{frame.canRecover}, ""), nil
+	case "close":
+		value, err := c.parseExpr(frame, args[0])
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		c.builder.CreateCall(c.mod.NamedFunction("runtime.chanClose"), []llvm.Value{value}, "")
+		return llvm.Value{}, nil // close() returns void
+	case "complex":
+		r, err := c.parseExpr(frame, args[0])
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		i, err := c.parseExpr(frame, args[1])
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		cplx := llvm.Undef(llvm.VectorType(r.Type(), 2))
+		cplx = c.builder.CreateInsertElement(cplx, r, llvm.ConstInt(llvm.Int32Type(), 0, false), "")
+		cplx = c.builder.CreateInsertElement(cplx, i, llvm.ConstInt(llvm.Int32Type(), 1, false), "")
+		return cplx, nil
+	case "real":
+		cplx, err := c.parseExpr(frame, args[0])
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		return c.builder.CreateExtractElement(cplx, llvm.ConstInt(llvm.Int32Type(), 0, false), "real"), nil
+	case "imag":
+		cplx, err := c.parseExpr(frame, args[0])
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		return c.builder.CreateExtractElement(cplx, llvm.ConstInt(llvm.Int32Type(), 1, false), "imag"), nil
 	case "copy":
 		dst, err := c.parseExpr(frame, args[0])
 		if err != nil {
@@ -1604,22 +2541,44 @@ func (c *Compiler) parseBuiltin(frame *Frame, args []ssa.Value, callName string)
 		elemSize := llvm.ConstInt(c.uintptrType, c.targetData.TypeAllocSize(elemType), false)
 		sliceCopy := c.mod.NamedFunction("runtime.sliceCopy")
 		return c.builder.CreateCall(sliceCopy, []llvm.Value{dstBuf, srcBuf, dstLen, srcLen, elemSize}, "copy.n"), nil
+	case "delete":
+		m, err := c.parseExpr(frame, args[0])
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		key, err := c.parseExpr(frame, args[1])
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		keyType := args[0].Type().Underlying().(*types.Map).Key()
+		keyKind, err := c.getMapKeyKind(keyType)
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		if keyKind != "String" {
+			key = c.emitMapKeyPtr(frame, key)
+		}
+		_, err = c.emitMapCall("Delete", keyKind, keyType, []llvm.Value{m, key}, "")
+		return llvm.Value{}, err // delete() returns void
 	case "len":
 		value, err := c.parseExpr(frame, args[0])
 		if err != nil {
 			return llvm.Value{}, err
 		}
-		switch args[0].Type().(type) {
+		switch typ := args[0].Type().Underlying().(type) {
 		case *types.Basic, *types.Slice:
 			// string or slice
 			return c.builder.CreateExtractValue(value, 1, "len"), nil
+		case *types.Array:
+			return llvm.ConstInt(c.intType, uint64(typ.Len()), false), nil
+		case *types.Pointer:
+			// pointer to array
+			arrayType := typ.Elem().Underlying().(*types.Array)
+			return llvm.ConstInt(c.intType, uint64(arrayType.Len()), false), nil
+		case *types.Chan:
+			return c.builder.CreateCall(c.mod.NamedFunction("runtime.chanLen"), []llvm.Value{value}, "len"), nil
 		case *types.Map:
-			indices := []llvm.Value{
-				llvm.ConstInt(llvm.Int32Type(), 0, false),
-				llvm.ConstInt(llvm.Int32Type(), 2, false), // hashmap.count
-			}
-			ptr := c.builder.CreateGEP(value, indices, "lenptr")
-			return c.builder.CreateLoad(ptr, "len"), nil
+			return c.builder.CreateCall(c.mod.NamedFunction("runtime.hashmapLen"), []llvm.Value{value}, "len"), nil
 		default:
 			return llvm.Value{}, errors.New("todo: len: unknown type")
 		}
@@ -1638,8 +2597,6 @@ func (c *Compiler) parseBuiltin(frame *Frame, args []ssa.Value, callName string)
 				switch typ.Kind() {
 				case types.String:
 					c.builder.CreateCall(c.mod.NamedFunction("runtime.printstring"), []llvm.Value{value}, "")
-				case types.Uintptr:
-					c.builder.CreateCall(c.mod.NamedFunction("runtime.printptr"), []llvm.Value{value}, "")
 				case types.UnsafePointer:
 					ptrValue := c.builder.CreatePtrToInt(value, c.uintptrType, "")
 					c.builder.CreateCall(c.mod.NamedFunction("runtime.printptr"), []llvm.Value{ptrValue}, "")
@@ -1664,15 +2621,30 @@ func (c *Compiler) parseBuiltin(frame *Frame, args []ssa.Value, callName string)
 						c.builder.CreateCall(c.mod.NamedFunction("runtime.printfloat32"), []llvm.Value{value}, "")
 					} else if typ.Kind() == types.Float64 {
 						c.builder.CreateCall(c.mod.NamedFunction("runtime.printfloat64"), []llvm.Value{value}, "")
+					} else if typ.Kind() == types.Complex64 {
+						c.builder.CreateCall(c.mod.NamedFunction("runtime.printcomplex64"), []llvm.Value{value}, "")
+					} else if typ.Kind() == types.Complex128 {
+						c.builder.CreateCall(c.mod.NamedFunction("runtime.printcomplex128"), []llvm.Value{value}, "")
 					} else {
 						return llvm.Value{}, errors.New("unknown basic arg type: " + typ.String())
 					}
 				}
 			case *types.Interface:
-				c.builder.CreateCall(c.mod.NamedFunction("runtime.printitf"), []llvm.Value{value}, "")
-			case *types.Map:
-				c.builder.CreateCall(c.mod.NamedFunction("runtime.printmap"), []llvm.Value{value}, "")
-			case *types.Pointer:
+				c.builder.CreateCall(c.mod.NamedFunction("runtime.printinterface"), []llvm.Value{value}, "")
+			case *types.Slice:
+				bufPtr := c.builder.CreateExtractValue(value, 0, "")
+				bufPtr = c.builder.CreatePtrToInt(bufPtr, c.uintptrType, "")
+				length := c.builder.CreateExtractValue(value, 1, "")
+				capacity := c.builder.CreateExtractValue(value, 2, "")
+				c.builder.CreateCall(c.mod.NamedFunction("runtime.printslice"), []llvm.Value{bufPtr, length, capacity}, "")
+			case *types.Signature:
+				if c.ir.SignatureNeedsContext(typ) {
+					// This is a closure. Print the function pointer.
+					value = c.builder.CreateExtractValue(value, 1, "")
+				}
+				ptrValue := c.builder.CreatePtrToInt(value, c.uintptrType, "")
+				c.builder.CreateCall(c.mod.NamedFunction("runtime.printptr"), []llvm.Value{ptrValue}, "")
+			case *types.Chan, *types.Map, *types.Pointer:
 				ptrValue := c.builder.CreatePtrToInt(value, c.uintptrType, "")
 				c.builder.CreateCall(c.mod.NamedFunction("runtime.printptr"), []llvm.Value{ptrValue}, "")
 			default:
@@ -1683,6 +2655,14 @@ func (c *Compiler) parseBuiltin(frame *Frame, args []ssa.Value, callName string)
 			c.builder.CreateCall(c.mod.NamedFunction("runtime.printnl"), nil, "")
 		}
 		return llvm.Value{}, nil // print() or println() returns void
+	case "panic":
+		// Only reached for a deferred panic(), see *ssa.Panic otherwise.
+		value, err := c.parseExpr(frame, args[0])
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		c.builder.CreateCall(c.mod.NamedFunction("runtime._panic"), []llvm.Value{value}, "")
+		return llvm.Value{}, nil
 	case "ssa:wrapnilchk":
 		// TODO: do an actual nil check?
 		return c.parseExpr(frame, args[0])
@@ -1693,15 +2673,6 @@ func (c *Compiler) parseBuiltin(frame *Frame, args []ssa.Value, callName string)
 
 func (c *Compiler) parseFunctionCall(frame *Frame, args []ssa.Value, llvmFn, context llvm.Value, blocking bool, parentHandle llvm.Value) (llvm.Value, error) {
 	var params []llvm.Value
-	if blocking {
-		if parentHandle.IsNil() {
-			// Started from 'go' statement.
-			params = append(params, llvm.ConstNull(c.i8ptrType))
-		} else {
-			// Blocking function calls another blocking function.
-			params = append(params, parentHandle)
-		}
-	}
 	for _, param := range args {
 		val, err := c.parseExpr(frame, param)
 		if err != nil {
@@ -1716,22 +2687,45 @@ func (c *Compiler) parseFunctionCall(frame *Frame, args []ssa.Value, llvmFn, con
 		params = append(params, context)
 	}
 
-	if frame.blocking && llvmFn.Name() == "runtime.Sleep" {
-		// Set task state to TASK_STATE_SLEEP and set the duration.
-		c.builder.CreateCall(c.mod.NamedFunction("runtime.sleepTask"), []llvm.Value{frame.taskHandle, params[0]}, "")
+	return c.createFunctionCall(frame, llvmFn, params, blocking, parentHandle)
+}
 
-		// Yield to scheduler.
-		continuePoint := c.builder.CreateCall(c.coroSuspendFunc, []llvm.Value{
-			llvm.ConstNull(c.ctx.TokenType()),
-			llvm.ConstInt(llvm.Int1Type(), 0, false),
-		}, "")
-		wakeup := c.ctx.InsertBasicBlock(llvm.NextBasicBlock(c.builder.GetInsertBlock()), "task.wakeup")
-		sw := c.builder.CreateSwitch(continuePoint, frame.suspendBlock, 2)
-		sw.AddCase(llvm.ConstInt(llvm.Int8Type(), 0, false), wakeup)
-		sw.AddCase(llvm.ConstInt(llvm.Int8Type(), 1, false), frame.cleanupBlock)
-		c.builder.SetInsertPointAtEnd(wakeup)
+// Call the given function with the already evaluated parameters. For blocking
+// functions, the parent coroutine and result slot parameters are added here.
+func (c *Compiler) createFunctionCall(frame *Frame, llvmFn llvm.Value, params []llvm.Value, blocking bool, parentHandle llvm.Value) (llvm.Value, error) {
+	if intrinsic, ok := parkingIntrinsics[llvmFn.Name()]; ok && frame.blocking {
+		// Sleeping, waiting in the sync package or waiting for an interrupt
+		// parks the goroutine, like a channel operation.
+		return c.emitParkingIntrinsic(frame, intrinsic, params)
+	}
 
-		return llvm.Value{}, nil
+	var resultSlot llvm.Value
+	if blocking {
+		var coroutineParams []llvm.Value
+		if parentHandle.IsNil() {
+			// Started from 'go' statement.
+			coroutineParams = append(coroutineParams, llvm.ConstNull(c.i8ptrType))
+		} else {
+			// Blocking function calls another blocking function.
+			coroutineParams = append(coroutineParams, parentHandle)
+		}
+
+		// A blocking function with results has a result slot as second
+		// parameter, see parseFuncDecl.
+		llvmFnType := llvmFn.Type().ElementType()
+		if llvmFnType.ParamTypesCount() > len(params)+1 {
+			slotType := llvmFnType.ParamTypes()[1]
+			if parentHandle.IsNil() {
+				// The results of a goroutine are discarded.
+				coroutineParams = append(coroutineParams, llvm.ConstPointerNull(slotType))
+			} else {
+				// The slot must survive the suspend point, so put it in the
+				// coroutine frame.
+				resultSlot = c.createEntryBlockAlloca(slotType.ElementType(), "result.slot")
+				coroutineParams = append(coroutineParams, resultSlot)
+			}
+		}
+		params = append(coroutineParams, params...)
 	}
 
 	result := c.builder.CreateCall(llvmFn, params, "")
@@ -1742,27 +2736,360 @@ func (c *Compiler) parseFunctionCall(frame *Frame, args []ssa.Value, llvmFn, con
 		// (with the TASK_STATE_CALL state). When the subroutine is finished, it
 		// will reactivate the parent (this frame) in it's destroy function.
 
-		c.builder.CreateCall(c.mod.NamedFunction("runtime.yieldToScheduler"), []llvm.Value{result}, "")
-
-		// Set task state to TASK_STATE_CALL.
+		// Set task state to TASK_STATE_CALL. This must happen before the
+		// subroutine is handed to the scheduler: if it has already returned,
+		// it is destroyed right away and will reactivate this frame.
 		c.builder.CreateCall(c.mod.NamedFunction("runtime.waitForAsyncCall"), []llvm.Value{frame.taskHandle}, "")
 
+		c.builder.CreateCall(c.mod.NamedFunction("runtime.yieldToScheduler"), []llvm.Value{result}, "")
+
 		// Yield to the scheduler.
-		continuePoint := c.builder.CreateCall(c.coroSuspendFunc, []llvm.Value{
-			llvm.ConstNull(c.ctx.TokenType()),
-			llvm.ConstInt(llvm.Int1Type(), 0, false),
-		}, "")
-		resume := c.ctx.InsertBasicBlock(llvm.NextBasicBlock(c.builder.GetInsertBlock()), "task.callComplete")
-		sw := c.builder.CreateSwitch(continuePoint, frame.suspendBlock, 2)
-		sw.AddCase(llvm.ConstInt(llvm.Int8Type(), 0, false), resume)
-		sw.AddCase(llvm.ConstInt(llvm.Int8Type(), 1, false), frame.cleanupBlock)
-		c.builder.SetInsertPointAtEnd(resume)
+		c.emitSuspend(frame, "task.callComplete")
+
+		if !resultSlot.IsNil() {
+			// The subroutine has returned, so its results are available.
+			return c.builder.CreateLoad(resultSlot, "result"), nil
+		}
 	}
 	return result, nil
 }
 
+// Evaluate the parameters of a deferred call.
+func (c *Compiler) parseDeferParams(frame *Frame, args []ssa.Value) ([]llvm.Value, error) {
+	params := make([]llvm.Value, 0, len(args))
+	for _, arg := range args {
+		param, err := c.parseExpr(frame, arg)
+		if err != nil {
+			return nil, err
+		}
+		params = append(params, param)
+	}
+	return params, nil
+}
+
+// Return the $defer wrapper for deferred calls through a function pointer of
+// the given type. The defer struct contains the function pointer after the
+// runtime._defer fields, followed by all parameters to pass to it (including
+// the interface receiver or closure context, if there is one). The body is
+// added after all functions have been parsed.
+func (c *Compiler) getDeferFuncPtrWrapper(fnPtrType, deferPtrType llvm.Type) llvm.Value {
+	if wrapper, ok := c.deferFuncPtrs[fnPtrType]; ok {
+		return wrapper
+	}
+	deferFuncType := llvm.FunctionType(llvm.VoidType(), []llvm.Type{deferPtrType}, false)
+	wrapper := llvm.AddFunction(c.mod, "runtime.funcptr$defer", deferFuncType)
+	wrapper.SetLinkage(llvm.InternalLinkage)
+	c.deferFuncPtrs[fnPtrType] = wrapper
+	return wrapper
+}
+
+// Run the deferred calls of a blocking function with deferred calls of
+// blocking functions. This works like runtime.rundefers, except that deferred
+// calls without callback are calls of blocking functions: they are made here,
+// so that this coroutine can wait for them.
+func (c *Compiler) emitRunDefers(frame *Frame) error {
+	loop := c.ctx.AddBasicBlock(frame.fn.llvmFn, "rundefers.loop")
+	body := c.ctx.AddBasicBlock(frame.fn.llvmFn, "rundefers.body")
+	callback := c.ctx.AddBasicBlock(frame.fn.llvmFn, "rundefers.callback")
+	blocking := c.ctx.AddBasicBlock(frame.fn.llvmFn, "rundefers.blocking")
+	done := c.ctx.AddBasicBlock(frame.fn.llvmFn, "rundefers.done")
+	c.builder.CreateBr(loop)
+
+	// Take the next deferred call from the list, if there is one.
+	zero := llvm.ConstInt(llvm.Int32Type(), 0, false)
+	one := llvm.ConstInt(llvm.Int32Type(), 1, false)
+	c.builder.SetInsertPointAtEnd(loop)
+	d := c.builder.CreateLoad(frame.deferPtr, "defer")
+	isNil := c.builder.CreateICmp(llvm.IntEQ, d, llvm.ConstPointerNull(d.Type()), "defer.isnil")
+	c.builder.CreateCondBr(isNil, done, body)
+	c.builder.SetInsertPointAtEnd(body)
+	next := c.builder.CreateLoad(c.builder.CreateGEP(d, []llvm.Value{zero, one}, ""), "defer.next")
+	c.builder.CreateStore(next, frame.deferPtr)
+	fn := c.builder.CreateLoad(c.builder.CreateGEP(d, []llvm.Value{zero, zero}, ""), "defer.callback")
+	hasCallback := c.builder.CreateICmp(llvm.IntNE, fn, llvm.ConstPointerNull(fn.Type()), "defer.hascallback")
+	c.builder.CreateCondBr(hasCallback, callback, blocking)
+
+	// Regular deferred call.
+	c.builder.SetInsertPointAtEnd(callback)
+	c.builder.CreateCall(fn, []llvm.Value{d}, "")
+	c.builder.CreateBr(loop)
+
+	// Deferred call of a blocking function: find it by its index.
+	c.builder.SetInsertPointAtEnd(blocking)
+	indexType := llvm.StructType([]llvm.Type{fn.Type(), d.Type(), llvm.Int32Type()}, false)
+	indexPtr := c.builder.CreateBitCast(d, llvm.PointerType(indexType, 0), "")
+	index := c.builder.CreateLoad(c.builder.CreateGEP(indexPtr, []llvm.Value{zero, llvm.ConstInt(llvm.Int32Type(), 2, false)}, ""), "defer.index")
+	sw := c.builder.CreateSwitch(index, loop, len(frame.blockingDefers))
+	for i, site := range frame.blockingDefers {
+		block := c.ctx.AddBasicBlock(frame.fn.llvmFn, "rundefers.call")
+		sw.AddCase(llvm.ConstInt(llvm.Int32Type(), uint64(i), false), block)
+		c.builder.SetInsertPointAtEnd(block)
+
+		// Extract the params from the struct, after the index.
+		contextPtr := c.builder.CreateBitCast(d, llvm.PointerType(site.contextType, 0), "context")
+		var params []llvm.Value
+		for j := 3; j < site.contextType.StructElementTypesCount(); j++ {
+			gep := c.builder.CreateGEP(contextPtr, []llvm.Value{zero, llvm.ConstInt(llvm.Int32Type(), uint64(j), false)}, "gep")
+			params = append(params, c.builder.CreateLoad(gep, "param"))
+		}
+
+		var err error
+		if fn := site.call.StaticCallee(); fn != nil {
+			_, err = c.createFunctionCall(frame, c.ir.GetFunction(fn).llvmFn, params, true, frame.taskHandle)
+		} else {
+			_, err = c.createDynamicCoroutineCall(frame, site.call, params[0], params[1:], frame.taskHandle)
+		}
+		if err != nil {
+			return err
+		}
+		c.builder.CreateBr(loop)
+	}
+
+	c.builder.SetInsertPointAtEnd(done)
+	return nil
+}
+
+// Whether this call is to a blocking function, either directly or through a
+// function pointer or interface method.
+func (c *Compiler) isBlockingCall(call *ssa.CallCommon) bool {
+	if fn := call.StaticCallee(); fn != nil {
+		return c.ir.IsBlocking(c.ir.GetFunction(fn))
+	}
+	return c.ir.IsBlockingDynamicCall(call)
+}
+
+// Store the function that is about to be called by a deferred call in
+// runtime.deferredFunc, see runtime.isDeferredCall.
+func (c *Compiler) emitSetDeferredFunc(fn llvm.Value) {
+	fnPtr := c.builder.CreateBitCast(fn, c.i8ptrType, "")
+	c.builder.CreateStore(fnPtr, c.mod.NamedGlobal("runtime.deferredFunc"))
+}
+
+// Return the maximum total size of the objects that don't escape that a single
+// function allocates on the stack (see emitAlloc). Other objects are still
+// allocated on the heap, as the stack is very small on most microcontrollers.
+func stackAllocBudget(triple string) uint64 {
+	arch := strings.Split(triple, "-")[0]
+	switch {
+	case arch == "avr":
+		// A few hundred bytes of stack at most.
+		return 32
+	case strings.HasPrefix(arch, "arm") || strings.HasPrefix(arch, "thumb"):
+		// Cortex-M microcontrollers, with a few kilobytes of stack.
+		return 256
+	default:
+		// Operating systems provide large stacks.
+		return 4096
+	}
+}
+
+// Whether panics can be recovered on this target. This needs
+// llvm.eh.sjlj.setjmp and llvm.eh.sjlj.longjmp, which are not supported by
+// every architecture (for example, AVR).
+func (c *Compiler) supportsRecover() bool {
+	arch := strings.Split(c.triple, "-")[0]
+	return arch == "x86_64" || arch == "i386" || arch == "i686" || strings.HasPrefix(arch, "arm") || strings.HasPrefix(arch, "thumb")
+}
+
+// Return the LLVM intrinsic with the given name, declaring it first if needed.
+func (c *Compiler) getIntrinsic(name string, fnType llvm.Type) llvm.Value {
+	fn := c.mod.NamedFunction(name)
+	if fn.IsNil() {
+		fn = llvm.AddFunction(c.mod, name, fnType)
+	}
+	return fn
+}
+
+// Create the defer frame of a function with defer statements and push it on
+// the stack of defer frames. A panic runs the deferred calls of this frame and
+// when one of them recovers, jumps back here (returning from setjmp a second
+// time) to continue in the recover block of the function.
+func (c *Compiler) emitDeferFrame(frame *Frame) {
+	zero := llvm.ConstInt(llvm.Int32Type(), 0, false)
+	frame.deferFrame = c.builder.CreateAlloca(c.mod.GetTypeByName("runtime.deferFrame"), "deferFrame")
+	frame.deferPtr = c.builder.CreateGEP(frame.deferFrame, []llvm.Value{zero, llvm.ConstInt(llvm.Int32Type(), 2, false)}, "deferPtr")
+	c.builder.CreateCall(c.mod.NamedFunction("runtime.pushDeferFrame"), []llvm.Value{frame.deferFrame}, "")
+
+	// Fill the jump buffer: llvm.eh.sjlj.setjmp expects the frame address in
+	// the first word and the stack pointer in the third word. It stores the
+	// resume address itself.
+	jumpBuffer := c.builder.CreateGEP(frame.deferFrame, []llvm.Value{zero, zero}, "jumpBuffer")
+	frameAddressType := llvm.FunctionType(c.i8ptrType, []llvm.Type{llvm.Int32Type()}, false)
+	frameAddress := c.builder.CreateCall(c.getIntrinsic("llvm.frameaddress", frameAddressType), []llvm.Value{zero}, "frameAddress")
+	c.builder.CreateStore(frameAddress, c.builder.CreateGEP(jumpBuffer, []llvm.Value{zero, zero}, ""))
+	stackSaveType := llvm.FunctionType(c.i8ptrType, nil, false)
+	stackPointer := c.builder.CreateCall(c.getIntrinsic("llvm.stacksave", stackSaveType), nil, "stackPointer")
+	c.builder.CreateStore(stackPointer, c.builder.CreateGEP(jumpBuffer, []llvm.Value{zero, llvm.ConstInt(llvm.Int32Type(), 2, false)}, ""))
+
+	setjmpType := llvm.FunctionType(llvm.Int32Type(), []llvm.Type{c.i8ptrType}, false)
+	jumpBufferPtr := c.builder.CreateBitCast(jumpBuffer, c.i8ptrType, "jumpBuffer.ptr")
+	result := c.builder.CreateCall(c.getIntrinsic("llvm.eh.sjlj.setjmp", setjmpType), []llvm.Value{jumpBufferPtr}, "setjmp")
+	recovered := c.builder.CreateICmp(llvm.IntNE, result, zero, "setjmp.recovered")
+
+	// The rest of the entry block continues in a new basic block.
+	entry := frame.fn.fn.Blocks[0]
+	cont := c.ctx.InsertBasicBlock(llvm.NextBasicBlock(c.builder.GetInsertBlock()), "setjmp.cont")
+	c.builder.CreateCondBr(recovered, frame.blocks[frame.fn.fn.Recover], cont)
+	frame.blocks[entry] = cont
+	c.builder.SetInsertPointAtEnd(cont)
+}
+
+// Lower runtime.SetFinalizer(obj, finalizer) to a call to
+// runtime.setFinalizer(obj, fn, context). The runtime cannot call a function
+// of arbitrary type stored in an interface, so unpack the function pointer and
+// its context here, where the type of the finalizer is known.
+func (c *Compiler) emitSetFinalizer(frame *Frame, args []ssa.Value) (llvm.Value, error) {
+	objItf, ok := args[0].(*ssa.MakeInterface)
+	if !ok {
+		return llvm.Value{}, errors.New("todo: SetFinalizer: object must be a pointer")
+	}
+	if _, ok := objItf.X.Type().Underlying().(*types.Pointer); !ok {
+		return llvm.Value{}, errors.New("todo: SetFinalizer: object must be a pointer, not " + objItf.X.Type().String())
+	}
+	obj, err := c.parseExpr(frame, objItf.X)
+	if err != nil {
+		return llvm.Value{}, err
+	}
+	obj = c.builder.CreateBitCast(obj, c.i8ptrType, "finalizer.obj")
+
+	fnPtr := llvm.ConstPointerNull(c.i8ptrType)
+	context := llvm.ConstPointerNull(c.i8ptrType)
+	switch finalizer := args[1].(type) {
+	case *ssa.Const:
+		// SetFinalizer(obj, nil) removes the finalizer.
+	case *ssa.MakeInterface:
+		sig, ok := finalizer.X.Type().Underlying().(*types.Signature)
+		if !ok || sig.Params().Len() != 1 || sig.Results().Len() != 0 {
+			return llvm.Value{}, errors.New("todo: SetFinalizer: unsupported finalizer type " + finalizer.X.Type().String())
+		}
+		if _, ok := sig.Params().At(0).Type().Underlying().(*types.Pointer); !ok {
+			return llvm.Value{}, errors.New("todo: SetFinalizer: finalizer must take a pointer, not " + sig.Params().At(0).Type().String())
+		}
+		if c.ir.IsBlockingSignature(sig) {
+			// Finalizers are called from the allocator, which cannot wait
+			// for a coroutine. Functions, closures and function values are
+			// all rejected when they may refer to a blocking function.
+			return llvm.Value{}, errors.New("todo: SetFinalizer: blocking finalizer " + finalizer.X.String())
+		}
+		fn, err := c.parseExpr(frame, finalizer.X)
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		if fn.Type().TypeKind() == llvm.StructTypeKind {
+			// closure: {context, function pointer}
+			context = c.builder.CreateExtractValue(fn, 0, "finalizer.context")
+			fn = c.builder.CreateExtractValue(fn, 1, "finalizer.fn")
+		}
+		fnPtr = c.builder.CreateBitCast(fn, c.i8ptrType, "finalizer.fnptr")
+	default:
+		return llvm.Value{}, errors.New("todo: SetFinalizer: finalizer must be a function or nil")
+	}
+
+	setFinalizer := c.mod.NamedFunction("runtime.setFinalizer")
+	c.builder.CreateCall(setFinalizer, []llvm.Value{obj, fnPtr, context}, "")
+	return llvm.Value{}, nil
+}
+
+// Suspend the current coroutine and continue in a new basic block (with the
+// given name) when it is resumed. The task state determines what the scheduler
+// does with the suspended task.
+func (c *Compiler) emitSuspend(frame *Frame, name string) {
+	continuePoint := c.builder.CreateCall(c.coroSuspendFunc, []llvm.Value{
+		llvm.ConstNull(c.ctx.TokenType()),
+		llvm.ConstInt(llvm.Int1Type(), 0, false),
+	}, "")
+	resume := c.ctx.InsertBasicBlock(llvm.NextBasicBlock(c.builder.GetInsertBlock()), name)
+	sw := c.builder.CreateSwitch(continuePoint, frame.suspendBlock, 2)
+	sw.AddCase(llvm.ConstInt(llvm.Int8Type(), 0, false), resume)
+	sw.AddCase(llvm.ConstInt(llvm.Int8Type(), 1, false), frame.cleanupBlock)
+	c.builder.SetInsertPointAtEnd(resume)
+}
+
+// Use the given alloca after a suspend point, so that it is put in the coroutine
+// frame. LLVM only moves an alloca to the frame when the alloca itself is used
+// after a suspend, not when it is only used through a pointer that was stored
+// somewhere before (for example, in a list in the runtime). Otherwise it stays
+// on the stack, which is reused as soon as the coroutine suspends. The load is
+// volatile, so that it isn't optimized away.
+func (c *Compiler) emitKeepAlive(alloca llvm.Value) {
+	if c.targetData.TypeAllocSize(alloca.Type().ElementType()) == 0 {
+		return
+	}
+	ptr := c.builder.CreateBitCast(alloca, c.i8ptrType, "")
+	load := c.builder.CreateLoad(ptr, "")
+	load.SetVolatile(true)
+}
+
+// Create a slice of all elements of an array alloca.
+func (c *Compiler) createArraySlice(array llvm.Value, length int, name string) llvm.Value {
+	zero := llvm.ConstInt(llvm.Int32Type(), 0, false)
+	ptr := c.builder.CreateGEP(array, []llvm.Value{zero, zero}, name+".ptr")
+	lengthValue := llvm.ConstInt(c.lenType, uint64(length), false)
+	slice := llvm.ConstStruct([]llvm.Value{llvm.Undef(ptr.Type()), lengthValue, lengthValue}, false)
+	return c.builder.CreateInsertValue(slice, ptr, 0, name+".slice")
+}
+
+// Call the runtime function of a parking intrinsic (see parkingIntrinsics),
+// which may park the current goroutine until something else wakes it up,
+// followed by a suspend. The task handle is passed as the first parameter.
+// Pointer arguments are converted to the types the runtime uses, as those may
+// be mirrors of the types in the sync package.
+func (c *Compiler) emitParkingIntrinsic(frame *Frame, intrinsic parkingIntrinsic, args []llvm.Value) (llvm.Value, error) {
+	fn := c.mod.NamedFunction(intrinsic.taskFunc)
+	paramTypes := fn.Type().ElementType().ParamTypes()
+	params := []llvm.Value{frame.taskHandle}
+	for i, value := range args[:intrinsic.numArgs] {
+		if paramType := paramTypes[i+1]; value.Type() != paramType {
+			value = c.builder.CreateBitCast(value, paramType, "")
+		}
+		params = append(params, value)
+	}
+	c.builder.CreateCall(fn, params, "")
+	c.emitSuspend(frame, "task.wakeup")
+	return llvm.Value{}, nil
+}
+
+// Create an alloca in the entry block of the current function, so that it is
+// allocated only once even when created inside a loop. This is also what the
+// coroutine passes expect for values that live across suspend points.
+func (c *Compiler) createEntryBlockAlloca(t llvm.Type, name string) llvm.Value {
+	currentBlock := c.builder.GetInsertBlock()
+	entryBlock := currentBlock.Parent().EntryBasicBlock()
+	if first := entryBlock.FirstInstruction(); first.IsNil() {
+		c.builder.SetInsertPointAtEnd(entryBlock)
+	} else {
+		c.builder.SetInsertPointBefore(first)
+	}
+	alloca := c.builder.CreateAlloca(t, name)
+	c.builder.SetInsertPointAtEnd(currentBlock)
+	return alloca
+}
+
+// Return whether this address points into a local variable (an *ssa.Alloc),
+// either directly or to one of its fields or elements.
+func isAllocAddr(addr ssa.Value) bool {
+	switch addr := addr.(type) {
+	case *ssa.Alloc:
+		return true
+	case *ssa.FieldAddr:
+		return isAllocAddr(addr.X)
+	case *ssa.IndexAddr:
+		return isAllocAddr(addr.X)
+	case *ssa.Slice:
+		return isAllocAddr(addr.X)
+	default:
+		return false
+	}
+}
+
 func (c *Compiler) parseCall(frame *Frame, instr *ssa.CallCommon, parentHandle llvm.Value) (llvm.Value, error) {
 	if instr.IsInvoke() {
+		if c.ir.IsBlockingDynamicCall(instr) {
+			// Some implementations of this method are blocking, so all of
+			// them are coroutines.
+			return c.emitDynamicCoroutineCall(frame, instr, parentHandle)
+		}
+
 		// Call an interface method with dynamic dispatch.
 		itf, err := c.parseExpr(frame, instr.Value) // interface
 		if err != nil {
@@ -1786,7 +3113,7 @@ func (c *Compiler) parseCall(frame *Frame, instr *ssa.CallCommon, parentHandle l
 
 		values := []llvm.Value{
 			itf,
-			llvm.ConstInt(llvm.Int16Type(), uint64(c.ir.MethodNum(instr.Method)), false),
+			llvm.ConstInt(c.uintptrType, uint64(c.ir.MethodNum(instr.Method)), false),
 		}
 		fn := c.builder.CreateCall(c.mod.NamedFunction("runtime.interfaceMethod"), values, "invoke.func")
 		fnCast := c.builder.CreateBitCast(fn, llvmFnType, "invoke.func.cast")
@@ -1807,7 +3134,6 @@ func (c *Compiler) parseCall(frame *Frame, instr *ssa.CallCommon, parentHandle l
 			args = append(args, llvm.ConstPointerNull(c.i8ptrType))
 		}
 
-		// TODO: blocking methods (needs analysis)
 		return c.builder.CreateCall(fnCast, args, ""), nil
 	}
 
@@ -1823,6 +3149,9 @@ func (c *Compiler) parseCall(frame *Frame, instr *ssa.CallCommon, parentHandle l
 				return c.builder.CreateCall(target, nil, ""), nil
 			}
 		}
+		if fn.RelString(nil) == "runtime.SetFinalizer" {
+			return c.emitSetFinalizer(frame, instr.Args)
+		}
 		targetFunc := c.ir.GetFunction(fn)
 		if targetFunc.llvmFn.IsNil() {
 			return llvm.Value{}, errors.New("undefined function: " + targetFunc.LinkName())
@@ -1855,11 +3184,15 @@ func (c *Compiler) parseCall(frame *Frame, instr *ssa.CallCommon, parentHandle l
 	case *ssa.Builtin:
 		return c.parseBuiltin(frame, instr.Args, call.Name())
 	default: // function pointer
+		if c.ir.IsBlockingDynamicCall(instr) {
+			// Some functions with this signature are blocking, so all of
+			// them are coroutines.
+			return c.emitDynamicCoroutineCall(frame, instr, parentHandle)
+		}
 		value, err := c.parseExpr(frame, instr.Value)
 		if err != nil {
 			return llvm.Value{}, err
 		}
-		// TODO: blocking function pointers (needs analysis)
 		var context llvm.Value
 		if c.ir.SignatureNeedsContext(instr.Signature()) {
 			// 'value' is a closure, not a raw function pointer.
@@ -1872,6 +3205,50 @@ func (c *Compiler) parseCall(frame *Frame, instr *ssa.CallCommon, parentHandle l
 	}
 }
 
+// Allocate a zero-initialized object of the given type for the given value (an
+// *ssa.Alloc, *ssa.MakeInterface or *ssa.MakeSlice). The object is put on the
+// stack when it does not escape (see EscapeReason) and is small enough, and
+// on the heap otherwise.
+func (c *Compiler) emitAlloc(frame *Frame, value ssa.Value, typ llvm.Type, name string) (llvm.Value, error) {
+	size := c.targetData.TypeAllocSize(typ)
+	reason := c.ir.EscapeReason(value)
+	if reason == "" && frame.stackAllocSize+size > c.maxStackAlloc {
+		reason = "too big for the stack (" + strconv.FormatUint(size, 10) + " bytes, with " + strconv.FormatUint(frame.stackAllocSize, 10) + " of " + strconv.FormatUint(c.maxStackAlloc, 10) + " bytes already in use)"
+	}
+	if reason != "" {
+		c.reportHeapAlloc(frame, value, reason)
+		sizeValue := llvm.ConstInt(c.uintptrType, size, false)
+		buf := c.builder.CreateCall(c.allocFunc, []llvm.Value{sizeValue}, name)
+		return c.builder.CreateBitCast(buf, llvm.PointerType(typ, 0), ""), nil
+	}
+
+	// Put the object in the entry block, so that it is only allocated once
+	// when created in a loop. This is safe, as it doesn't escape: it is not
+	// used anymore in the next iteration.
+	frame.stackAllocSize += size
+	buf := c.createEntryBlockAlloca(typ, name)
+	zero, err := getZeroValue(typ)
+	if err != nil {
+		return llvm.Value{}, err
+	}
+	c.builder.CreateStore(zero, buf)
+	return buf, nil
+}
+
+// Print why an object is allocated on the heap, with the -print-allocs flag.
+func (c *Compiler) reportHeapAlloc(frame *Frame, value ssa.Value, reason string) {
+	if !c.printAllocs {
+		return
+	}
+	pos := c.ir.program.Fset.Position(value.Pos())
+	if !pos.IsValid() {
+		// Implicit conversions (for example to an interface) have no
+		// position.
+		pos = c.ir.program.Fset.Position(frame.fn.fn.Pos())
+	}
+	fmt.Printf("%s: heap allocation in %s: %s\n", pos, frame.fn.fn.RelString(nil), reason)
+}
+
 func (c *Compiler) emitBoundsCheck(frame *Frame, arrayLen, index llvm.Value) {
 	if frame.fn.nobounds {
 		// The //go:nobounds pragma was added to the function to avoid bounds
@@ -1888,8 +3265,46 @@ func (c *Compiler) emitBoundsCheck(frame *Frame, arrayLen, index llvm.Value) {
 			return
 		}
 	}
-	lookupBoundsCheck := c.mod.NamedFunction("runtime.lookupBoundsCheck")
-	c.builder.CreateCall(lookupBoundsCheck, []llvm.Value{arrayLen, index}, "")
+	lookupBoundsCheck := c.mod.NamedFunction("runtime.lookupBoundsCheck")
+	c.builder.CreateCall(lookupBoundsCheck, []llvm.Value{arrayLen, index}, "")
+}
+
+// Check the indices of a slice expression: low <= high <= max <= capacity.
+func (c *Compiler) emitSliceBoundsCheck(frame *Frame, capacity, low, high, max llvm.Value) {
+	if frame.fn.nobounds {
+		// The //go:nobounds pragma was added to the function to avoid bounds
+		// checking.
+		return
+	}
+	sliceBoundsCheck := c.mod.NamedFunction("runtime.sliceBoundsCheck")
+	c.builder.CreateCall(sliceBoundsCheck, []llvm.Value{capacity, low, high, max}, "")
+}
+
+// Parse an index of a slice expression, which may be of any integer type, and
+// convert it to the length type of slices and strings. Signed indices are sign
+// extended so that negative indices fail the bounds check. Indices wider than
+// the length type are checked before they are truncated.
+func (c *Compiler) parseSliceIndex(frame *Frame, index ssa.Value) (llvm.Value, error) {
+	value, err := c.parseExpr(frame, index)
+	if err != nil {
+		return llvm.Value{}, err
+	}
+	if value.Type().IntTypeWidth() < c.lenType.IntTypeWidth() {
+		if index.Type().Underlying().(*types.Basic).Info()&types.IsUnsigned != 0 {
+			return c.builder.CreateZExt(value, c.lenType, ""), nil
+		}
+		return c.builder.CreateSExt(value, c.lenType, ""), nil
+	} else if value.Type().IntTypeWidth() > c.lenType.IntTypeWidth() {
+		if !frame.fn.nobounds {
+			// The index must not have any bits set that would be lost, which
+			// also rules out negative values of signed types.
+			maxIndex := llvm.ConstInt(value.Type(), 1<<uint(c.lenType.IntTypeWidth())-1, false)
+			fits := c.builder.CreateICmp(llvm.IntULE, value, maxIndex, "slice.index.fits")
+			c.builder.CreateCall(c.mod.NamedFunction("runtime.sliceIndexCheck"), []llvm.Value{fits}, "")
+		}
+		return c.builder.CreateTrunc(value, c.lenType, ""), nil
+	}
+	return value, nil
 }
 
 func (c *Compiler) parseExpr(frame *Frame, expr ssa.Value) (llvm.Value, error) {
@@ -1909,10 +3324,10 @@ func (c *Compiler) parseExpr(frame *Frame, expr ssa.Value) (llvm.Value, error) {
 		}
 		var buf llvm.Value
 		if expr.Heap {
-			// TODO: escape analysis
-			size := llvm.ConstInt(c.uintptrType, c.targetData.TypeAllocSize(typ), false)
-			buf = c.builder.CreateCall(c.allocFunc, []llvm.Value{size}, expr.Comment)
-			buf = c.builder.CreateBitCast(buf, llvm.PointerType(typ, 0), "")
+			buf, err = c.emitAlloc(frame, expr, typ, expr.Comment)
+			if err != nil {
+				return llvm.Value{}, err
+			}
 		} else {
 			buf = c.builder.CreateAlloca(typ, expr.Comment)
 			zero, err := getZeroValue(typ)
@@ -1986,7 +3401,10 @@ func (c *Compiler) parseExpr(frame *Frame, expr ssa.Value) (llvm.Value, error) {
 		return c.builder.CreateGEP(val, indices, ""), nil
 	case *ssa.Function:
 		fn := c.ir.GetFunction(expr)
-		ptr := fn.llvmFn
+		ptr, err := c.getFuncPtr(fn)
+		if err != nil {
+			return llvm.Value{}, err
+		}
 		if c.ir.FunctionNeedsContext(fn) {
 			// Create closure for function pointer.
 			// Closure is: {context, function pointer}
@@ -2074,18 +3492,15 @@ func (c *Compiler) parseExpr(frame *Frame, expr ssa.Value) (llvm.Value, error) {
 			panic("unreachable")
 		}
 	case *ssa.Lookup:
-		if expr.CommaOk {
-			return llvm.Value{}, errors.New("todo: lookup with comma-ok")
-		}
 		value, err := c.parseExpr(frame, expr.X)
 		if err != nil {
-			return llvm.Value{}, nil
+			return llvm.Value{}, err
 		}
 		index, err := c.parseExpr(frame, expr.Index)
 		if err != nil {
-			return llvm.Value{}, nil
+			return llvm.Value{}, err
 		}
-		switch xType := expr.X.Type().(type) {
+		switch xType := expr.X.Type().Underlying().(type) {
 		case *types.Basic:
 			// Value type must be a string, which is a basic type.
 			if xType.Kind() != types.String {
@@ -2105,37 +3520,57 @@ func (c *Compiler) parseExpr(frame *Frame, expr ssa.Value) (llvm.Value, error) {
 			bufPtr := c.builder.CreateGEP(buf, []llvm.Value{index}, "")
 			return c.builder.CreateLoad(bufPtr, ""), nil
 		case *types.Map:
-			switch keyType := xType.Key().Underlying().(type) {
-			case *types.Basic:
-				llvmValueType, err := c.getLLVMType(expr.Type())
-				if err != nil {
-					return llvm.Value{}, err
-				}
-				mapValueAlloca := c.builder.CreateAlloca(llvmValueType, "hashmap.value")
-				mapValuePtr := c.builder.CreateBitCast(mapValueAlloca, c.i8ptrType, "hashmap.valueptr")
-				if keyType.Kind() == types.String {
-					params := []llvm.Value{value, index, mapValuePtr}
-					fn := c.mod.NamedFunction("runtime.hashmapStringGet")
-					c.builder.CreateCall(fn, params, "")
-					return c.builder.CreateLoad(mapValueAlloca, ""), nil
-				} else if keyType.Info()&(types.IsBoolean|types.IsInteger) != 0 {
-					keyAlloca := c.builder.CreateAlloca(index.Type(), "hashmap.key")
-					c.builder.CreateStore(index, keyAlloca)
-					keyPtr := c.builder.CreateBitCast(keyAlloca, c.i8ptrType, "hashmap.keyptr")
-					params := []llvm.Value{value, keyPtr, mapValuePtr}
-					fn := c.mod.NamedFunction("runtime.hashmapBinaryGet")
-					c.builder.CreateCall(fn, params, "")
-					return c.builder.CreateLoad(mapValueAlloca, ""), nil
-				} else {
-					return llvm.Value{}, errors.New("todo: map lookup key type: " + keyType.String())
-				}
-			default:
-				return llvm.Value{}, errors.New("todo: map lookup key type: " + keyType.String())
+			keyKind, err := c.getMapKeyKind(xType.Key())
+			if err != nil {
+				return llvm.Value{}, err
+			}
+			llvmValueType, err := c.getLLVMType(xType.Elem())
+			if err != nil {
+				return llvm.Value{}, err
 			}
+			mapValueAlloca := c.createEntryBlockAlloca(llvmValueType, "hashmap.value")
+			zeroValue, err := getZeroValue(llvmValueType)
+			if err != nil {
+				return llvm.Value{}, err
+			}
+			c.builder.CreateStore(zeroValue, mapValueAlloca) // for nil maps
+			mapValuePtr := c.builder.CreateBitCast(mapValueAlloca, c.i8ptrType, "hashmap.valueptr")
+			if keyKind != "String" {
+				index = c.emitMapKeyPtr(frame, index)
+			}
+			commaOk, err := c.emitMapCall("Get", keyKind, xType.Key(), []llvm.Value{value, index, mapValuePtr}, "")
+			if err != nil {
+				return llvm.Value{}, err
+			}
+			mapValue := c.builder.CreateLoad(mapValueAlloca, "")
+			if expr.CommaOk {
+				tuple := llvm.Undef(llvm.StructType([]llvm.Type{llvmValueType, llvm.Int1Type()}, false))
+				tuple = c.builder.CreateInsertValue(tuple, mapValue, 0, "")
+				tuple = c.builder.CreateInsertValue(tuple, commaOk, 1, "")
+				return tuple, nil
+			}
+			return mapValue, nil
 		default:
 			panic("unknown lookup type: " + expr.String())
 		}
 
+	case *ssa.MakeChan:
+		chanType := expr.Type().Underlying().(*types.Chan)
+		llvmElemType, err := c.getLLVMType(chanType.Elem())
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		elemSize := llvm.ConstInt(c.uintptrType, c.targetData.TypeAllocSize(llvmElemType), false)
+		bufSize, err := c.parseExpr(frame, expr.Size)
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		bufSize, err = c.parseConvert(expr.Size.Type(), types.Typ[types.Uintptr], bufSize)
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		chanMake := c.mod.NamedFunction("runtime.chanMake")
+		return c.builder.CreateCall(chanMake, []llvm.Value{elemSize, bufSize}, "chan"), nil
 	case *ssa.MakeClosure:
 		return c.parseMakeClosure(frame, expr)
 
@@ -2144,7 +3579,7 @@ func (c *Compiler) parseExpr(frame *Frame, expr ssa.Value) (llvm.Value, error) {
 		if err != nil {
 			return llvm.Value{}, err
 		}
-		return c.parseMakeInterface(val, expr.X.Type(), false)
+		return c.parseMakeInterface(frame, expr, val, expr.X.Type(), false)
 	case *ssa.MakeMap:
 		mapType := expr.Type().Underlying().(*types.Map)
 		llvmKeyType, err := c.getLLVMType(mapType.Key().Underlying())
@@ -2185,14 +3620,25 @@ func (c *Compiler) parseExpr(frame *Frame, expr ssa.Value) (llvm.Value, error) {
 		}
 
 		// Allocate the backing array.
-		// TODO: escape analysis
-		elemSizeValue := llvm.ConstInt(c.uintptrType, elemSize, false)
-		sliceCapCast, err := c.parseConvert(expr.Cap.Type(), types.Typ[types.Uintptr], sliceCap)
-		if err != nil {
-			return llvm.Value{}, err
+		var slicePtr llvm.Value
+		if capConst, ok := expr.Cap.(*ssa.Const); ok {
+			// The size is known, so it may be possible to allocate it on the
+			// stack.
+			arrayType := llvm.ArrayType(llvmElemType, int(capConst.Int64()))
+			slicePtr, err = c.emitAlloc(frame, expr, arrayType, "makeslice.buf")
+			if err != nil {
+				return llvm.Value{}, err
+			}
+		} else {
+			c.reportHeapAlloc(frame, expr, "size is not constant")
+			elemSizeValue := llvm.ConstInt(c.uintptrType, elemSize, false)
+			sliceCapCast, err := c.parseConvert(expr.Cap.Type(), types.Typ[types.Uintptr], sliceCap)
+			if err != nil {
+				return llvm.Value{}, err
+			}
+			sliceSize := c.builder.CreateBinOp(llvm.Mul, elemSizeValue, sliceCapCast, "makeslice.cap")
+			slicePtr = c.builder.CreateCall(c.allocFunc, []llvm.Value{sliceSize}, "makeslice.buf")
 		}
-		sliceSize := c.builder.CreateBinOp(llvm.Mul, elemSizeValue, sliceCapCast, "makeslice.cap")
-		slicePtr := c.builder.CreateCall(c.allocFunc, []llvm.Value{sliceSize}, "makeslice.buf")
 		slicePtr = c.builder.CreateBitCast(slicePtr, llvm.PointerType(llvmElemType, 0), "makeslice.array")
 
 		// Create the slice.
@@ -2205,6 +3651,48 @@ func (c *Compiler) parseExpr(frame *Frame, expr ssa.Value) (llvm.Value, error) {
 		slice = c.builder.CreateInsertValue(slice, sliceLen, 1, "")
 		slice = c.builder.CreateInsertValue(slice, sliceCap, 2, "")
 		return slice, nil
+	case *ssa.Next:
+		if expr.IsString {
+			return llvm.Value{}, errors.New("todo: range over string")
+		}
+		rangeVal := expr.Iter.(*ssa.Range).X
+		m, err := c.parseExpr(frame, rangeVal)
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		it, err := c.parseExpr(frame, expr.Iter)
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		// The key and value in the tuple may be invalid types when they are
+		// not used, so take them from the map type instead.
+		mapType := rangeVal.Type().Underlying().(*types.Map)
+		llvmKeyType, err := c.getLLVMType(mapType.Key())
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		llvmValueType, err := c.getLLVMType(mapType.Elem())
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		keyKind, err := c.getMapKeyKind(mapType.Key())
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		mapKeyAlloca := c.createEntryBlockAlloca(llvmKeyType, "range.key")
+		mapKeyPtr := c.builder.CreateBitCast(mapKeyAlloca, c.i8ptrType, "range.keyptr")
+		mapValueAlloca := c.createEntryBlockAlloca(llvmValueType, "range.value")
+		mapValuePtr := c.builder.CreateBitCast(mapValueAlloca, c.i8ptrType, "range.valueptr")
+		ok, err := c.emitMapCall("Next", keyKind, mapType.Key(), []llvm.Value{m, it, mapKeyPtr, mapValuePtr}, "range.next")
+		if err != nil {
+			return llvm.Value{}, err
+		}
+
+		tuple := llvm.Undef(llvm.StructType([]llvm.Type{llvm.Int1Type(), llvmKeyType, llvmValueType}, false))
+		tuple = c.builder.CreateInsertValue(tuple, ok, 0, "")
+		tuple = c.builder.CreateInsertValue(tuple, c.builder.CreateLoad(mapKeyAlloca, ""), 1, "")
+		tuple = c.builder.CreateInsertValue(tuple, c.builder.CreateLoad(mapValueAlloca, ""), 2, "")
+		return tuple, nil
 	case *ssa.Phi:
 		t, err := c.getLLVMType(expr.Type())
 		if err != nil {
@@ -2213,50 +3701,73 @@ func (c *Compiler) parseExpr(frame *Frame, expr ssa.Value) (llvm.Value, error) {
 		phi := c.builder.CreatePHI(t, "")
 		frame.phis = append(frame.phis, Phi{expr, phi})
 		return phi, nil
-	case *ssa.Slice:
-		if expr.Max != nil {
-			return llvm.Value{}, errors.New("todo: full slice expressions (with max): " + expr.Type().String())
+	case *ssa.Range:
+		switch expr.X.Type().Underlying().(type) {
+		case *types.Map:
+			// The iterator state, see runtime.hashmapIterator. It must be
+			// zero-initialized before the first call to hashmapNext.
+			iteratorType := c.mod.GetTypeByName("runtime.hashmapIterator")
+			it := c.createEntryBlockAlloca(iteratorType, "range.it")
+			zero, err := getZeroValue(iteratorType)
+			if err != nil {
+				return llvm.Value{}, err
+			}
+			c.builder.CreateStore(zero, it)
+			return it, nil
+		case *types.Basic:
+			return llvm.Value{}, errors.New("todo: range over string")
+		default:
+			return llvm.Value{}, errors.New("todo: range: unknown type: " + expr.X.Type().String())
 		}
+	case *ssa.Select:
+		return c.emitSelect(frame, expr)
+	case *ssa.Slice:
 		value, err := c.parseExpr(frame, expr.X)
 		if err != nil {
 			return llvm.Value{}, err
 		}
-		var low, high llvm.Value
+		var low, high, max llvm.Value
 		if expr.Low == nil {
 			low = llvm.ConstInt(c.lenType, 0, false)
 		} else {
-			low, err = c.parseExpr(frame, expr.Low)
+			low, err = c.parseSliceIndex(frame, expr.Low)
 			if err != nil {
-				return llvm.Value{}, nil
+				return llvm.Value{}, err
 			}
 		}
 		if expr.High != nil {
-			high, err = c.parseExpr(frame, expr.High)
+			high, err = c.parseSliceIndex(frame, expr.High)
 			if err != nil {
-				return llvm.Value{}, nil
+				return llvm.Value{}, err
+			}
+		}
+		if expr.Max != nil {
+			max, err = c.parseSliceIndex(frame, expr.Max)
+			if err != nil {
+				return llvm.Value{}, err
 			}
 		}
 		switch typ := expr.X.Type().Underlying().(type) {
 		case *types.Pointer: // pointer to array
 			// slice an array
-			length := typ.Elem().(*types.Array).Len()
+			length := typ.Elem().Underlying().(*types.Array).Len()
 			llvmLen := llvm.ConstInt(c.lenType, uint64(length), false)
 			if high.IsNil() {
 				high = llvmLen
 			}
+			if max.IsNil() {
+				max = llvmLen
+			}
 			indices := []llvm.Value{
 				llvm.ConstInt(llvm.Int32Type(), 0, false),
 				low,
 			}
 			slicePtr := c.builder.CreateGEP(value, indices, "slice.ptr")
 			sliceLen := c.builder.CreateSub(high, low, "slice.len")
-			sliceCap := c.builder.CreateSub(llvmLen, low, "slice.cap")
+			sliceCap := c.builder.CreateSub(max, low, "slice.cap")
 
 			// This check is optimized away in most cases.
-			if !frame.fn.nobounds {
-				sliceBoundsCheck := c.mod.NamedFunction("runtime.sliceBoundsCheck")
-				c.builder.CreateCall(sliceBoundsCheck, []llvm.Value{llvmLen, low, high}, "")
-			}
+			c.emitSliceBoundsCheck(frame, llvmLen, low, high, max)
 
 			slice := llvm.ConstStruct([]llvm.Value{
 				llvm.Undef(slicePtr.Type()),
@@ -2270,10 +3781,33 @@ func (c *Compiler) parseExpr(frame *Frame, expr ssa.Value) (llvm.Value, error) {
 
 		case *types.Slice:
 			// slice a slice
-			return llvm.Value{}, errors.New("todo: slice a slice: " + typ.String())
+			oldPtr := c.builder.CreateExtractValue(value, 0, "")
+			oldLen := c.builder.CreateExtractValue(value, 1, "")
+			oldCap := c.builder.CreateExtractValue(value, 2, "")
+			if high.IsNil() {
+				high = oldLen
+			}
+			if max.IsNil() {
+				max = oldCap
+			}
+
+			c.emitSliceBoundsCheck(frame, oldCap, low, high, max)
+
+			newPtr := c.builder.CreateGEP(oldPtr, []llvm.Value{low}, "")
+			newLen := c.builder.CreateSub(high, low, "")
+			newCap := c.builder.CreateSub(max, low, "")
+			slice := llvm.ConstStruct([]llvm.Value{
+				llvm.Undef(newPtr.Type()),
+				llvm.Undef(c.lenType),
+				llvm.Undef(c.lenType),
+			}, false)
+			slice = c.builder.CreateInsertValue(slice, newPtr, 0, "")
+			slice = c.builder.CreateInsertValue(slice, newLen, 1, "")
+			slice = c.builder.CreateInsertValue(slice, newCap, 2, "")
+			return slice, nil
 
 		case *types.Basic:
-			if typ.Kind() != types.String {
+			if typ.Info()&types.IsString == 0 {
 				return llvm.Value{}, errors.New("unknown slice type: " + typ.String())
 			}
 			// slice a string
@@ -2283,10 +3817,9 @@ func (c *Compiler) parseExpr(frame *Frame, expr ssa.Value) (llvm.Value, error) {
 				high = oldLen
 			}
 
-			if !frame.fn.nobounds {
-				sliceBoundsCheck := c.mod.NamedFunction("runtime.sliceBoundsCheck")
-				c.builder.CreateCall(sliceBoundsCheck, []llvm.Value{oldLen, low, high}, "")
-			}
+			// Strings can't be sliced with a max index (the type checker
+			// doesn't allow it), so high is also the max.
+			c.emitSliceBoundsCheck(frame, oldLen, low, high, high)
 
 			newPtr := c.builder.CreateGEP(oldPtr, []llvm.Value{low}, "")
 			newLen := c.builder.CreateSub(high, low, "")
@@ -2323,10 +3856,17 @@ func (c *Compiler) parseExpr(frame *Frame, expr ssa.Value) (llvm.Value, error) {
 			// This is slightly non-trivial: at runtime the list of methods
 			// needs to be checked to see whether it implements the interface.
 			// At the same time, the interface value itself is unchanged.
-			itfTypeNum := c.ir.InterfaceNum(itf)
-			itfTypeNumValue := llvm.ConstInt(llvm.Int16Type(), uint64(itfTypeNum), false)
-			fn := c.mod.NamedFunction("runtime.interfaceImplements")
-			commaOk = c.builder.CreateCall(fn, []llvm.Value{actualTypeNum, itfTypeNumValue}, "")
+			if itf.Empty() {
+				// Every type implements the empty interface, so only a nil
+				// interface fails this type assert.
+				zero := llvm.ConstInt(actualTypeNum.Type(), 0, false)
+				commaOk = c.builder.CreateICmp(llvm.IntNE, actualTypeNum, zero, "")
+			} else {
+				itfTypeNum := c.ir.InterfaceNum(itf)
+				itfTypeNumValue := llvm.ConstInt(c.uintptrType, uint64(itfTypeNum), false)
+				fn := c.mod.NamedFunction("runtime.interfaceImplements")
+				commaOk = c.builder.CreateCall(fn, []llvm.Value{actualTypeNum, itfTypeNumValue}, "")
+			}
 
 		} else {
 			// Type assert on concrete type.
@@ -2336,11 +3876,7 @@ func (c *Compiler) parseExpr(frame *Frame, expr ssa.Value) (llvm.Value, error) {
 				// Static analysis has determined this type assert will never apply.
 				return llvm.ConstStruct([]llvm.Value{valueNil, llvm.ConstInt(llvm.Int1Type(), 0, false)}, false), nil
 			}
-			if assertedTypeNum >= 1<<16 {
-				return llvm.Value{}, errors.New("interface typecodes do not fit in a 16-bit integer")
-			}
-
-			assertedTypeNumValue := llvm.ConstInt(llvm.Int16Type(), uint64(assertedTypeNum), false)
+			assertedTypeNumValue := llvm.ConstInt(c.uintptrType, uint64(assertedTypeNum), false)
 			commaOk = c.builder.CreateICmp(llvm.IntEQ, assertedTypeNumValue, actualTypeNum, "")
 		}
 
@@ -2383,16 +3919,18 @@ func (c *Compiler) parseExpr(frame *Frame, expr ssa.Value) (llvm.Value, error) {
 					valueOk = c.builder.CreatePtrToInt(valuePtr, assertedType, "typeassert.value.ok")
 				case llvm.PointerTypeKind:
 					valueOk = c.builder.CreateBitCast(valuePtr, assertedType, "typeassert.value.ok")
-				case llvm.StructTypeKind:
+				case llvm.FloatTypeKind, llvm.DoubleTypeKind:
+					bitsType := llvm.IntType(int(c.targetData.TypeSizeInBits(assertedType)))
+					bits := c.builder.CreatePtrToInt(valuePtr, bitsType, "")
+					valueOk = c.builder.CreateBitCast(bits, assertedType, "typeassert.value.ok")
+				default: // struct, array, complex
 					// A bitcast would be useful here, but bitcast doesn't allow
 					// aggregate types. So we'll bitcast it using an alloca.
 					// Hopefully this will get optimized away.
-					mem := c.builder.CreateAlloca(c.i8ptrType, "")
+					mem := c.createEntryBlockAlloca(c.i8ptrType, "typeassert.value.mem")
 					c.builder.CreateStore(valuePtr, mem)
 					memStructPtr := c.builder.CreateBitCast(mem, llvm.PointerType(assertedType, 0), "")
 					valueOk = c.builder.CreateLoad(memStructPtr, "typeassert.value.ok")
-				default:
-					return llvm.Value{}, errors.New("todo: typeassert: bitcast small types")
 				}
 			}
 		}
@@ -2551,6 +4089,50 @@ func (c *Compiler) parseBinOp(frame *Frame, binop *ssa.BinOp) (llvm.Value, error
 			default:
 				return llvm.Value{}, errors.New("todo: binop on float: " + binop.Op.String())
 			}
+		} else if typ.Info()&types.IsComplex != 0 {
+			// Operations on complex numbers, which are vectors of two floats:
+			// the real and the imaginary part.
+			zero := llvm.ConstInt(llvm.Int32Type(), 0, false)
+			one := llvm.ConstInt(llvm.Int32Type(), 1, false)
+			switch binop.Op {
+			case token.ADD:
+				return c.builder.CreateFAdd(x, y, ""), nil
+			case token.SUB: // -
+				return c.builder.CreateFSub(x, y, ""), nil
+			case token.MUL: // *
+				// (a+bi) * (c+di) = (ac-bd) + (ad+bc)i
+				a := c.builder.CreateExtractElement(x, zero, "")
+				b := c.builder.CreateExtractElement(x, one, "")
+				cr := c.builder.CreateExtractElement(y, zero, "")
+				d := c.builder.CreateExtractElement(y, one, "")
+				r := c.builder.CreateFSub(c.builder.CreateFMul(a, cr, ""), c.builder.CreateFMul(b, d, ""), "")
+				i := c.builder.CreateFAdd(c.builder.CreateFMul(a, d, ""), c.builder.CreateFMul(b, cr, ""), "")
+				result := c.builder.CreateInsertElement(llvm.Undef(x.Type()), r, zero, "")
+				return c.builder.CreateInsertElement(result, i, one, ""), nil
+			case token.QUO: // /
+				// Implemented in the runtime, for complex128 only.
+				if typ.Kind() == types.Complex64 {
+					complex128Type := llvm.VectorType(llvm.DoubleType(), 2)
+					x = c.builder.CreateFPExt(x, complex128Type, "")
+					y = c.builder.CreateFPExt(y, complex128Type, "")
+				}
+				result := c.builder.CreateCall(c.mod.NamedFunction("runtime.complex128div"), []llvm.Value{x, y}, "")
+				if typ.Kind() == types.Complex64 {
+					result = c.builder.CreateFPTrunc(result, llvm.VectorType(llvm.FloatType(), 2), "")
+				}
+				return result, nil
+			case token.EQL, token.NEQ: // ==, !=
+				cmp := c.builder.CreateFCmp(llvm.FloatOEQ, x, y, "")
+				realEqual := c.builder.CreateExtractElement(cmp, zero, "")
+				imagEqual := c.builder.CreateExtractElement(cmp, one, "")
+				result := c.builder.CreateAnd(realEqual, imagEqual, "")
+				if binop.Op == token.NEQ {
+					result = c.builder.CreateNot(result, "")
+				}
+				return result, nil
+			default:
+				return llvm.Value{}, errors.New("todo: binop on complex number: " + binop.Op.String())
+			}
 		} else if typ.Kind() == types.UnsafePointer {
 			// Operations on pointers
 			switch binop.Op {
@@ -2637,16 +4219,7 @@ func (c *Compiler) parseConst(expr *ssa.Const) (llvm.Value, error) {
 			}
 			return llvm.ConstInt(llvmType, n, false), nil
 		} else if typ.Kind() == types.String {
-			str := constant.StringVal(expr.Value)
-			strLen := llvm.ConstInt(c.lenType, uint64(len(str)), false)
-			global := llvm.AddGlobal(c.mod, llvm.ArrayType(llvm.Int8Type(), len(str)), ".str")
-			global.SetInitializer(c.ctx.ConstString(str, false))
-			global.SetLinkage(llvm.PrivateLinkage)
-			global.SetGlobalConstant(true)
-			zero := llvm.ConstInt(llvm.Int32Type(), 0, false)
-			strPtr := c.builder.CreateInBoundsGEP(global, []llvm.Value{zero, zero}, "")
-			strObj := llvm.ConstNamedStruct(c.mod.GetTypeByName("runtime._string"), []llvm.Value{strPtr, strLen})
-			return strObj, nil
+			return c.createConstString(constant.StringVal(expr.Value)), nil
 		} else if typ.Kind() == types.UnsafePointer {
 			if !expr.IsNil() {
 				value, _ := constant.Uint64Val(expr.Value)
@@ -2662,6 +4235,13 @@ func (c *Compiler) parseConst(expr *ssa.Const) (llvm.Value, error) {
 		} else if typ.Info()&types.IsFloat != 0 {
 			n, _ := constant.Float64Val(expr.Value)
 			return llvm.ConstFloat(llvmType, n), nil
+		} else if typ.Info()&types.IsComplex != 0 {
+			r, _ := constant.Float64Val(constant.Real(expr.Value))
+			i, _ := constant.Float64Val(constant.Imag(expr.Value))
+			return llvm.ConstVector([]llvm.Value{
+				llvm.ConstFloat(llvmType.ElementType(), r),
+				llvm.ConstFloat(llvmType.ElementType(), i),
+			}, false), nil
 		} else {
 			return llvm.Value{}, errors.New("todo: unknown constant: " + expr.String())
 		}
@@ -2680,7 +4260,7 @@ func (c *Compiler) parseConst(expr *ssa.Const) (llvm.Value, error) {
 		}
 		// Create a generic nil interface with no dynamic type (typecode=0).
 		fields := []llvm.Value{
-			llvm.ConstInt(llvm.Int16Type(), 0, false),
+			llvm.ConstInt(c.uintptrType, 0, false),
 			llvm.ConstPointerNull(c.i8ptrType),
 		}
 		itf := llvm.ConstNamedStruct(c.mod.GetTypeByName("runtime._interface"), fields)
@@ -2715,6 +4295,18 @@ func (c *Compiler) parseConst(expr *ssa.Const) (llvm.Value, error) {
 	}
 }
 
+// Create a string constant (of type runtime._string) with the given contents.
+func (c *Compiler) createConstString(str string) llvm.Value {
+	strLen := llvm.ConstInt(c.lenType, uint64(len(str)), false)
+	global := llvm.AddGlobal(c.mod, llvm.ArrayType(llvm.Int8Type(), len(str)), ".str")
+	global.SetInitializer(c.ctx.ConstString(str, false))
+	global.SetLinkage(llvm.PrivateLinkage)
+	global.SetGlobalConstant(true)
+	zero := llvm.ConstInt(llvm.Int32Type(), 0, false)
+	strPtr := llvm.ConstInBoundsGEP(global, []llvm.Value{zero, zero})
+	return llvm.ConstNamedStruct(c.mod.GetTypeByName("runtime._string"), []llvm.Value{strPtr, strLen})
+}
+
 func (c *Compiler) parseConvert(typeFrom, typeTo types.Type, value llvm.Value) (llvm.Value, error) {
 	llvmTypeFrom := value.Type()
 	llvmTypeTo, err := c.getLLVMType(typeTo)
@@ -2748,8 +4340,14 @@ func (c *Compiler) parseConvert(typeFrom, typeTo types.Type, value llvm.Value) (
 				// Cast to an i32 value as expected by
 				// runtime.stringFromUnicode.
 				if sizeFrom > 4 {
+					// Values that don't fit in a rune are invalid code points,
+					// just like values above 0x10ffff. This includes negative
+					// values, when compared as unsigned integers.
+					maxRune := llvm.ConstInt(value.Type(), 0x10ffff, false)
+					invalid := c.builder.CreateICmp(llvm.IntUGT, value, maxRune, "")
+					value = c.builder.CreateSelect(invalid, llvm.ConstInt(value.Type(), 0xfffd, false), value, "")
 					value = c.builder.CreateTrunc(value, llvm.Int32Type(), "")
-				} else if sizeFrom < 4 && typeTo.Info()&types.IsUnsigned != 0 {
+				} else if sizeFrom < 4 && typeFrom.Info()&types.IsUnsigned != 0 {
 					value = c.builder.CreateZExt(value, llvm.Int32Type(), "")
 				} else if sizeFrom < 4 {
 					value = c.builder.CreateSExt(value, llvm.Int32Type(), "")
@@ -2757,10 +4355,13 @@ func (c *Compiler) parseConvert(typeFrom, typeTo types.Type, value llvm.Value) (
 				fn := c.mod.NamedFunction("runtime.stringFromUnicode")
 				return c.builder.CreateCall(fn, []llvm.Value{value}, ""), nil
 			case *types.Slice:
-				switch typeFrom.Elem().(*types.Basic).Kind() {
+				switch typeFrom.Elem().Underlying().(*types.Basic).Kind() {
 				case types.Byte:
 					fn := c.mod.NamedFunction("runtime.stringFromBytes")
 					return c.builder.CreateCall(fn, []llvm.Value{value}, ""), nil
+				case types.Rune:
+					fn := c.mod.NamedFunction("runtime.stringFromRunes")
+					return c.builder.CreateCall(fn, []llvm.Value{value}, ""), nil
 				default:
 					return llvm.Value{}, errors.New("todo: convert to string: " + typeFrom.String())
 				}
@@ -2794,28 +4395,39 @@ func (c *Compiler) parseConvert(typeFrom, typeTo types.Type, value llvm.Value) (
 			}
 		}
 
+		if typeFrom.Info()&types.IsComplex != 0 && typeTo.Info()&types.IsComplex != 0 {
+			// Conversion between two complex numbers.
+			if sizeFrom > sizeTo {
+				return c.builder.CreateFPTrunc(value, llvmTypeTo, ""), nil
+			} else if sizeFrom < sizeTo {
+				return c.builder.CreateFPExt(value, llvmTypeTo, ""), nil
+			} else {
+				return value, nil
+			}
+		}
+
 		if typeFrom.Info()&types.IsFloat != 0 && typeTo.Info()&types.IsInteger != 0 {
 			// Conversion from float to int.
-			if typeTo.Info()&types.IsUnsigned != 0 { // to signed int
-				return c.builder.CreateFPToSI(value, llvmTypeTo, ""), nil
-			} else { // to unsigned int
+			if typeTo.Info()&types.IsUnsigned != 0 { // to unsigned int
 				return c.builder.CreateFPToUI(value, llvmTypeTo, ""), nil
+			} else { // to signed int
+				return c.builder.CreateFPToSI(value, llvmTypeTo, ""), nil
 			}
 		}
 
 		if typeFrom.Info()&types.IsInteger != 0 && typeTo.Info()&types.IsFloat != 0 {
 			// Conversion from int to float.
-			if typeFrom.Info()&types.IsUnsigned != 0 { // from signed int
-				return c.builder.CreateSIToFP(value, llvmTypeTo, ""), nil
-			} else { // from unsigned int
+			if typeFrom.Info()&types.IsUnsigned != 0 { // from unsigned int
 				return c.builder.CreateUIToFP(value, llvmTypeTo, ""), nil
+			} else { // from signed int
+				return c.builder.CreateSIToFP(value, llvmTypeTo, ""), nil
 			}
 		}
 
 		return llvm.Value{}, errors.New("todo: convert: basic non-integer type: " + typeFrom.String() + " -> " + typeTo.String())
 
 	case *types.Slice:
-		if basic, ok := typeFrom.(*types.Basic); !ok || basic.Kind() != types.String {
+		if basic, ok := typeFrom.Underlying().(*types.Basic); !ok || basic.Info()&types.IsString == 0 {
 			panic("can only convert from a string to a slice")
 		}
 
@@ -2824,6 +4436,9 @@ func (c *Compiler) parseConvert(typeFrom, typeTo types.Type, value llvm.Value) (
 		case types.Byte:
 			fn := c.mod.NamedFunction("runtime.stringToBytes")
 			return c.builder.CreateCall(fn, []llvm.Value{value}, ""), nil
+		case types.Rune:
+			fn := c.mod.NamedFunction("runtime.stringToRunes")
+			return c.builder.CreateCall(fn, []llvm.Value{value}, ""), nil
 		default:
 			return llvm.Value{}, errors.New("todo: convert from string: " + elemType.String())
 		}
@@ -2907,12 +4522,118 @@ func (c *Compiler) parseMakeClosure(frame *Frame, expr *ssa.MakeClosure) (llvm.V
 	if err != nil {
 		return llvm.Value{}, err
 	}
-	closure = c.builder.CreateInsertValue(closure, f.llvmFn, 1, "")
+	fnPtr, err := c.getFuncPtr(f)
+	if err != nil {
+		return llvm.Value{}, err
+	}
+	closure = c.builder.CreateInsertValue(closure, fnPtr, 1, "")
 	closure = c.builder.CreateInsertValue(closure, context, 0, "")
 	return closure, nil
 }
 
-func (c *Compiler) parseMakeInterface(val llvm.Value, typ types.Type, isConst bool) (llvm.Value, error) {
+// Return the function pointer of this function, as stored in a function value.
+// Blocking functions have a different LLVM type than their signature (see
+// parseFuncDecl), so they are bitcast to the regular function pointer type.
+// They are called as coroutines, see emitDynamicCoroutineCall.
+func (c *Compiler) getFuncPtr(f *Function) (llvm.Value, error) {
+	if !c.ir.IsBlocking(f) {
+		return f.llvmFn, nil
+	}
+	typ, err := c.getLLVMType(f.fn.Signature)
+	if err != nil {
+		return llvm.Value{}, err
+	}
+	if typ.TypeKind() == llvm.StructTypeKind {
+		// closure: {context, function pointer}
+		typ = typ.Subtypes()[1]
+	}
+	return llvm.ConstBitCast(f.llvmFn, typ), nil
+}
+
+// Call a function pointer or interface method of which all possible targets
+// are blocking (see AnalyseBlockingRecursive), as a coroutine. When started
+// from a go statement (parentHandle is nil), this returns the handle of the
+// new coroutine.
+func (c *Compiler) emitDynamicCoroutineCall(frame *Frame, instr *ssa.CallCommon, parentHandle llvm.Value) (llvm.Value, error) {
+	fnPtr, params, err := c.parseDynamicCoroutineCall(frame, instr)
+	if err != nil {
+		return llvm.Value{}, err
+	}
+	return c.createDynamicCoroutineCall(frame, instr, fnPtr, params, parentHandle)
+}
+
+// Evaluate the function pointer and parameters of a call through a function
+// pointer or interface method to a coroutine, see emitDynamicCoroutineCall.
+// The parameters include the receiver and closure context, if any.
+func (c *Compiler) parseDynamicCoroutineCall(frame *Frame, instr *ssa.CallCommon) (llvm.Value, []llvm.Value, error) {
+	var params []llvm.Value
+	var fnPtr, context llvm.Value
+	var err error
+	if instr.IsInvoke() {
+		itf, err := c.parseExpr(frame, instr.Value)
+		if err != nil {
+			return llvm.Value{}, nil, err
+		}
+		methodNum := llvm.ConstInt(c.uintptrType, uint64(c.ir.MethodNum(instr.Method)), false)
+		fnPtr = c.builder.CreateCall(c.mod.NamedFunction("runtime.interfaceMethod"), []llvm.Value{itf, methodNum}, "invoke.func")
+		// Pass the value of the interface as receiver. Methods with another
+		// receiver type have an $invoke wrapper that unpacks it, see
+		// getInvokeFunc.
+		params = append(params, c.builder.CreateExtractValue(itf, 1, "invoke.func.receiver"))
+		if c.ir.SignatureNeedsContext(instr.Signature()) {
+			// See parseCall: an interface call is never a closure call.
+			context = llvm.ConstPointerNull(c.i8ptrType)
+		}
+	} else {
+		fnPtr, err = c.parseExpr(frame, instr.Value)
+		if err != nil {
+			return llvm.Value{}, nil, err
+		}
+		if c.ir.SignatureNeedsContext(instr.Signature()) {
+			// closure: {context, function pointer}
+			context = c.builder.CreateExtractValue(fnPtr, 0, "")
+			fnPtr = c.builder.CreateExtractValue(fnPtr, 1, "")
+		}
+	}
+
+	for _, arg := range instr.Args {
+		val, err := c.parseExpr(frame, arg)
+		if err != nil {
+			return llvm.Value{}, nil, err
+		}
+		params = append(params, val)
+	}
+	if !context.IsNil() {
+		params = append(params, context)
+	}
+	return fnPtr, params, nil
+}
+
+// Call the coroutine fnPtr with the parameters from parseDynamicCoroutineCall.
+func (c *Compiler) createDynamicCoroutineCall(frame *Frame, instr *ssa.CallCommon, fnPtr llvm.Value, params []llvm.Value, parentHandle llvm.Value) (llvm.Value, error) {
+	// Determine the type of the coroutine, see parseFuncDecl: it has a
+	// parent coroutine parameter and possibly a result slot before the
+	// regular parameters.
+	paramTypes := []llvm.Type{c.i8ptrType}
+	resultType, err := c.getResultType(instr.Signature())
+	if err != nil {
+		return llvm.Value{}, err
+	}
+	if !resultType.IsNil() {
+		paramTypes = append(paramTypes, llvm.PointerType(resultType, 0))
+	}
+	for _, param := range params {
+		paramTypes = append(paramTypes, param.Type())
+	}
+	fnType := llvm.FunctionType(c.i8ptrType, paramTypes, false)
+	fnPtr = c.builder.CreateBitCast(fnPtr, llvm.PointerType(fnType, 0), "coroutine")
+	return c.createFunctionCall(frame, fnPtr, params, true, parentHandle)
+}
+
+// Create an interface value of the given type. The frame and expression are
+// only used for non-constant interfaces, to allocate the value when it doesn't
+// fit in a pointer.
+func (c *Compiler) parseMakeInterface(frame *Frame, expr *ssa.MakeInterface, val llvm.Value, typ types.Type, isConst bool) (llvm.Value, error) {
 	var itfValue llvm.Value
 	size := c.targetData.TypeAllocSize(val.Type())
 	if size > c.targetData.TypeAllocSize(c.i8ptrType) {
@@ -2926,12 +4647,14 @@ func (c *Compiler) parseMakeInterface(val llvm.Value, typ types.Type, isConst bo
 			itfValueRaw := llvm.ConstInBoundsGEP(global, []llvm.Value{zero, zero})
 			itfValue = llvm.ConstBitCast(itfValueRaw, c.i8ptrType)
 		} else {
-			// Allocate on the heap and put a pointer in the interface.
-			// TODO: escape analysis.
-			sizeValue := llvm.ConstInt(c.uintptrType, size, false)
-			itfValue = c.builder.CreateCall(c.allocFunc, []llvm.Value{sizeValue}, "")
-			itfValueCast := c.builder.CreateBitCast(itfValue, llvm.PointerType(val.Type(), 0), "")
+			// Allocate (on the heap, if it escapes) and put a pointer in the
+			// interface.
+			itfValueCast, err := c.emitAlloc(frame, expr, val.Type(), "")
+			if err != nil {
+				return llvm.Value{}, err
+			}
 			c.builder.CreateStore(val, itfValueCast)
+			itfValue = c.builder.CreateBitCast(itfValueCast, c.i8ptrType, "")
 		}
 	} else {
 		// Directly place the value in the interface.
@@ -2940,23 +4663,23 @@ func (c *Compiler) parseMakeInterface(val llvm.Value, typ types.Type, isConst bo
 			itfValue = c.builder.CreateIntToPtr(val, c.i8ptrType, "")
 		case llvm.PointerTypeKind:
 			itfValue = c.builder.CreateBitCast(val, c.i8ptrType, "")
-		case llvm.StructTypeKind:
+		case llvm.FloatTypeKind, llvm.DoubleTypeKind:
+			// Store the bits of the float as an integer.
+			bitsType := llvm.IntType(int(c.targetData.TypeSizeInBits(val.Type())))
+			bits := c.builder.CreateBitCast(val, bitsType, "")
+			itfValue = c.builder.CreateIntToPtr(bits, c.i8ptrType, "")
+		default: // struct, array, complex
 			// A bitcast would be useful here, but bitcast doesn't allow
 			// aggregate types. So we'll bitcast it using an alloca.
 			// Hopefully this will get optimized away.
-			mem := c.builder.CreateAlloca(c.i8ptrType, "")
+			mem := c.createEntryBlockAlloca(c.i8ptrType, "makeinterface.mem")
 			memStructPtr := c.builder.CreateBitCast(mem, llvm.PointerType(val.Type(), 0), "")
 			c.builder.CreateStore(val, memStructPtr)
 			itfValue = c.builder.CreateLoad(mem, "")
-		default:
-			return llvm.Value{}, errors.New("todo: makeinterface: cast small type to i8*")
 		}
 	}
 	itfTypeNum, _ := c.ir.TypeNum(typ)
-	if itfTypeNum >= 1<<16 {
-		return llvm.Value{}, errors.New("interface typecodes do not fit in a 16-bit integer")
-	}
-	itf := llvm.ConstNamedStruct(c.mod.GetTypeByName("runtime._interface"), []llvm.Value{llvm.ConstInt(llvm.Int16Type(), uint64(itfTypeNum), false), llvm.Undef(c.i8ptrType)})
+	itf := llvm.ConstNamedStruct(c.mod.GetTypeByName("runtime._interface"), []llvm.Value{llvm.ConstInt(c.uintptrType, uint64(itfTypeNum), false), llvm.Undef(c.i8ptrType)})
 	itf = c.builder.CreateInsertValue(itf, itfValue, 1, "")
 	return itf, nil
 }
@@ -2975,6 +4698,8 @@ func (c *Compiler) parseUnOp(frame *Frame, unop *ssa.UnOp) (llvm.Value, error) {
 				return c.builder.CreateSub(llvm.ConstInt(x.Type(), 0, false), x, ""), nil
 			} else if typ.Info()&types.IsFloat != 0 {
 				return c.builder.CreateFSub(llvm.ConstFloat(x.Type(), 0.0), x, ""), nil
+			} else if typ.Info()&types.IsComplex != 0 {
+				return c.builder.CreateFSub(llvm.ConstNull(x.Type()), x, ""), nil
 			} else {
 				return llvm.Value{}, errors.New("todo: unknown basic type for negate: " + typ.String())
 			}
@@ -2989,14 +4714,189 @@ func (c *Compiler) parseUnOp(frame *Frame, unop *ssa.UnOp) (llvm.Value, error) {
 			// registers.
 			load.SetVolatile(true)
 		}
+		if !frame.deferFrame.IsNil() && isAllocAddr(unop.X) {
+			// See *ssa.Store: values must be read from memory, as they may
+			// have been changed before a recovered panic.
+			load.SetVolatile(true)
+		}
 		return load, nil
 	case token.XOR: // ^x, toggle all bits in integer
 		return c.builder.CreateXor(x, llvm.ConstInt(x.Type(), ^uint64(0), false), ""), nil
+	case token.ARROW: // <-x, receive from channel
+		return c.emitChanRecv(frame, unop, x)
 	default:
 		return llvm.Value{}, errors.New("todo: unknown unop")
 	}
 }
 
+// Emit a channel send operation. In a blocking function, the current coroutine
+// is suspended afterwards: the runtime either leaves it runnable (the value
+// was sent) or parks it until a receiver arrives or the channel is closed.
+func (c *Compiler) emitChanSend(frame *Frame, instr *ssa.Send) error {
+	ch, err := c.parseExpr(frame, instr.Chan)
+	if err != nil {
+		return err
+	}
+	value, err := c.parseExpr(frame, instr.X)
+	if err != nil {
+		return err
+	}
+
+	// The value and the list node must stay alive while the coroutine is
+	// parked. They are passed to chanSendResult after the suspend, so that
+	// they are part of the coroutine frame instead of the stack.
+	valueAlloca := c.createEntryBlockAlloca(value.Type(), "chan.value")
+	c.builder.CreateStore(value, valueAlloca)
+	valuePtr := c.builder.CreateBitCast(valueAlloca, c.i8ptrType, "chan.valueptr")
+	blocked := c.createEntryBlockAlloca(c.mod.GetTypeByName("runtime.channelBlockedList"), "chan.blocked")
+
+	chanSend := c.mod.NamedFunction("runtime.chanSend")
+	if frame.blocking {
+		c.builder.CreateCall(chanSend, []llvm.Value{frame.taskHandle, ch, valuePtr, blocked}, "")
+		c.emitSuspend(frame, "chan.sent")
+		valuePtr = c.builder.CreateBitCast(valueAlloca, c.i8ptrType, "chan.valueptr")
+		chanSendResult := c.mod.NamedFunction("runtime.chanSendResult")
+		c.builder.CreateCall(chanSendResult, []llvm.Value{frame.taskHandle, ch, valuePtr, blocked}, "")
+	} else {
+		// There is no scheduler, so there is nobody to wait for.
+		sender := llvm.ConstPointerNull(c.i8ptrType)
+		c.builder.CreateCall(chanSend, []llvm.Value{sender, ch, valuePtr, blocked}, "")
+	}
+	return nil
+}
+
+// Emit a select statement. The runtime picks a case that can proceed (or parks
+// the coroutine until there is one) and the result is the tuple go/ssa expects:
+// the case index, recvOk and the received value of every receive case.
+func (c *Compiler) emitSelect(frame *Frame, expr *ssa.Select) (llvm.Value, error) {
+	// All cases, their values and their list nodes must stay alive while the
+	// coroutine is parked. They are used again after the suspend, so that they
+	// are part of the coroutine frame instead of the stack.
+	stateType := c.mod.GetTypeByName("runtime.chanSelectState")
+	blockedType := c.mod.GetTypeByName("runtime.channelBlockedList")
+	statesAlloca := c.createEntryBlockAlloca(llvm.ArrayType(stateType, len(expr.States)), "select.states")
+	blockedAlloca := c.createEntryBlockAlloca(llvm.ArrayType(blockedType, len(expr.States)), "select.blocked")
+
+	zero := llvm.ConstInt(llvm.Int32Type(), 0, false)
+	resultTypes := []llvm.Type{c.intType, llvm.Int1Type()} // index, recvOk
+	var sendAllocas, recvAllocas []llvm.Value
+	for i, state := range expr.States {
+		ch, err := c.parseExpr(frame, state.Chan)
+		if err != nil {
+			return llvm.Value{}, err
+		}
+		var valueAlloca llvm.Value
+		isSend := state.Dir == types.SendOnly
+		if isSend {
+			value, err := c.parseExpr(frame, state.Send)
+			if err != nil {
+				return llvm.Value{}, err
+			}
+			valueAlloca = c.createEntryBlockAlloca(value.Type(), "select.send.value")
+			c.builder.CreateStore(value, valueAlloca)
+			sendAllocas = append(sendAllocas, valueAlloca)
+		} else {
+			llvmElemType, err := c.getLLVMType(state.Chan.Type().Underlying().(*types.Chan).Elem())
+			if err != nil {
+				return llvm.Value{}, err
+			}
+			valueAlloca = c.createEntryBlockAlloca(llvmElemType, "select.recv.value")
+			recvAllocas = append(recvAllocas, valueAlloca)
+			resultTypes = append(resultTypes, llvmElemType)
+		}
+		valuePtr := c.builder.CreateBitCast(valueAlloca, c.i8ptrType, "select.valueptr")
+
+		// Fill in runtime.chanSelectState{ch, value, send}.
+		selectState := llvm.Undef(stateType)
+		selectState = c.builder.CreateInsertValue(selectState, ch, 0, "")
+		selectState = c.builder.CreateInsertValue(selectState, valuePtr, 1, "")
+		if isSend {
+			selectState = c.builder.CreateInsertValue(selectState, llvm.ConstInt(llvm.Int1Type(), 1, false), 2, "")
+		} else {
+			selectState = c.builder.CreateInsertValue(selectState, llvm.ConstInt(llvm.Int1Type(), 0, false), 2, "")
+		}
+		statePtr := c.builder.CreateGEP(statesAlloca, []llvm.Value{zero, llvm.ConstInt(llvm.Int32Type(), uint64(i), false)}, "select.state")
+		c.builder.CreateStore(selectState, statePtr)
+	}
+
+	// Create slices of the cases and list nodes, to pass to the runtime.
+	states := c.createArraySlice(statesAlloca, len(expr.States), "select.states")
+	blocked := c.createArraySlice(blockedAlloca, len(expr.States), "select.blocked")
+
+	chanSelect := c.mod.NamedFunction("runtime.chanSelect")
+	var result llvm.Value
+	if frame.blocking && expr.Blocking {
+		blocking := llvm.ConstInt(llvm.Int1Type(), 1, false)
+		c.builder.CreateCall(chanSelect, []llvm.Value{frame.taskHandle, states, blocked, blocking}, "")
+		c.emitSuspend(frame, "select.done")
+		// The runtime only refers to the send values through the cases.
+		for _, valueAlloca := range sendAllocas {
+			c.emitKeepAlive(valueAlloca)
+		}
+		states = c.createArraySlice(statesAlloca, len(expr.States), "select.states")
+		blocked = c.createArraySlice(blockedAlloca, len(expr.States), "select.blocked")
+		chanSelectResult := c.mod.NamedFunction("runtime.chanSelectResult")
+		result = c.builder.CreateCall(chanSelectResult, []llvm.Value{frame.taskHandle, states, blocked}, "select.result")
+	} else {
+		// Either there is a default case, or there is no scheduler so that
+		// there is nobody to wait for.
+		task := llvm.ConstPointerNull(c.i8ptrType)
+		blocking := llvm.ConstInt(llvm.Int1Type(), 0, false)
+		if expr.Blocking {
+			blocking = llvm.ConstInt(llvm.Int1Type(), 1, false)
+		}
+		result = c.builder.CreateCall(chanSelect, []llvm.Value{task, states, blocked, blocking}, "select.result")
+	}
+
+	// Create the result tuple.
+	tuple := llvm.Undef(llvm.StructType(resultTypes, false))
+	tuple = c.builder.CreateInsertValue(tuple, c.builder.CreateExtractValue(result, 0, "select.index"), 0, "")
+	tuple = c.builder.CreateInsertValue(tuple, c.builder.CreateExtractValue(result, 1, "select.recvOk"), 1, "")
+	for i, valueAlloca := range recvAllocas {
+		received := c.builder.CreateLoad(valueAlloca, "select.received")
+		tuple = c.builder.CreateInsertValue(tuple, received, 2+i, "")
+	}
+	return tuple, nil
+}
+
+// Emit a channel receive operation. Like a send, it suspends the current
+// coroutine in blocking functions. The result is either the received value or
+// a {value, ok} tuple for comma-ok receives.
+func (c *Compiler) emitChanRecv(frame *Frame, unop *ssa.UnOp, ch llvm.Value) (llvm.Value, error) {
+	chanType := unop.X.Type().Underlying().(*types.Chan)
+	llvmElemType, err := c.getLLVMType(chanType.Elem())
+	if err != nil {
+		return llvm.Value{}, err
+	}
+	valueAlloca := c.createEntryBlockAlloca(llvmElemType, "chan.value")
+	valuePtr := c.builder.CreateBitCast(valueAlloca, c.i8ptrType, "chan.valueptr")
+	blocked := c.createEntryBlockAlloca(c.mod.GetTypeByName("runtime.channelBlockedList"), "chan.blocked")
+
+	chanRecv := c.mod.NamedFunction("runtime.chanRecv")
+	var commaOk llvm.Value
+	if frame.blocking {
+		c.builder.CreateCall(chanRecv, []llvm.Value{frame.taskHandle, ch, valuePtr, blocked}, "")
+		c.emitSuspend(frame, "chan.received")
+		// Like in emitChanSend, pass the list node after the suspend to keep
+		// it in the coroutine frame. The value is loaded below.
+		chanRecvResult := c.mod.NamedFunction("runtime.chanRecvResult")
+		commaOk = c.builder.CreateCall(chanRecvResult, []llvm.Value{frame.taskHandle, blocked}, "chan.commaOk")
+	} else {
+		// There is no scheduler, so there is nobody to wait for.
+		receiver := llvm.ConstPointerNull(c.i8ptrType)
+		commaOk = c.builder.CreateCall(chanRecv, []llvm.Value{receiver, ch, valuePtr, blocked}, "chan.commaOk")
+	}
+	received := c.builder.CreateLoad(valueAlloca, "chan.received")
+
+	if unop.CommaOk {
+		tuple := llvm.ConstStruct([]llvm.Value{llvm.Undef(llvmElemType), llvm.Undef(llvm.Int1Type())}, false) // create empty tuple
+		tuple = c.builder.CreateInsertValue(tuple, received, 0, "")                                           // insert value
+		tuple = c.builder.CreateInsertValue(tuple, commaOk, 1, "")                                            // insert 'comma ok' boolean
+		return tuple, nil
+	}
+	return received, nil
+}
+
 // IR returns the whole IR as a human-readable string.
 func (c *Compiler) IR() string {
 	return c.mod.String()
@@ -172,6 +172,10 @@ func (p *Program) interpret(instrs []ssa.Instruction, paramKeys []*ssa.Parameter
 		case *ssa.MakeInterface:
 			locals[instr] = &InterfaceValue{instr.X.Type(), locals[instr.X]}
 		case *ssa.MakeMap:
+			if !isStringMap(instr.Type()) {
+				// Only maps with string keys can be created at compile time.
+				return i, nil
+			}
 			locals[instr] = &MapValue{instr.Type().Underlying().(*types.Map), nil, nil}
 		case *ssa.MapUpdate:
 			// Assume no duplicate keys exist. This is most likely true for
@@ -270,7 +274,7 @@ func canInterpret(callee *ssa.Function) bool {
 		return false
 	}
 	for _, instr := range callee.Blocks[0].Instrs {
-		switch instr.(type) {
+		switch instr := instr.(type) {
 		// Ignore all functions fully supported by Program.interpret()
 		// above.
 		case *ssa.Alloc:
@@ -280,6 +284,9 @@ func canInterpret(callee *ssa.Function) bool {
 		case *ssa.IndexAddr:
 		case *ssa.MakeInterface:
 		case *ssa.MakeMap:
+			if !isStringMap(instr.Type()) {
+				return false
+			}
 		case *ssa.MapUpdate:
 		case *ssa.Return:
 		case *ssa.Slice:
@@ -292,6 +299,12 @@ func canInterpret(callee *ssa.Function) bool {
 	return true
 }
 
+// Return true if this is a map type with string keys.
+func isStringMap(typ types.Type) bool {
+	keyType, ok := typ.Underlying().(*types.Map).Key().Underlying().(*types.Basic)
+	return ok && keyType.Kind() == types.String
+}
+
 func (p *Program) getValue(value ssa.Value, locals map[ssa.Value]Value) (Value, error) {
 	switch value := value.(type) {
 	case *ssa.Const:
@@ -8,6 +8,7 @@ import (
 
 	"github.com/aykevl/llvm/bindings/go/llvm"
 	"golang.org/x/tools/go/ssa"
+	"golang.org/x/tools/go/types/typeutil"
 )
 
 // This file provides a wrapper around go/ssa values and adds extra
@@ -25,25 +26,29 @@ type Program struct {
 	NamedTypes           []*NamedType
 	needsScheduler       bool
 	goCalls              []*ssa.Go
-	typesWithMethods     map[string]*TypeWithMethods // see AnalyseInterfaceConversions
-	typesWithoutMethods  map[string]int              // see AnalyseInterfaceConversions
-	methodSignatureNames map[string]int              // see MethodNum
-	interfaces           map[string]*Interface       // see AnalyseInterfaceConversions
-	fpWithContext        map[string]struct{}         // see AnalyseFunctionPointers
+	typesWithMethods     typeutil.Map              // *TypeWithMethods by type, see AnalyseInterfaceConversions
+	typesWithoutMethods  typeutil.Map              // typecode by type, see AnalyseInterfaceConversions
+	methodSignatureNames map[string]int            // see MethodNum
+	interfaces           map[string]*Interface     // see AnalyseInterfaceConversions
+	fpWithContext        map[string]struct{}       // see AnalyseFunctionPointers
+	blockingFuncPtrs     map[string]struct{}       // see AnalyseBlockingRecursive
+	blockingMethods      map[string]struct{}       // see AnalyseBlockingRecursive
+	paramEscapes         map[*ssa.Parameter]string // see EscapeReason
 }
 
 // Function or method.
 type Function struct {
 	fn           *ssa.Function
 	llvmFn       llvm.Value
-	linkName     string      // go:linkname or go:export pragma
-	exported     bool        // go:export
-	nobounds     bool        // go:nobounds pragma
-	blocking     bool        // calculated by AnalyseBlockingRecursive
-	flag         bool        // used by dead code elimination
-	addressTaken bool        // used as function pointer, calculated by AnalyseFunctionPointers
-	parents      []*Function // calculated by AnalyseCallgraph
-	children     []*Function // calculated by AnalyseCallgraph
+	linkName     string                // go:linkname or go:export pragma
+	exported     bool                  // go:export
+	nobounds     bool                  // go:nobounds pragma
+	blocking     bool                  // calculated by AnalyseBlockingRecursive
+	flag         bool                  // used by dead code elimination
+	addressTaken bool                  // used as function pointer, calculated by AnalyseFunctionPointers
+	parents      []*Function           // calculated by AnalyseCallgraph
+	children     []*Function           // calculated by AnalyseCallgraph
+	dynamicCalls []ssa.CallInstruction // function pointer and interface calls, calculated by AnalyseCallgraph
 }
 
 // Global variable, possibly constant.
@@ -216,6 +221,22 @@ func (f *Function) IsExported() bool {
 	return f.exported
 }
 
+// Return true iff this function calls the builtin recover().
+func (f *Function) CallsRecover() bool {
+	for _, block := range f.fn.Blocks {
+		for _, instr := range block.Instrs {
+			call, ok := instr.(*ssa.Call)
+			if !ok {
+				continue
+			}
+			if builtin, ok := call.Call.Value.(*ssa.Builtin); ok && builtin.Name() == "recover" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
 // Return the link name for this function.
 func (f *Function) LinkName() string {
 	if f.linkName != "" {
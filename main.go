@@ -16,10 +16,10 @@ import (
 )
 
 // Helper function for Compiler object.
-func Compile(pkgName, runtimePath, outpath, target string, printIR, dumpSSA bool) error {
+func Compile(pkgName, runtimePath, outpath, target string, printIR, dumpSSA, printAllocs bool) error {
 	spec, err := LoadTarget(target)
 
-	c, err := NewCompiler(pkgName, spec.Triple, dumpSSA)
+	c, err := NewCompiler(pkgName, spec.Triple, dumpSSA, printAllocs)
 	if err != nil {
 		return err
 	}
@@ -127,7 +127,7 @@ func Compile(pkgName, runtimePath, outpath, target string, printIR, dumpSSA bool
 
 // Run the specified package directly (using JIT or interpretation).
 func Run(pkgName string) error {
-	c, err := NewCompiler(pkgName, llvm.DefaultTargetTriple(), false)
+	c, err := NewCompiler(pkgName, llvm.DefaultTargetTriple(), false, false)
 	if err != nil {
 		return errors.New("compiler: " + err.Error())
 	}
@@ -169,6 +169,7 @@ func main() {
 	outpath := flag.String("o", "", "output filename")
 	printIR := flag.Bool("printir", false, "print LLVM IR")
 	dumpSSA := flag.Bool("dumpssa", false, "dump internal Go SSA")
+	printAllocs := flag.Bool("print-allocs", false, "print which objects are allocated on the heap and why")
 	runtime := flag.String("runtime", "", "runtime LLVM bitcode files (from C sources)")
 	target := flag.String("target", llvm.DefaultTargetTriple(), "LLVM target")
 
@@ -195,7 +196,7 @@ func main() {
 			usage()
 			os.Exit(1)
 		}
-		err := Compile(flag.Arg(0), *runtime, *outpath, *target, *printIR, *dumpSSA)
+		err := Compile(flag.Arg(0), *runtime, *outpath, *target, *printIR, *dumpSSA, *printAllocs)
 		if err != nil {
 			fmt.Fprintln(os.Stderr, "error:", err)
 			os.Exit(1)
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"go/token"
 	"go/types"
 	"sort"
 	"strings"
 
 	"golang.org/x/tools/go/ssa"
+	"golang.org/x/tools/go/types/typeutil"
 )
 
 // This file implements several optimization passes (analysis + transform) to
@@ -71,6 +73,28 @@ func InterfaceKey(itf *types.Interface) string {
 	return strings.Join(methodStrings, ";")
 }
 
+// A function that parks the calling goroutine until something else wakes it
+// up. Calling one makes the caller blocking. When goroutines are used, the call
+// is replaced by a call to the given runtime function (with the task handle and
+// the first numArgs arguments) that sets the task state, followed by a suspend.
+type parkingIntrinsic struct {
+	taskFunc string
+	numArgs  int
+}
+
+// All functions that park the calling goroutine, by link name.
+var parkingIntrinsics = map[string]parkingIntrinsic{
+	// Sleeping.
+	"runtime.Sleep": {"runtime.sleepTask", 1},
+	"time.Sleep":    {"runtime.sleepTask", 1},
+	// Waiting for a sync.Mutex, sync.WaitGroup, sync.Cond, etc.
+	"sync.runtime_Semacquire":      {"runtime.semacquireTask", 1},
+	"sync.runtime_SemacquireMutex": {"runtime.semacquireTask", 1},
+	"sync.runtime_notifyListWait":  {"runtime.notifyListWaitTask", 2},
+	// Waiting for an interrupt handler to call runtime.wakeScheduler.
+	"machine.waitForInterrupt": {"runtime.interruptWaitTask", 0},
+}
+
 // Fill in parents of all functions.
 //
 // All packages need to be added before this pass can run, or it will produce
@@ -80,15 +104,25 @@ func (p *Program) AnalyseCallgraph() {
 		// Clear, if AnalyseCallgraph has been called before.
 		f.children = nil
 		f.parents = nil
+		f.dynamicCalls = nil
 
 		for _, block := range f.fn.Blocks {
 			for _, instr := range block.Instrs {
 				switch instr := instr.(type) {
-				case *ssa.Call:
-					if instr.Common().IsInvoke() {
+				case *ssa.Go:
+					if instr.Common().StaticCallee() == nil {
+						f.dynamicCalls = append(f.dynamicCalls, instr)
+					}
+				case *ssa.Call, *ssa.Defer:
+					// Deferred calls are regular calls, made when the
+					// function returns.
+					callInstr := instr.(ssa.CallInstruction)
+					if callInstr.Common().IsInvoke() {
+						// Interface method call, see AnalyseBlockingRecursive.
+						f.dynamicCalls = append(f.dynamicCalls, callInstr)
 						continue
 					}
-					switch call := instr.Call.Value.(type) {
+					switch call := callInstr.Common().Value.(type) {
 					case *ssa.Builtin:
 						// ignore
 					case *ssa.Function:
@@ -99,10 +133,31 @@ func (p *Program) AnalyseCallgraph() {
 						if child.CName() != "" {
 							continue // assume non-blocking
 						}
-						if child.LinkName() == "runtime.Sleep" {
+						if _, ok := parkingIntrinsics[child.LinkName()]; ok {
 							f.blocking = true
 						}
 						f.children = append(f.children, child)
+					case *ssa.MakeClosure:
+						child := p.GetFunction(call.Fn.(*ssa.Function))
+						f.children = append(f.children, child)
+					default:
+						// Function pointer, see AnalyseBlockingRecursive.
+						f.dynamicCalls = append(f.dynamicCalls, callInstr)
+					}
+				case *ssa.Select:
+					if instr.Blocking {
+						// A select without default case waits until one of
+						// the channels is ready.
+						f.blocking = true
+					}
+				case *ssa.Send:
+					// Sending on a channel may need to wait for a receiver.
+					f.blocking = true
+				case *ssa.UnOp:
+					if instr.Op == token.ARROW {
+						// Receiving from a channel may need to wait for a
+						// sender.
+						f.blocking = true
 					}
 				}
 			}
@@ -117,30 +172,33 @@ func (p *Program) AnalyseCallgraph() {
 
 // Find all types that are put in an interface.
 func (p *Program) AnalyseInterfaceConversions() {
-	// Clear, if AnalyseTypes has been called before.
-	p.typesWithoutMethods = map[string]int{"nil": 0}
-	p.typesWithMethods = map[string]*TypeWithMethods{}
+	// Clear, if AnalyseTypes has been called before. The types are keyed by
+	// identity instead of by name, as types declared in different functions
+	// may have the same name.
+	p.typesWithoutMethods = typeutil.Map{}
+	p.typesWithMethods = typeutil.Map{}
 
 	for _, f := range p.Functions {
 		for _, block := range f.fn.Blocks {
 			for _, instr := range block.Instrs {
 				switch instr := instr.(type) {
 				case *ssa.MakeInterface:
-					methods := getAllMethods(f.fn.Prog, instr.X.Type())
-					name := instr.X.Type().String()
-					if _, ok := p.typesWithMethods[name]; !ok && len(methods) > 0 {
+					typ := instr.X.Type()
+					methods := getAllMethods(f.fn.Prog, typ)
+					if p.typesWithMethods.At(typ) == nil && len(methods) > 0 {
 						t := &TypeWithMethods{
-							t:       instr.X.Type(),
-							Num:     len(p.typesWithMethods),
+							t:       typ,
+							Num:     p.typesWithMethods.Len(),
 							Methods: make(map[string]*types.Selection),
 						}
 						for _, sel := range methods {
 							name := MethodSignature(sel.Obj().(*types.Func))
 							t.Methods[name] = sel
 						}
-						p.typesWithMethods[name] = t
-					} else if _, ok := p.typesWithoutMethods[name]; !ok && len(methods) == 0 {
-						p.typesWithoutMethods[name] = len(p.typesWithoutMethods)
+						p.typesWithMethods.Set(typ, t)
+					} else if p.typesWithoutMethods.At(typ) == nil && len(methods) == 0 {
+						// Typecode 0 is used for nil interfaces.
+						p.typesWithoutMethods.Set(typ, p.typesWithoutMethods.Len()+1)
 					}
 				}
 			}
@@ -193,7 +251,8 @@ func (p *Program) AnalyseFunctionPointers() {
 
 // Analyse which functions are recursively blocking.
 //
-// Depends on AnalyseCallgraph.
+// Depends on AnalyseCallgraph, AnalyseInterfaceConversions and
+// AnalyseFunctionPointers.
 func (p *Program) AnalyseBlockingRecursive() {
 	worklist := make([]*Function, 0)
 
@@ -208,6 +267,57 @@ func (p *Program) AnalyseBlockingRecursive() {
 	// from the worklist and pushing all its parents that are non-blocking.
 	// This is somewhat similar to a worklist in a mark-sweep garbage collector.
 	// The work items are then grey objects.
+	p.markParentsBlocking(worklist)
+
+	// A function pointer or interface method call can call any function with
+	// the same signature. If one of them is blocking, all of them must be
+	// compiled as coroutines as they are called in the same way, and the
+	// caller is blocking as well (unless it starts a goroutine). That in turn
+	// may make other functions blocking, so repeat until nothing changes.
+	p.blockingFuncPtrs = map[string]struct{}{}
+	p.blockingMethods = map[string]struct{}{}
+	for {
+		worklist = worklist[:0]
+		for _, f := range p.Functions {
+			for _, instr := range f.dynamicCalls {
+				targets := p.dynamicCallTargets(instr.Common())
+				blocking := false
+				for _, target := range targets {
+					if target.blocking {
+						blocking = true
+						break
+					}
+				}
+				if !blocking {
+					continue
+				}
+				for _, target := range targets {
+					if !target.blocking {
+						target.blocking = true
+						worklist = append(worklist, target)
+					}
+				}
+				if _, ok := instr.(*ssa.Go); !ok && !f.blocking {
+					f.blocking = true
+					worklist = append(worklist, f)
+				}
+				if instr.Common().IsInvoke() {
+					p.blockingMethods[MethodSignature(instr.Common().Method)] = struct{}{}
+				} else {
+					p.blockingFuncPtrs[Signature(instr.Common().Signature())] = struct{}{}
+				}
+			}
+		}
+		if len(worklist) == 0 {
+			break
+		}
+		p.markParentsBlocking(worklist)
+	}
+}
+
+// Mark all parents of the functions in the worklist as blocking, recursively.
+// All functions in the worklist must already be marked as blocking.
+func (p *Program) markParentsBlocking(worklist []*Function) {
 	for len(worklist) != 0 {
 		// Pick the topmost.
 		f := worklist[len(worklist)-1]
@@ -223,7 +333,7 @@ func (p *Program) AnalyseBlockingRecursive() {
 
 // Check whether we need a scheduler. A scheduler is only necessary when there
 // are go calls that start blocking functions (if they're not blocking, the go
-// function can be turned into a regular function call).
+// function can be turned into a regular function call) or when timers are used.
 //
 // Depends on AnalyseBlockingRecursive.
 func (p *Program) AnalyseGoCalls() {
@@ -239,16 +349,200 @@ func (p *Program) AnalyseGoCalls() {
 		}
 	}
 	for _, instr := range p.goCalls {
-		switch instr := instr.Call.Value.(type) {
-		case *ssa.Builtin:
-		case *ssa.Function:
-			if p.functionMap[instr].blocking {
+		if fn := instr.Common().StaticCallee(); fn != nil {
+			if p.functionMap[fn].blocking {
 				p.needsScheduler = true
 			}
+		} else if p.isBlockingDynamicCall(instr.Common()) {
+			p.needsScheduler = true
+		}
+	}
+
+	// Timers of the time package are fired by the scheduler. Only a blocking
+	// main function can wait for them (by receiving from the timer channel),
+	// so only include the scheduler in that case.
+	main := p.GetFunction(p.mainPkg.Members["main"].(*ssa.Function))
+	if main.blocking {
+		for _, f := range p.Functions {
+			if f.LinkName() == "time.startTimer" && len(f.fn.Blocks) == 0 {
+				// The time package declares startTimer and uses it.
+				p.needsScheduler = true
+			}
+		}
+	}
+}
+
+// Return all functions that may be called by this call through a function
+// pointer or interface method: functions with the same signature whose
+// address is taken or methods with the same name and signature of types that
+// are put in an interface. Static calls and builtins have no dynamic targets.
+//
+// Depends on AnalyseInterfaceConversions and AnalyseFunctionPointers.
+func (p *Program) dynamicCallTargets(call *ssa.CallCommon) []*Function {
+	var targets []*Function
+	if call.IsInvoke() {
+		name := MethodSignature(call.Method)
+		for _, t := range p.AllDynamicTypes() {
+			if sel, ok := t.Methods[name]; ok {
+				targets = append(targets, p.GetFunction(p.program.MethodValue(sel)))
+			}
+		}
+		return targets
+	}
+	if call.StaticCallee() != nil {
+		return nil
+	}
+	if _, ok := call.Value.(*ssa.Builtin); ok {
+		return nil
+	}
+	sig := Signature(call.Signature())
+	for _, f := range p.Functions {
+		if f.addressTaken && Signature(f.fn.Signature) == sig {
+			targets = append(targets, f)
+		}
+	}
+	return targets
+}
+
+// Whether this call through a function pointer or interface method may call a
+// blocking function, in which case all possible targets are coroutines.
+//
+// Depends on AnalyseBlockingRecursive.
+func (p *Program) isBlockingDynamicCall(call *ssa.CallCommon) bool {
+	if call.IsInvoke() {
+		_, blocking := p.blockingMethods[MethodSignature(call.Method)]
+		return blocking
+	}
+	if call.StaticCallee() != nil {
+		return false
+	}
+	if _, ok := call.Value.(*ssa.Builtin); ok {
+		return false
+	}
+	_, blocking := p.blockingFuncPtrs[Signature(call.Signature())]
+	return blocking
+}
+
+// Escape analysis. Return why the object created by this value (an *ssa.Alloc,
+// *ssa.MakeInterface or *ssa.MakeSlice) may be referenced after the function
+// that created it has returned, or an empty string if it cannot. Objects that
+// don't escape can be allocated on the stack instead of the heap.
+func (p *Program) EscapeReason(value ssa.Value) string {
+	if p.paramEscapes == nil {
+		p.paramEscapes = make(map[*ssa.Parameter]string)
+	}
+	return p.escapeReason(value)
+}
+
+// Return why the object referenced by this value (a pointer, slice or
+// interface) may escape, following all values derived from it. See
+// EscapeReason.
+func (p *Program) escapeReason(value ssa.Value) string {
+	referrers := value.Referrers()
+	if referrers == nil {
+		return ""
+	}
+	for _, instr := range *referrers {
+		reason := ""
+		switch instr := instr.(type) {
+		case *ssa.DebugRef:
+			// ignore
+		case *ssa.UnOp:
+			// Loading from a pointer copies the value.
+		case *ssa.BinOp:
+			// Comparing a pointer, slice or interface doesn't keep it.
+		case *ssa.Store:
+			if instr.Val == value {
+				reason = "stored in memory"
+			}
+		case *ssa.FieldAddr, *ssa.IndexAddr, *ssa.Slice, *ssa.ChangeInterface, *ssa.ChangeType:
+			// A value derived from this object, which references the same
+			// memory.
+			reason = p.escapeReason(instr.(ssa.Value))
+		case *ssa.TypeAssert:
+			if _, ok := instr.AssertedType.Underlying().(*types.Interface); ok {
+				reason = "converted to another interface"
+			}
+			// Else the value is copied out of the interface.
+		case *ssa.Call:
+			reason = p.callEscapeReason(instr, value)
+		case *ssa.Return:
+			reason = "returned from function"
+		case *ssa.MakeInterface:
+			reason = "converted to an interface"
+		case *ssa.MakeClosure:
+			reason = "captured by a closure"
+		case *ssa.Phi:
+			reason = "used in a phi node"
+		case *ssa.Go:
+			reason = "passed to a goroutine"
+		case *ssa.Defer:
+			reason = "passed to a deferred call"
 		default:
-			panic("unknown go call function type")
+			reason = "used by an unsupported instruction: " + instr.String()
+		}
+		if reason != "" {
+			return reason
+		}
+	}
+	return ""
+}
+
+// Return why the object referenced by value may escape through the given call,
+// where it is used as an argument (or interface receiver).
+func (p *Program) callEscapeReason(call *ssa.Call, value ssa.Value) string {
+	common := call.Common()
+	if common.IsInvoke() {
+		return "passed to an interface method"
+	}
+	if builtin, ok := common.Value.(*ssa.Builtin); ok {
+		switch builtin.Name() {
+		case "print", "println", "len", "cap", "copy":
+			return ""
+		case "append":
+			if common.Args[0] == value {
+				// The result may use the same backing array.
+				return p.escapeReason(call)
+			}
+			return "" // the elements are copied
+		case "ssa:wrapnilchk":
+			// Returns its first argument.
+			return p.escapeReason(call)
+		default:
+			return "passed to builtin " + builtin.Name()
+		}
+	}
+	fn := common.StaticCallee()
+	if fn == nil {
+		return "passed to a function pointer"
+	}
+	if len(fn.Blocks) == 0 {
+		return "passed to external function " + fn.RelString(nil)
+	}
+	if p.IsBlocking(p.GetFunction(fn)) {
+		// The caller is suspended while the callee is parked. A stack object
+		// that isn't used after the call does not end up in the coroutine
+		// frame and would be overwritten by other goroutines in the meantime.
+		return "passed to blocking function " + fn.RelString(nil)
+	}
+	for i, arg := range common.Args {
+		if arg != value {
+			continue
+		}
+		param := fn.Params[i]
+		reason, ok := p.paramEscapes[param]
+		if !ok {
+			// Assume the worst while analysing this parameter, in case the
+			// function is (indirectly) recursive.
+			p.paramEscapes[param] = "passed to a recursive function"
+			reason = p.escapeReason(param)
+			p.paramEscapes[param] = reason
+		}
+		if reason != "" {
+			return "passed to " + fn.RelString(nil) + ", where it is " + reason
 		}
 	}
+	return ""
 }
 
 // Simple pass that removes dead code. This pass makes later analysis passes
@@ -289,7 +583,9 @@ func (p *Program) SimpleDCE() {
 						fn := p.program.MethodValue(sel)
 						callee := p.GetFunction(fn)
 						if callee == nil {
-							// TODO: why is this necessary?
+							// Methods on *T and wrappers of promoted methods
+							// are not added in AddPackage, as they're only
+							// created by MethodValue.
 							p.addFunction(fn)
 							callee = p.GetFunction(fn)
 						}
@@ -367,16 +663,45 @@ func (p *Program) IsBlocking(f *Function) bool {
 	return f.blocking
 }
 
+// Whether this call through a function pointer or interface method blocks, see
+// isBlockingDynamicCall.
+//
+// Depends on AnalyseBlockingRecursive and AnalyseGoCalls.
+func (p *Program) IsBlockingDynamicCall(call *ssa.CallCommon) bool {
+	if !p.needsScheduler {
+		return false
+	}
+	return p.isBlockingDynamicCall(call)
+}
+
+// Whether a function value with this signature may refer to a blocking
+// function. Such functions are coroutines, which can only be called from other
+// blocking functions.
+//
+// Depends on AnalyseBlockingRecursive and AnalyseGoCalls.
+func (p *Program) IsBlockingSignature(sig *types.Signature) bool {
+	if !p.needsScheduler {
+		return false
+	}
+	name := Signature(sig)
+	for _, f := range p.Functions {
+		if f.addressTaken && f.blocking && Signature(f.fn.Signature) == name {
+			return true
+		}
+	}
+	return false
+}
+
 // Return the type number and whether this type is actually used. Used in
 // interface conversions (type is always used) and type asserts (type may not be
 // used, meaning assert is always false in this program).
 //
 // May only be used after all packages have been added to the analyser.
 func (p *Program) TypeNum(typ types.Type) (int, bool) {
-	if n, ok := p.typesWithoutMethods[typ.String()]; ok {
-		return n, true
-	} else if meta, ok := p.typesWithMethods[typ.String()]; ok {
-		return len(p.typesWithoutMethods) + meta.Num, true
+	if n := p.typesWithoutMethods.At(typ); n != nil {
+		return n.(int), true
+	} else if meta := p.typesWithMethods.At(typ); meta != nil {
+		return p.FirstDynamicType() + meta.(*TypeWithMethods).Num, true
 	} else {
 		return -1, false // type is never put in an interface
 	}
@@ -405,21 +730,39 @@ func (p *Program) MethodNum(method *types.Func) int {
 	return p.methodSignatureNames[MethodSignature(method)]
 }
 
+// NumMethods returns the number of method IDs handed out by MethodNum so far.
+func (p *Program) NumMethods() int {
+	return len(p.methodSignatureNames)
+}
+
 // The start index of the first dynamic type that has methods.
 // Types without methods always have a lower ID and types with methods have this
 // or a higher ID.
 //
 // May only be used after all packages have been added to the analyser.
 func (p *Program) FirstDynamicType() int {
-	return len(p.typesWithoutMethods)
+	return p.typesWithoutMethods.Len() + 1 // typecode 0 is nil
 }
 
 // Return all types with methods, sorted by type ID.
 func (p *Program) AllDynamicTypes() []*TypeWithMethods {
-	l := make([]*TypeWithMethods, len(p.typesWithMethods))
-	for _, m := range p.typesWithMethods {
-		l[m.Num] = m
+	l := make([]*TypeWithMethods, p.typesWithMethods.Len())
+	p.typesWithMethods.Iterate(func(_ types.Type, m interface{}) {
+		l[m.(*TypeWithMethods).Num] = m.(*TypeWithMethods)
+	})
+	return l
+}
+
+// Return all types that are put in an interface, indexed by typecode. The first
+// entry is nil, as typecode 0 is used for nil interfaces.
+func (p *Program) AllTypes() []types.Type {
+	l := make([]types.Type, p.FirstDynamicType()+p.typesWithMethods.Len())
+	iterate := func(t types.Type, _ interface{}) {
+		n, _ := p.TypeNum(t)
+		l[n] = t
 	}
+	p.typesWithoutMethods.Iterate(iterate)
+	p.typesWithMethods.Iterate(iterate)
 	return l
 }
 
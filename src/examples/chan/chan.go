@@ -0,0 +1,158 @@
+package main
+
+// This example sends values between goroutines over channels, both unbuffered
+// (the sender waits for the receiver) and buffered (the sender only waits when
+// the buffer is full). It also waits on multiple channels at once using select
+// and returns values from functions that block.
+
+import "runtime"
+
+func main() {
+	ch := make(chan int)
+	go sender(ch)
+	for n := range ch {
+		println("received:", n)
+	}
+
+	buffered := make(chan int, 2)
+	go sender(buffered)
+	runtime.Sleep(runtime.Millisecond)
+	for {
+		n, ok := <-buffered
+		if !ok {
+			break
+		}
+		println("received from buffer:", n)
+	}
+
+	numbers := make(chan int)
+	quit := make(chan bool)
+	go sender(numbers)
+	go stopper(quit)
+	for done := false; !done; {
+		select {
+		case n, ok := <-numbers:
+			if ok {
+				println("selected:", n)
+			} else {
+				numbers = nil // stop selecting on the closed channel
+			}
+		case <-quit:
+			done = true
+		}
+	}
+
+	select {
+	case n := <-numbers:
+		println("unexpected:", n)
+	default:
+		println("nothing to receive")
+	}
+
+	values := make(chan int)
+	go sender(values)
+	n, ok := receiveWithTimeout(values)
+	println("received with timeout:", n, ok)
+	println("sum of remaining values:", sum(values))
+
+	// Goroutines can also be started on closures, function values and
+	// (interface) methods.
+	results := make(chan int)
+	base := 10
+	go func() {
+		results <- base + 1
+	}()
+	f := send
+	go f(results, 20)
+	w := worker{30}
+	go w.run(results)
+	var r runner = worker{40}
+	go r.run(results)
+	for i := 0; i < 4; i++ {
+		println("result:", <-results)
+	}
+
+	// Deferred calls may block as well.
+	finished := make(chan bool)
+	go finish(finished)
+	<-finished
+	println("finished")
+
+	// Blocking methods can also be called through an interface.
+	var d delayer = sleeper{runtime.Millisecond}
+	println("slept:", d.delay(5))
+
+	println("done")
+}
+
+type runner interface {
+	run(chan int)
+}
+
+type worker struct {
+	n int
+}
+
+func (w worker) run(ch chan int) {
+	ch <- w.n
+}
+
+type delayer interface {
+	delay(ms int) int
+}
+
+type sleeper struct {
+	unit runtime.Duration
+}
+
+func (s sleeper) delay(n int) int {
+	runtime.Sleep(s.unit * runtime.Duration(n))
+	return n
+}
+
+func send(ch chan int, n int) {
+	ch <- n
+}
+
+// receiveWithTimeout blocks, but still returns values to its caller.
+func receiveWithTimeout(ch chan int) (int, bool) {
+	timeout := make(chan bool, 1)
+	go stopper(timeout)
+	select {
+	case n := <-ch:
+		return n, true
+	case <-timeout:
+		return 0, false
+	}
+}
+
+func sum(ch chan int) int {
+	total := 0
+	for n := range ch {
+		total += n
+	}
+	return total
+}
+
+func stopper(quit chan bool) {
+	runtime.Sleep(runtime.Millisecond * 10)
+	quit <- true
+}
+
+func sender(ch chan int) {
+	defer close(ch)
+	for i := 1; i <= 4; i++ {
+		println("sending:", i)
+		ch <- i
+	}
+}
+
+// The deferred send waits until main receives the value.
+func finish(done chan bool) {
+	defer signal(done)
+	println("finishing")
+}
+
+func signal(done chan bool) {
+	done <- true
+}
@@ -0,0 +1,92 @@
+package main
+
+// This example exercises numeric and string conversions. Every test case
+// converts a value that is only known at runtime and compares the result
+// against the expected value.
+
+import "unsafe"
+
+type testCase struct {
+	name string
+	got  interface{}
+	want interface{}
+}
+
+var (
+	i8  int8    = -100
+	i16 int16   = -30000
+	i32 int32   = -2000000000
+	i64 int64   = -5000000000
+	u8  uint8   = 200
+	u16 uint16  = 60000
+	u32 uint32  = 4000000000
+	u64 uint64  = 10000000000
+	f32 float32 = -3.75
+	f64 float64 = 1e10 + 0.5
+
+	runes = []rune{'h', 'é', '世', '😀'}
+	text  = "hé世😀"
+)
+
+func main() {
+	x := 5
+	ptr := unsafe.Pointer(&x)
+
+	tests := []testCase{
+		// float -> int
+		{"float32 -> int8", int8(f32), int8(-3)},
+		{"float32 -> int16", int16(f32), int16(-3)},
+		{"float32 -> int32", int32(f32), int32(-3)},
+		{"float32 -> int64", int64(f32), int64(-3)},
+		{"float64 -> int64", int64(f64), int64(10000000000)},
+		{"float64 -> uint8", uint8(-f64 / -1e8), uint8(100)},
+		{"float64 -> uint32", uint32(f64 / 10), uint32(1000000000)},
+		{"float64 -> uint64", uint64(f64), uint64(10000000000)},
+
+		// int -> float
+		{"int8 -> float32", float32(i8), float32(-100)},
+		{"int16 -> float64", float64(i16), float64(-30000)},
+		{"int32 -> float64", float64(i32), float64(-2000000000)},
+		{"int64 -> float64", float64(i64), float64(-5000000000)},
+		{"uint8 -> float32", float32(u8), float32(200)},
+		{"uint16 -> float32", float32(u16), float32(60000)},
+		{"uint32 -> float64", float64(u32), float64(4000000000)},
+		{"uint64 -> float64", float64(u64), float64(10000000000)},
+
+		// float -> float
+		{"float32 -> float64", float64(f32), float64(-3.75)},
+		{"float64 -> float32", float32(f64 / 1e10), float32(1)},
+
+		// int -> string
+		{"int8 -> string", string(-i8 - 35), "A"},
+		{"int16 -> string", string(i16 + 30233), "é"},
+		{"int32 -> string", string(i32), "�"},
+		{"int64 -> string", string(i64 + 5000019990), "世"},
+		{"int64 (too big) -> string", string(-i64), "�"},
+		{"uint8 -> string", string(u8), "È"},
+		{"uint16 -> string", string(u16), "\uea60"},
+		{"uint32 -> string", string(u32), "�"},
+		{"uint64 -> string", string(u64), "�"},
+
+		// string <-> []rune
+		{"[]rune -> string", string(runes), text},
+		{"string -> []rune (len)", len([]rune(text)), len(runes)},
+		{"string -> []rune (last)", []rune(text)[3], '😀'},
+		{"string -> []rune (invalid)", []rune(text[:2])[1], '�'},
+
+		// unsafe.Pointer <-> uintptr
+		{"unsafe.Pointer -> uintptr", uintptr(ptr) != 0, true},
+		{"uintptr -> unsafe.Pointer", *(*int)(unsafe.Pointer(uintptr(ptr))), 5},
+	}
+
+	failures := 0
+	for _, tc := range tests {
+		if tc.got == tc.want {
+			println("ok:  ", tc.name)
+		} else {
+			println("FAIL:", tc.name)
+			failures++
+		}
+	}
+	println("failures:", failures)
+}
@@ -0,0 +1,35 @@
+package main
+
+// This example allocates a lot more memory than fits in the heap of a small
+// microcontroller, which only works when unreachable memory is reclaimed. It
+// also shows how finalizers are run once an object has become unreachable.
+
+import "runtime"
+
+type buffer struct {
+	data [64]byte
+	id   int
+}
+
+func main() {
+	sum := 0
+	for i := 0; i < 10000; i++ {
+		buf := &buffer{id: i}
+		buf.data[i%len(buf.data)] = byte(i)
+		sum += int(buf.data[i%len(buf.data)])
+	}
+	println("sum:", sum)
+
+	setFinalizer(42)
+	runtime.GC()
+	println("done")
+}
+
+func setFinalizer(id int) {
+	buf := &buffer{id: id}
+	runtime.SetFinalizer(buf, finalize)
+}
+
+func finalize(buf *buffer) {
+	println("finalized buffer:", buf.id)
+}
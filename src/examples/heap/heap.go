@@ -0,0 +1,43 @@
+package main
+
+// This example fills the heap, drops every reference to it and then allocates
+// a single object that is larger than half of the heap. That only fits when
+// the allocator finds all memory that the garbage collector freed, including
+// the free space around the position of the previous allocation.
+//
+// The sizes assume a heap of 64kB, for example on a Unix-like system with
+// TINYGOHEAP=64K or on a nRF52.
+
+type chunk struct {
+	next *chunk
+	data [1000]byte
+}
+
+func main() {
+	// Fill most of the heap and drop it again.
+	println("filled:", fill(56))
+
+	// Allocate again, so that the next allocation starts in the middle of the
+	// heap instead of at the start or the end.
+	println("filled:", fill(36))
+
+	// All chunks are unreachable now, but they are only freed by a collection.
+	big := make([]byte, 40*1024)
+	big[len(big)-1] = 1
+	println("allocated:", len(big))
+}
+
+// Allocate the given number of chunks and keep them all reachable until it
+// returns.
+func fill(n int) int {
+	var list *chunk
+	for i := 0; i < n; i++ {
+		list = &chunk{next: list}
+		list.data[i] = byte(i)
+	}
+	count := 0
+	for c := list; c != nil; c = c.next {
+		count++
+	}
+	return count
+}
@@ -0,0 +1,78 @@
+package main
+
+// This example shows how a panic runs the deferred calls of the functions it
+// unwinds through, and how recover() stops a panic.
+
+func main() {
+	println("result:", divide(10, 2))
+	println("result:", divide(10, 0))
+	nested()
+	indirect()
+	p := steps(5)
+	println("steps done:", p.done, p.total)
+	println("done")
+}
+
+func divide(a, b int) (result int) {
+	defer func() {
+		if err := recover(); err != nil {
+			println("recovered from division by zero")
+			result = -1
+		}
+	}()
+	if b == 0 {
+		panic("division by zero")
+	}
+	return a / b
+}
+
+func nested() {
+	defer func() {
+		println("recovered:", recover() != nil)
+	}()
+	deepPanic(3)
+	println("not reached")
+}
+
+func deepPanic(n int) {
+	defer println("unwinding:", n)
+	if n == 0 {
+		panic("deep panic")
+	}
+	deepPanic(n - 1)
+}
+
+func indirect() {
+	defer func() {
+		// recover() only stops a panic when called directly by the deferred
+		// function.
+		println("recovered indirectly:", tryRecover() != nil)
+		println("recovered directly:", recover() != nil)
+	}()
+	panic("indirect")
+}
+
+type progress struct {
+	done  int
+	total int
+}
+
+func steps(n int) (p progress) {
+	defer func() {
+		recover()
+	}()
+	for i := 0; i < n; i++ {
+		// The fields of the result must be kept up to date in memory, so
+		// that they are returned after the panic.
+		p.done++
+		p.total += i
+		if i == 2 {
+			panic("step failed")
+		}
+	}
+	return
+}
+
+func tryRecover() interface{} {
+	return recover()
+}
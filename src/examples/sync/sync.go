@@ -0,0 +1,76 @@
+package main
+
+// This example uses the sync package of the standard library with goroutines.
+// Goroutines that have to wait (for a locked mutex, a wait group or a
+// condition) are parked by the scheduler until another goroutine wakes them
+// up.
+
+import (
+	"runtime"
+	"sync"
+)
+
+func main() {
+	// Several goroutines increment a counter while holding a lock, and sleep
+	// in between so that the others have to wait for the lock.
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	counter := 0
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			for j := 0; j < 3; j++ {
+				mu.Lock()
+				value := counter
+				runtime.Sleep(runtime.Millisecond)
+				counter = value + 1
+				mu.Unlock()
+			}
+			wg.Done()
+		}()
+	}
+	wg.Wait()
+	println("counter:", counter)
+
+	// Readers can hold a RWMutex at the same time, a writer waits for them.
+	var rw sync.RWMutex
+	rw.RLock()
+	rw.RLock()
+	done := make(chan bool)
+	go func() {
+		rw.Lock()
+		println("writer got the lock")
+		rw.Unlock()
+		done <- true
+	}()
+	runtime.Sleep(runtime.Millisecond)
+	println("readers done")
+	rw.RUnlock()
+	rw.RUnlock()
+	<-done
+
+	// Once only calls the function the first time.
+	var once sync.Once
+	for i := 0; i < 3; i++ {
+		once.Do(func() {
+			println("once")
+		})
+	}
+
+	// Wait for a condition that is signalled by another goroutine.
+	cond := sync.NewCond(&mu)
+	ready := false
+	go func() {
+		runtime.Sleep(runtime.Millisecond)
+		mu.Lock()
+		ready = true
+		mu.Unlock()
+		cond.Broadcast()
+	}()
+	mu.Lock()
+	for !ready {
+		cond.Wait()
+	}
+	mu.Unlock()
+	println("condition is ready")
+}
@@ -2,7 +2,10 @@ package main
 
 // This file is here to test features of the Go compiler.
 
-import "unicode"
+import (
+	"errors"
+	"unicode"
+)
 
 type Thing struct {
 	name string
@@ -28,10 +31,41 @@ type Doubler interface {
 	Double() int
 }
 
+type LinkedList struct {
+	next  *LinkedList
+	value int
+}
+
+// Embeds Thing, so it has the String method of Thing.
+type EmbeddedThing struct {
+	Thing
+	n int
+}
+
+// Embeds a pointer to Number, so it has the Double method of Number.
+type EmbeddedNumber struct {
+	*Number
+}
+
+// A struct with a complex field, for zero values of complex numbers in
+// globals.
+type Point struct {
+	name string
+	pos  complex128
+}
+
 const SIX = 6
 
 var testmap = map[string]int{"data": 3}
 
+var errTimeout = errors.New("timeout")
+
+var (
+	zeroComplex complex128
+	unitComplex = complex64(1i)
+	origin      Point
+)
+
 func main() {
 	println("Hello world from Go!")
 	println("The answer is:", calculateAnswer())
@@ -45,6 +79,10 @@ func main() {
 	m := map[string]int{"answer": 42, "foo": 3}
 	readMap(m, "answer")
 	readMap(testmap, "data")
+	delete(m, "foo")
+	readMap(m, "foo")
+	testMapGrow(50)
+	testMapKeys()
 
 	// slice
 	l := 5
@@ -56,6 +94,32 @@ func main() {
 	println("sum foo:", sum(foo))
 	println("copy foo -> bar:", copy(bar, foo))
 	println("sum bar:", sum(bar))
+	baz := foo[1:3]
+	println("len/cap foo[1:3]:", len(baz), cap(baz))
+	baz = foo[1:2:3]
+	println("len/cap foo[1:2:3]:", len(baz), cap(baz))
+	println("sum foo[2:]:", sum(foo[2:]))
+	foo = append(foo, 6, 7)
+	println("append foo:", len(foo), cap(foo) >= len(foo), sum(foo))
+	buf := append([]byte("foo"), "bar"...)
+	println("append string:", string(buf))
+	arr := [4]int{}
+	ch := make(chan int, 2)
+	ch <- 1
+	println("len/cap array:", len(arr), cap(&arr))
+	println("len/cap chan:", len(ch), cap(ch))
+	var nilMap map[string]int
+	println("len nil map:", len(nilMap), nilMap == nil)
+	var nilPtr *Thing
+	println("nil pointer, slice, interface:", nilPtr, []int(nil), interface{}(nil))
+
+	// complex numbers
+	z := complex64(1 + 2i)
+	println("complex:", z, z*z, z/(1-1i), real(z), imag(z))
+	println("complex128:", complex128(z)+complex(0.5, 0), z == 1+2i)
+	println("complex globals:", zeroComplex, unitComplex, origin.pos, origin.name == "")
+	origin.pos = 3 + 4i
+	println("complex field:", origin.pos, real(origin.pos))
 
 	// interfaces, pointers
 	thing := &Thing{"foo"}
@@ -67,6 +131,9 @@ func main() {
 	printItf(thing)
 	printItf(Stringer(thing))
 	printItf(Number(3))
+	printItf(float32(1.5))
+	testStructs()
+	testInterfaces()
 	s := Stringer(thing)
 	println("Stringer.String():", s.String())
 	var itf interface{} = s
@@ -96,9 +163,30 @@ func testDefer() {
 	defer deferred("...run as defer", i)
 	i += 1
 	defer deferred("...run as defer", i)
+	defer func() {
+		println("...run closure deferred:", i)
+	}()
+	i += 1
+	defer Thing{"foo"}.Print("bar")
+	t := Thing{"baz"}
+	defer printString(t.String)
+	var s Stringer = t
+	defer s.String() // interface method call, result is ignored
+	m := t.Print
+	defer m("qux")
+	f := deferred
+	defer f("...run as defer through function pointer", i)
 	println("deferring...")
 }
 
+func printString(f func() string) {
+	println("...run method value deferred:", f())
+}
+
+func (t Thing) Print(arg string) {
+	println("Thing.Print:", t.name, arg)
+}
+
 func deferred(msg string, i int) {
 	println(msg, i)
 }
@@ -107,11 +195,163 @@ func testBound(f func() string) {
 	println("bound method:", f())
 }
 
+func testStructs() {
+	list := &LinkedList{value: 1, next: &LinkedList{value: 2}}
+	sum := 0
+	for l := list; l != nil; l = l.next {
+		sum += l.value
+	}
+	println("linked list sum:", sum)
+
+	// A recursive type declared inside a function.
+	type tree struct {
+		left, right *tree
+		value       int
+	}
+	t := &tree{value: 2, left: &tree{value: 1}, right: &tree{value: 3}}
+	println("tree:", t.left.value, t.value, t.right.value)
+
+	anonymous := struct {
+		x, y int
+	}{3, 4}
+	println("anonymous struct:", anonymous.x, anonymous.y)
+
+	embedded := EmbeddedThing{Thing{"embedded"}, 5}
+	println("promoted method:", embedded.String(), embedded.n)
+	var s Stringer = embedded
+	println("promoted method through interface:", s.String())
+	s = &embedded
+	println("promoted method through pointer in interface:", s.String())
+	n := Number(21)
+	var d Doubler = EmbeddedNumber{&n}
+	println("promoted method of embedded pointer:", d.Double())
+}
+
+func testInterfaces() {
+	err := timeout(true)
+	println("err == errTimeout:", err == errTimeout, timeout(false) == errTimeout, timeout(false) == nil)
+	foo := "foo"
+	var a, b interface{} = foo + "bar", "foobar"
+	println("interface{} strings equal:", a == b, a == interface{}(foo))
+	a, b = Thing{"foo"}, Thing{foo}
+	println("interface{} structs equal:", a == b, a == interface{}(Number(3)))
+
+	var itf interface{} = Number(3)
+	d, ok := itf.(Doubler)
+	println("interface{} to Doubler:", ok, d.Double())
+	_, ok = itf.(Stringer)
+	println("interface{} to Stringer:", ok)
+	var s Stringer = EmbeddedThing{Thing{"thing"}, 1}
+	_, ok = s.(interface{})
+	println("Stringer to interface{}:", ok)
+	p, ok := s.(interface{ Print(string) })
+	println("Stringer to Printer:", ok)
+	p.Print("promoted")
+	itf = nil
+	_, ok = itf.(interface{})
+	println("nil to interface{}:", ok)
+
+	// Types declared in different functions are different types, even when
+	// they have the same name.
+	a, b = localKeyA(1, nil), localKeyB(1, nil)
+	println("local types equal:", a == b, a == localKeyA(1, nil), b == localKeyB(1, nil))
+	localKeyA(2, b)
+	localKeyB(2, b)
+	keys := map[interface{}]int{a: 1, b: 2}
+	println("local types as map keys:", len(keys), keys[localKeyA(1, nil)], keys[localKeyB(1, nil)])
+}
+
+// Return a value of a local type named key, and print whether other is one as
+// well. See localKeyB for a different type with the same name.
+func localKeyA(n int, other interface{}) interface{} {
+	type key struct {
+		a uint8
+		b string
+	}
+	if other != nil {
+		_, ok := other.(key)
+		println("local type A assert:", ok)
+		m := map[key]int{{1, "one"}: 1}
+		m[key{uint8(n), "n"}] = n
+		println("local map key A:", len(m), m[key{1, "one"}], m[key{uint8(n), "n"}])
+	}
+	return key{uint8(n), "a"}
+}
+
+func localKeyB(n int, other interface{}) interface{} {
+	type key struct {
+		a    int64
+		b, c int32
+	}
+	if other != nil {
+		_, ok := other.(key)
+		println("local type B assert:", ok)
+		m := map[key]int{{1, 2, 3}: 6}
+		m[key{int64(n), 2, 3}] = n + 5
+		println("local map key B:", len(m), m[key{1, 2, 3}], m[key{int64(n), 2, 3}])
+	}
+	return key{int64(n), 2, 3}
+}
+
+func timeout(fail bool) error {
+	if fail {
+		return errTimeout
+	}
+	return nil
+}
+
 func readMap(m map[string]int, key string) {
 	println("map length:", len(m))
 	println("map read:", key, "=", m[key])
 }
 
+func testMapGrow(n int) {
+	m := make(map[int]int)
+	for i := 0; i < n; i++ {
+		m[i] = i * 2
+	}
+	for i := 0; i < n; i += 2 {
+		delete(m, i)
+	}
+	keys, values := 0, 0
+	for k, v := range m {
+		keys += k
+		values += v
+	}
+	println("map grow:", len(m), keys, values)
+}
+
+type register struct {
+	addr uint8
+	reg  uint8
+}
+
+func testMapKeys() {
+	registers := map[register]string{}
+	registers[register{0x68, 0x3b}] = "accel"
+	registers[register{0x68, 0x43}] = "gyro"
+	println("map struct key:", registers[register{0x68, 0x43}])
+
+	floats := map[float64]int{}
+	zero := 0.0
+	floats[zero] = 1
+	floats[-zero] = 2
+	println("map float key:", len(floats), floats[0])
+
+	itfs := map[interface{}]int{}
+	itfs[5] = 1
+	itfs["foo"] = 2
+	itfs[uint8(5)] = 3
+	println("map interface key:", len(itfs), itfs[5], itfs["foo"], itfs[uint8(5)])
+
+	if value, ok := registers[register{0x68, 0x3b}]; ok {
+		println("map comma-ok:", value)
+	}
+	if _, ok := registers[register{0x68, 0x00}]; !ok {
+		println("map comma-ok: not found")
+	}
+}
+
 func hello(n int) {
 	println("hello from function pointer:", n)
 }
@@ -130,6 +370,8 @@ func printItf(val interface{}) {
 		println("is byte:", val)
 	case string:
 		println("is string:", val)
+	case float32:
+		println("is float32:", val)
 	case Thing:
 		println("is Thing:", val.String())
 	case *Thing:
@@ -0,0 +1,40 @@
+package main
+
+// This example uses the time package of the standard library: sleeping,
+// measuring elapsed time, timers and tickers. Timers are fired by the
+// scheduler, which sends the current time on the timer channel, so they can be
+// waited on like any other channel.
+
+import "time"
+
+func main() {
+	start := time.Now()
+	time.Sleep(10 * time.Millisecond)
+	println("slept at least 10ms:", time.Since(start) >= 10*time.Millisecond)
+
+	<-time.After(20 * time.Millisecond)
+	println("waited at least 30ms:", time.Since(start) >= 30*time.Millisecond)
+
+	ticker := time.NewTicker(5 * time.Millisecond)
+	for i := 1; i <= 3; i++ {
+		<-ticker.C
+		println("tick", i)
+	}
+	ticker.Stop()
+
+	timer := time.NewTimer(time.Hour)
+	println("stopped timer:", timer.Stop())
+
+	done := make(chan bool)
+	time.AfterFunc(time.Millisecond, func() {
+		done <- true
+	})
+	println("AfterFunc called:", <-done)
+
+	select {
+	case <-make(chan int):
+		println("unexpected receive")
+	case <-time.After(time.Millisecond):
+		println("timeout")
+	}
+}
@@ -15,3 +15,9 @@ func (p GPIO) High() {
 func (p GPIO) Low() {
 	p.Set(false)
 }
+
+// Implemented in the runtime. Interrupt handlers call wakeScheduler after an
+// event that a goroutine may be waiting for in waitForInterrupt. See the
+// runtime for what interrupt handlers may and may not do.
+func wakeScheduler()
+func waitForInterrupt()
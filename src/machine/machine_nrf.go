@@ -3,6 +3,7 @@
 package machine
 
 import (
+	"device/arm"
 	"device/nrf"
 )
 
@@ -39,3 +40,67 @@ func (p GPIO) Set(high bool) {
 		nrf.P0.OUTCLR = 1 << p.Pin
 	}
 }
+
+// PinChange is a change of a pin input that a goroutine can wait for, see
+// WaitForChange.
+type PinChange uint8
+
+const (
+	PinRising  PinChange = nrf.GPIOTE_CONFIG_POLARITY_LoToHi
+	PinFalling PinChange = nrf.GPIOTE_CONFIG_POLARITY_HiToLo
+	PinToggle  PinChange = nrf.GPIOTE_CONFIG_POLARITY_Toggle
+)
+
+var (
+	gpioteChannels uint8        // GPIOTE channels in use by WaitForChange
+	gpioteEvents   nrf.RegValue // channels that had an event, set in GPIOTE_IRQHandler
+)
+
+// WaitForChange waits until the pin input changes in the given way. Only the
+// calling goroutine waits, other goroutines keep running in the mean time. Up
+// to 8 goroutines can wait for a pin change at the same time.
+func (p GPIO) WaitForChange(change PinChange) {
+	channel := uint8(0)
+	for gpioteChannels&(1<<channel) != 0 {
+		channel++
+		if channel == 8 {
+			panic("machine: too many goroutines waiting for a pin change")
+		}
+	}
+	gpioteChannels |= 1 << channel
+	mask := nrf.RegValue(1) << channel
+
+	nrf.GPIOTE.CONFIG[channel] = nrf.GPIOTE_CONFIG_MODE_Event<<nrf.GPIOTE_CONFIG_MODE_Pos |
+		nrf.RegValue(p.Pin)<<nrf.GPIOTE_CONFIG_PSEL_Pos |
+		nrf.RegValue(change)<<nrf.GPIOTE_CONFIG_POLARITY_Pos
+	nrf.GPIOTE.EVENTS_IN[channel] = 0
+	nrf.GPIOTE.INTENSET = mask
+	arm.EnableIRQ(nrf.IRQ_GPIOTE)
+
+	// The scheduler wakes up all goroutines waiting for an interrupt, so check
+	// whether it was this one.
+	for gpioteEvents&mask == 0 {
+		waitForInterrupt()
+	}
+
+	// Disable the interrupt before clearing the event bit, so that it can't be
+	// set again afterwards. Other bits may still be set by the interrupt
+	// handler, so clear it with interrupts disabled.
+	nrf.GPIOTE.INTENCLR = mask
+	arm.Asm("cpsid i")
+	gpioteEvents &^= mask
+	arm.Asm("cpsie i")
+	nrf.GPIOTE.CONFIG[channel] = 0
+	gpioteChannels &^= 1 << channel
+}
+
+//go:export GPIOTE_IRQHandler
+func GPIOTE_IRQHandler() {
+	for channel := uint8(0); channel < 8; channel++ {
+		if nrf.GPIOTE.EVENTS_IN[channel] != 0 {
+			nrf.GPIOTE.EVENTS_IN[channel] = 0
+			gpioteEvents |= 1 << channel
+		}
+	}
+	wakeScheduler()
+}
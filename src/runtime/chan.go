@@ -1,8 +1,504 @@
 package runtime
 
-// This file implements the 'chan' type and send/receive/select operations.
+// This file implements the 'chan' type and send/receive/close operations.
+//
+// A channel consists of a ring buffer (of size zero for unbuffered channels)
+// and a list of goroutines that are blocked on the channel. Goroutines only
+// need to wait when the buffer is full (senders) or empty (receivers), so this
+// list contains either only senders or only receivers, as indicated by the
+// channel state.
+//
+// Blocking operations are implemented together with the compiler. The compiler
+// emits a call to chanSend or chanRecv followed by a suspend of the current
+// coroutine. When the operation could be completed directly the task is still
+// runnable and will simply be put at the back of the run queue. Otherwise, the
+// task is parked (TASK_STATE_CHAN) in the list of blocked goroutines of the
+// channel and will be re-activated by the goroutine that completes the
+// operation.
+//
+// A select statement that cannot proceed parks the goroutine on all channels
+// involved at once. The first channel that becomes ready wakes the goroutine
+// and removes it from the other channels.
 
-// dummy
+import (
+	"unsafe"
+)
 
 type channel struct {
+	elementSize uintptr
+	bufSize     uintptr        // number of values that fit in the buffer
+	bufUsed     uintptr        // number of values currently in the buffer
+	bufHead     uintptr        // index of the oldest value in the buffer
+	buf         unsafe.Pointer // ring buffer with room for bufSize values
+	state       uint8
+	blocked     *channelBlockedList
+}
+
+// Various states a channel can be in.
+const (
+	chanStateEmpty  = iota // no goroutines are blocked on this channel
+	chanStateSend          // there are blocked senders
+	chanStateRecv          // there are blocked receivers
+	chanStateClosed        // the channel has been closed
+)
+
+// A node in the linked list of goroutines blocked on a channel. It is
+// allocated (but not initialized) by the compiler in the frame of the blocked
+// coroutine, so it stays valid for as long as the goroutine is parked.
+type channelBlockedList struct {
+	next  *channelBlockedList
+	t     *coroutine
+	value unsafe.Pointer // value to send, or buffer to receive into
+
+	// Only set for select statements: the state of this case and the list
+	// nodes of all cases, so that they can be removed from their channels once
+	// one of them completes.
+	s            *chanSelectState
+	allSelectOps []channelBlockedList
+}
+
+// One case of a select statement, as emitted by the compiler.
+type chanSelectState struct {
+	ch    *channel
+	value unsafe.Pointer // value to send, or buffer to receive into
+	send  bool
+}
+
+// Create a new channel with the given element size and buffer size.
+//
+// This is a compiler intrinsic.
+func chanMake(elementSize uintptr, bufSize uintptr) *channel {
+	ch := &channel{
+		elementSize: elementSize,
+		bufSize:     bufSize,
+	}
+	if bufSize != 0 {
+		ch.buf = alloc(elementSize * bufSize)
+	}
+	return ch
+}
+
+// Send a value over a channel. The value is copied from the value pointer.
+// When the value cannot be sent directly, the sender is parked until a
+// receiver takes the value or the channel is closed. Coroutines must call
+// chanSendResult after they resume, to find out which of the two happened.
+//
+// This is a compiler intrinsic.
+func chanSend(sender *coroutine, ch *channel, value unsafe.Pointer, blocked *channelBlockedList) {
+	if ch == nil {
+		// A nil channel blocks forever.
+		chanBlockForever(sender)
+		return
+	}
+	if ch.state == chanStateClosed {
+		runtimePanic("send on closed channel")
+	}
+
+	if ch.state == chanStateRecv {
+		// There is a receiver waiting for a value (which implies the buffer is
+		// empty). Hand it over directly.
+		receiver := ch.popBlocked()
+		memcpy(receiver.value, value, ch.elementSize)
+		receiver.wakeUp(true)
+		chanSetResult(sender, true)
+		return
+	}
+
+	if ch.bufUsed < ch.bufSize {
+		// There is room in the buffer.
+		index := (ch.bufHead + ch.bufUsed) % ch.bufSize
+		memcpy(ch.bufPtr(index), value, ch.elementSize)
+		ch.bufUsed++
+		chanSetResult(sender, true)
+		return
+	}
+
+	// Nobody is ready to take the value, so wait until a receiver arrives.
+	if sender == nil {
+		deadlock()
+	}
+	*blocked = channelBlockedList{
+		t:     sender,
+		value: value,
+	}
+	ch.pushBlocked(blocked)
+	ch.state = chanStateSend
+	sender.promise().state = TASK_STATE_CHAN
+}
+
+// Check the result of the last send operation of this coroutine, after it
+// resumes. A sender that was parked when the channel was closed panics here,
+// like in gc.
+//
+// The value and the list node that were passed to chanSend are cleared, as the
+// channel doesn't refer to them anymore. This also means that the compiler
+// keeps them alive in the coroutine frame while the coroutine is parked.
+//
+// This is a compiler intrinsic.
+func chanSendResult(t *coroutine, ch *channel, value unsafe.Pointer, blocked *channelBlockedList) {
+	if ch != nil {
+		memzero(value, ch.elementSize)
+	}
+	*blocked = channelBlockedList{}
+	if t.promise().data == 0 {
+		runtimePanic("send on closed channel")
+	}
+}
+
+// Receive a value from a channel and store it in the value pointer. When no
+// value is available, the receiver is parked until a sender arrives.
+//
+// The return value indicates whether a value was received (as opposed to the
+// zero value of a closed channel). Coroutines will find the same result in
+// their task state after they resume, see chanRecvResult.
+//
+// This is a compiler intrinsic.
+func chanRecv(receiver *coroutine, ch *channel, value unsafe.Pointer, blocked *channelBlockedList) bool {
+	if ch == nil {
+		// A nil channel blocks forever.
+		chanBlockForever(receiver)
+		return false
+	}
+
+	if ch.bufUsed != 0 {
+		// Take the oldest value from the buffer.
+		memcpy(value, ch.bufPtr(ch.bufHead), ch.elementSize)
+		ch.bufHead = (ch.bufHead + 1) % ch.bufSize
+		ch.bufUsed--
+		if ch.state == chanStateSend {
+			// Now that there is room in the buffer, move the value of the
+			// first blocked sender into it.
+			sender := ch.popBlocked()
+			index := (ch.bufHead + ch.bufUsed) % ch.bufSize
+			memcpy(ch.bufPtr(index), sender.value, ch.elementSize)
+			ch.bufUsed++
+			sender.wakeUp(true)
+		}
+		chanSetResult(receiver, true)
+		return true
+	}
+
+	if ch.state == chanStateSend {
+		// Unbuffered channel (or a buffered channel with a zero-sized buffer)
+		// with a waiting sender. Take the value directly from the sender.
+		sender := ch.popBlocked()
+		memcpy(value, sender.value, ch.elementSize)
+		sender.wakeUp(true)
+		chanSetResult(receiver, true)
+		return true
+	}
+
+	if ch.state == chanStateClosed {
+		// Closed channels always return the zero value.
+		memzero(value, ch.elementSize)
+		chanSetResult(receiver, false)
+		return false
+	}
+
+	// No value available, so wait until a sender arrives.
+	if receiver == nil {
+		deadlock()
+	}
+	*blocked = channelBlockedList{
+		t:     receiver,
+		value: value,
+	}
+	ch.pushBlocked(blocked)
+	ch.state = chanStateRecv
+	receiver.promise().state = TASK_STATE_CHAN
+	return false
+}
+
+// Return the result of the last receive operation of this coroutine: whether
+// a value was received. The list node is cleared, like in chanSendResult.
+//
+// This is a compiler intrinsic.
+func chanRecvResult(t *coroutine, blocked *channelBlockedList) bool {
+	*blocked = channelBlockedList{}
+	return t.promise().data != 0
+}
+
+// Return the number of values queued in the channel buffer, for len(ch). A nil
+// channel has length 0.
+//
+// This is a compiler intrinsic.
+func chanLen(ch *channel) int {
+	if ch == nil {
+		return 0
+	}
+	return int(ch.bufUsed)
+}
+
+// Return the size of the channel buffer, for cap(ch). A nil channel has
+// capacity 0.
+//
+// This is a compiler intrinsic.
+func chanCap(ch *channel) int {
+	if ch == nil {
+		return 0
+	}
+	return int(ch.bufSize)
+}
+
+// Close the channel. All blocked receivers are woken up and receive the zero
+// value. All blocked senders are woken up as well, and panic once they resume.
+//
+// This is a compiler intrinsic.
+func chanClose(ch *channel) {
+	if ch == nil {
+		runtimePanic("close of nil channel")
+	}
+	switch ch.state {
+	case chanStateClosed:
+		runtimePanic("close of closed channel")
+	case chanStateSend:
+		for ch.blocked != nil {
+			sender := ch.popBlocked()
+			sender.wakeUp(false)
+		}
+	case chanStateRecv:
+		for ch.blocked != nil {
+			receiver := ch.popBlocked()
+			memzero(receiver.value, ch.elementSize)
+			receiver.wakeUp(false)
+		}
+	}
+	ch.state = chanStateClosed
+}
+
+// State of the xorshift pseudo-random number generator used by select. It must
+// never become zero.
+var selectRandomState uint32 = 1
+
+// Return a pseudo-random number, to pick a select case.
+func selectRandom() uint32 {
+	x := selectRandomState
+	x ^= x << 13
+	x ^= x >> 17
+	x ^= x << 5
+	selectRandomState = x
+	return x
+}
+
+// Run a select statement. A case that can proceed is executed and its index is
+// returned, together with whether a value was received for receive cases. Like
+// gc, the cases are tried starting at a pseudo-random one, so that a case that
+// is always ready does not starve the others. When no case is ready, either -1
+// is returned (for selects with a default case) or the goroutine is parked on
+// all channels until one of them becomes ready.
+//
+// As with chanRecv, coroutines will find the result in their task state after
+// they resume, see chanSelectResult.
+//
+// This is a compiler intrinsic.
+func chanSelect(t *coroutine, states []chanSelectState, blocked []channelBlockedList, blocking bool) (int, bool) {
+	var start int
+	if len(states) > 1 {
+		start = int(selectRandom() % uint32(len(states)))
+	}
+	for n := range states {
+		i := start + n
+		if i >= len(states) {
+			i -= len(states)
+		}
+		s := &states[i]
+		if !s.ready() {
+			continue
+		}
+		ok := true
+		if s.send {
+			chanSend(nil, s.ch, s.value, nil)
+		} else {
+			ok = chanRecv(nil, s.ch, s.value, nil)
+		}
+		chanSetSelectResult(t, i, ok)
+		return i, ok
+	}
+
+	if !blocking {
+		// Take the default case.
+		return -1, false
+	}
+
+	// None of the channels are ready, so wait for the first one that is.
+	if t == nil {
+		deadlock()
+	}
+	for i := range states {
+		s := &states[i]
+		// The list nodes are not initialized by the compiler.
+		blocked[i] = channelBlockedList{}
+		if s.ch == nil {
+			// Operations on a nil channel never proceed.
+			continue
+		}
+		state := uint8(chanStateRecv)
+		if s.send {
+			state = chanStateSend
+		}
+		if s.ch.state != chanStateEmpty && s.ch.state != state {
+			// Both a send and a receive case on the same channel. Only
+			// goroutines other than this one can complete these operations,
+			// so register only the first of the two.
+			continue
+		}
+		b := &blocked[i]
+		*b = channelBlockedList{
+			t:            t,
+			value:        s.value,
+			s:            s,
+			allSelectOps: blocked,
+		}
+		s.ch.pushBlocked(b)
+		s.ch.state = state
+	}
+	// Also park the goroutine when there are no cases at all (select {}): it
+	// will simply never be woken up.
+	t.promise().state = TASK_STATE_CHAN
+	return 0, false
+}
+
+// Return the result of the last select statement of this coroutine: the index
+// of the case that was executed and whether a value was received. When the
+// case was a send on a channel that has been closed in the meantime, this
+// panics like chanSendResult.
+//
+// The values to send and the list nodes are cleared, like in chanSendResult.
+//
+// This is a compiler intrinsic.
+func chanSelectResult(t *coroutine, states []chanSelectState, blocked []channelBlockedList) (int, bool) {
+	for i := range states {
+		s := &states[i]
+		if s.send && s.ch != nil {
+			memzero(s.value, s.ch.elementSize)
+		}
+		blocked[i] = channelBlockedList{}
+	}
+	data := t.promise().data
+	index := int(data >> 1)
+	ok := data&1 != 0
+	if states[index].send && !ok {
+		runtimePanic("send on closed channel")
+	}
+	return index, ok
+}
+
+// Whether this select case can proceed without blocking.
+func (s *chanSelectState) ready() bool {
+	ch := s.ch
+	if ch == nil {
+		return false
+	}
+	if s.send {
+		// Sending on a closed channel panics, which also doesn't block.
+		return ch.state == chanStateRecv || ch.state == chanStateClosed || ch.bufUsed < ch.bufSize
+	}
+	return ch.bufUsed != 0 || ch.state == chanStateSend || ch.state == chanStateClosed
+}
+
+// Return a pointer to the value with the given index in the ring buffer.
+func (ch *channel) bufPtr(index uintptr) unsafe.Pointer {
+	return unsafe.Pointer(uintptr(ch.buf) + index*ch.elementSize)
+}
+
+// Add a blocked goroutine to the end of the list, so that goroutines are
+// unblocked in the order they arrived.
+func (ch *channel) pushBlocked(blocked *channelBlockedList) {
+	blocked.next = nil
+	if ch.blocked == nil {
+		ch.blocked = blocked
+		return
+	}
+	last := ch.blocked
+	for last.next != nil {
+		last = last.next
+	}
+	last.next = blocked
+}
+
+// Remove the first blocked goroutine from the list and return it. The channel
+// state is reset when no goroutines remain.
+func (ch *channel) popBlocked() *channelBlockedList {
+	blocked := ch.blocked
+	ch.blocked = blocked.next
+	blocked.next = nil
+	if ch.blocked == nil {
+		ch.state = chanStateEmpty
+	}
+	return blocked
+}
+
+// Remove the given node from the list of blocked goroutines, if it is present.
+// The channel state is reset when no goroutines remain.
+func (ch *channel) removeBlocked(blocked *channelBlockedList) {
+	for ptr := &ch.blocked; *ptr != nil; ptr = &(*ptr).next {
+		if *ptr == blocked {
+			*ptr = blocked.next
+			blocked.next = nil
+			break
+		}
+	}
+	if ch.blocked == nil && ch.state != chanStateClosed {
+		ch.state = chanStateEmpty
+	}
+}
+
+// Make the goroutine of this (already removed) list node runnable again, after
+// its channel operation has completed. When the operation was part of a select
+// statement, the goroutine is also removed from all other channels it was
+// waiting on.
+func (b *channelBlockedList) wakeUp(ok bool) {
+	if b.allSelectOps == nil {
+		chanSetResult(b.t, ok)
+	} else {
+		index := 0
+		for i := range b.allSelectOps {
+			op := &b.allSelectOps[i]
+			if op == b {
+				index = i
+				continue
+			}
+			if op.s != nil && op.s.ch != nil {
+				op.s.ch.removeBlocked(op)
+			}
+		}
+		chanSetSelectResult(b.t, index, ok)
+	}
+	activateTask(b.t)
+}
+
+// Store the result of a receive operation in the task state, for when the
+// coroutine resumes.
+func chanSetResult(t *coroutine, ok bool) {
+	if t == nil {
+		return
+	}
+	if ok {
+		t.promise().data = 1
+	} else {
+		t.promise().data = 0
+	}
+}
+
+// Store the result of a select statement in the task state, for when the
+// coroutine resumes: the index of the selected case and whether a value was
+// received.
+func chanSetSelectResult(t *coroutine, index int, ok bool) {
+	if t == nil {
+		return
+	}
+	data := uint32(index) << 1
+	if ok {
+		data |= 1
+	}
+	t.promise().data = data
+}
+
+// Park the current goroutine without a way to wake it up again. Used for
+// operations on a nil channel.
+func chanBlockForever(t *coroutine) {
+	if t == nil {
+		deadlock()
+	}
+	t.promise().state = TASK_STATE_CHAN
 }
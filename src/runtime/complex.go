@@ -0,0 +1,31 @@
+package runtime
+
+// This file implements complex number operations that are too big to be
+// emitted inline by the compiler.
+
+// Divide two complex numbers, using the algorithm by Robert L. Smith (Algorithm
+// 116: Complex division. Commun. ACM 5(8): 435 (1962)) which avoids overflow in
+// intermediate results. Division of complex64 numbers also uses this function.
+// This is a compiler intrinsic.
+func complex128div(n, m complex128) complex128 {
+	var e, f float64 // complex(e, f) = n/m
+	if abs(real(m)) >= abs(imag(m)) {
+		ratio := imag(m) / real(m)
+		denom := real(m) + ratio*imag(m)
+		e = (real(n) + imag(n)*ratio) / denom
+		f = (imag(n) - real(n)*ratio) / denom
+	} else {
+		ratio := real(m) / imag(m)
+		denom := imag(m) + ratio*real(m)
+		e = (real(n)*ratio + imag(n)) / denom
+		f = (imag(n)*ratio - real(n)) / denom
+	}
+	return complex(e, f)
+}
+
+func abs(x float64) float64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
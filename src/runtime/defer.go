@@ -9,9 +9,13 @@ type _defer struct {
 	next     *_defer
 }
 
-func rundefers(stack *_defer) {
-	for stack != nil {
-		stack.callback(stack)
-		stack = stack.next
+// Run all deferred calls in the list. Each call is removed from the list
+// before it runs, so that a panic in a deferred call continues with the
+// remaining calls.
+func rundefers(stack **_defer) {
+	for *stack != nil {
+		d := *stack
+		*stack = d.next
+		d.callback(d)
 	}
 }
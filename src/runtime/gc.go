@@ -1,42 +1,459 @@
-// +build !linux
-
 package runtime
 
+// This memory manager is a textbook mark/sweep implementation. It is
+// conservative: every word in the globals, on the stack and in heap objects
+// that looks like a pointer into the heap is treated as one.
+//
+// The heap is divided in blocks of a fixed size. Every block has a 2-bit state
+// stored in a metadata area at the start of the heap, that indicates whether
+// the block is free, the start of an object (the head), part of an object (a
+// tail), or a head that has been marked as reachable during a collection.
+//
+// Coroutine frames are regular heap objects: they are reachable from the run
+// queue, the sleep queue, from channels or from their parent coroutine, so
+// they do not need any special treatment.
+//
+// The location of the heap, the globals and the top of the stack are provided
+// by the target: see gc_baremetal.go and runtime_unix.go.
+
 import (
 	"unsafe"
 )
 
+const gcDebug = false
+
+// Size of a block in bytes: 4 pointers. Objects are rounded up to a multiple
+// of this size.
+const bytesPerBlock = 4 * unsafe.Sizeof(heapStart)
+
+// Number of states (of 2 bits) that fit in a byte of metadata.
+const blocksPerStateByte = 4
+
+// Various states a block can be in.
+const (
+	blockStateFree = iota // the block is not in use
+	blockStateHead        // the first block of an object
+	blockStateTail        // a block following a head or another tail
+	blockStateMark        // a head that has been marked as reachable
+)
+
+// Number of blocks that can be marked before the mark phase falls back to
+// rescanning the heap. It limits the stack usage of the mark phase.
+const markStackSize = 8
+
+var (
+	poolStart         uintptr // start of the first block, after the metadata
+	endBlock          gcBlock // the block just past the end of the heap
+	nextAlloc         gcBlock // the block where the allocator continues
+	markStackOverflow bool    // the mark stack was full during the mark phase
+)
+
+// A finalizer set with SetFinalizer. The object pointer is stored inverted, so
+// that the finalizer list itself doesn't keep the object alive.
+type finalizer struct {
+	next    *finalizer
+	obj     uintptr        // ^uintptr(obj)
+	fn      unsafe.Pointer // function pointer to call with obj
+	context unsafe.Pointer // context of fn, if it is a closure
+}
+
 var (
-	_extern__heap_start unsafe.Pointer // defined by the linker
-	heapptr             = uintptr(unsafe.Pointer(&_extern__heap_start))
+	finalizers        *finalizer // objects with a finalizer
+	readyFinalizers   *finalizer // objects that became unreachable, not yet finalized
+	runningFinalizers bool       // runFinalizers is running
 )
 
+// Stores the last value passed to KeepAlive, see there.
+var keepAliveSink interface{}
+
+// Returned for zero-sized allocations, which do not need a unique address.
+var zeroSizedAlloc uint8
+
+// Provide some abstraction over heap blocks.
+type gcBlock uintptr
+
+// Return the block that contains the given address.
+func blockFromAddr(addr uintptr) gcBlock {
+	return gcBlock((addr - poolStart) / bytesPerBlock)
+}
+
+// Return the address of the start of the block.
+func (b gcBlock) address() uintptr {
+	return poolStart + uintptr(b)*bytesPerBlock
+}
+
+// Return the head of the object this block is part of.
+func (b gcBlock) findHead() gcBlock {
+	for b.state() == blockStateTail {
+		b--
+	}
+	return b
+}
+
+// Return the block just past the end of the object starting at this block.
+func (b gcBlock) findNext() gcBlock {
+	if b.state() == blockStateHead || b.state() == blockStateMark {
+		b++
+	}
+	for b != endBlock && b.state() == blockStateTail {
+		b++
+	}
+	return b
+}
+
+// Return a pointer to the metadata byte of this block and the shift of its
+// state within that byte.
+func (b gcBlock) stateByte() (*uint8, uint8) {
+	ptr := (*uint8)(unsafe.Pointer(heapStart + uintptr(b)/blocksPerStateByte))
+	shift := uint8(b%blocksPerStateByte) * 2
+	return ptr, shift
+}
+
+// Return the state of this block.
+func (b gcBlock) state() uint8 {
+	ptr, shift := b.stateByte()
+	return (*ptr >> shift) & 3
+}
+
+// Change the state of this block.
+func (b gcBlock) setState(state uint8) {
+	ptr, shift := b.stateByte()
+	*ptr = *ptr&^(3<<shift) | state<<shift
+}
+
+// Set up the heap metadata on first use: the metadata area at the start of
+// the heap is followed by the blocks it describes.
+func initHeap() {
+	if poolStart != 0 {
+		return
+	}
+	initHeapRegion()
+	// Every block needs bytesPerBlock bytes of memory and a quarter byte of
+	// metadata.
+	numBlocks := (heapEnd - heapStart) * blocksPerStateByte / (bytesPerBlock*blocksPerStateByte + 1)
+	metadataSize := (numBlocks + blocksPerStateByte - 1) / blocksPerStateByte
+	memzero(unsafe.Pointer(heapStart), metadataSize)
+	poolStart = (heapStart + metadataSize + (bytesPerBlock - 1)) &^ (bytesPerBlock - 1)
+	endBlock = gcBlock((heapEnd - poolStart) / bytesPerBlock)
+	if uintptr(endBlock) > numBlocks {
+		// Aligning poolStart may leave room for more blocks than there is
+		// metadata for. Don't use those.
+		endBlock = gcBlock(numBlocks)
+	}
+	if endBlock.address() > heapEnd || (uintptr(endBlock)+blocksPerStateByte-1)/blocksPerStateByte > metadataSize {
+		runtimeFatal("heap layout is inconsistent")
+	}
+	if gcDebug {
+		println("heap blocks:", uint(endBlock), "block size:", uint(bytesPerBlock))
+	}
+}
+
+// Allocate a zeroed object of the given size on the heap. A collection is run
+// when no free space is found, and the program exits with a fatal error when
+// there still isn't enough space afterwards.
 func alloc(size uintptr) unsafe.Pointer {
-	// TODO: this can be optimized by not casting between pointers and ints so
-	// much. And by using platform-native data types (e.g. *uint8 for 8-bit
-	// systems).
-	size = align(size)
-	addr := heapptr
-	heapptr += size
-	for i := uintptr(0); i < uintptr(size); i += 4 {
-		ptr := (*uint32)(unsafe.Pointer(addr + i))
-		*ptr = 0
+	if size == 0 {
+		return unsafe.Pointer(&zeroSizedAlloc)
+	}
+	initHeap()
+
+	neededBlocks := (size + (bytesPerBlock - 1)) / bytesPerBlock
+
+	// Look for a run of free blocks that is big enough, starting at the last
+	// allocation. Wrap around at the end of the heap.
+	index := nextAlloc
+	numFreeBlocks := uintptr(0)
+	heapScanCount := uint8(0)
+	for {
+		if index == nextAlloc && heapScanCount < 2 {
+			if heapScanCount == 0 {
+				heapScanCount = 1
+			} else {
+				// The whole heap has been searched without success. Free
+				// some memory and try again. The finalizers of objects that
+				// were freed are only run once this allocation is done.
+				collect()
+				heapScanCount = 2
+				// Search the whole heap from the start this time, without
+				// wrapping around, so that a run of free blocks that
+				// contains nextAlloc isn't split in two.
+				index = 0
+				nextAlloc = 0
+				numFreeBlocks = 0
+			}
+		}
+		if index == endBlock {
+			if heapScanCount == 2 {
+				runtimeFatal("out of memory")
+			}
+			// Objects cannot wrap around the end of the heap.
+			index = 0
+			numFreeBlocks = 0
+			continue
+		}
+		if index.state() != blockStateFree {
+			numFreeBlocks = 0
+			index++
+			continue
+		}
+		numFreeBlocks++
+		index++
+		if numFreeBlocks == neededBlocks {
+			thisAlloc := index - gcBlock(neededBlocks)
+			nextAlloc = index
+			if nextAlloc == endBlock {
+				nextAlloc = 0
+			}
+			thisAlloc.setState(blockStateHead)
+			for i := thisAlloc + 1; i != index; i++ {
+				i.setState(blockStateTail)
+			}
+			ptr := unsafe.Pointer(thisAlloc.address())
+			memzero(ptr, size)
+			if readyFinalizers != nil {
+				runFinalizers()
+			}
+			return ptr
+		}
 	}
-	return unsafe.Pointer(addr)
 }
 
+// Free the object at the given address. The object must not be used anymore
+// afterwards.
 func free(ptr unsafe.Pointer) {
-	// TODO: use a GC
+	addr := uintptr(ptr)
+	if !looksLikePointer(addr) {
+		return // not a heap object, e.g. a zero-sized allocation
+	}
+	block := blockFromAddr(addr).findHead()
+	next := block.findNext()
+	for ; block != next; block++ {
+		block.setState(blockStateFree)
+	}
 }
 
+// Run a garbage collection cycle: mark everything reachable from the globals
+// and the stack and free everything else. Finalizers of objects that became
+// unreachable are run afterwards.
 func GC() {
-	// Unimplemented.
+	collect()
+	runFinalizers()
+}
+
+// Run a garbage collection cycle without running finalizers. Objects with a
+// finalizer that became unreachable are kept alive and added to
+// readyFinalizers, see runFinalizers.
+func collect() {
+	if poolStart == 0 {
+		return // nothing allocated yet
+	}
+	if gcDebug {
+		println("running collection cycle...")
+	}
+
+	// Mark phase.
+	markRoots(globalsStart, globalsEnd)
+	markStack()
+	finishMark()
+
+	// Objects with a finalizer that are unreachable now must stay alive until
+	// their finalizer has run, together with everything they reference. This
+	// includes objects from an earlier cycle whose finalizer hasn't run yet.
+	for f := readyFinalizers; f != nil; f = f.next {
+		markRoot(^f.obj)
+	}
+	for ptr := &finalizers; *ptr != nil; {
+		f := *ptr
+		block := blockFromAddr(^f.obj).findHead()
+		if block.state() == blockStateMark {
+			ptr = &f.next
+			continue
+		}
+		*ptr = f.next
+		f.next = readyFinalizers
+		readyFinalizers = f
+		markRoot(^f.obj)
+	}
+	finishMark()
+
+	// Sweep phase.
+	sweep()
+}
+
+// Run the finalizers of objects that were found to be unreachable. This is
+// not done in the middle of an allocation (when the heap is in an intermediate
+// state), nor recursively when a finalizer allocates memory.
+func runFinalizers() {
+	if runningFinalizers {
+		return
+	}
+	runningFinalizers = true
+	// Finalizers may allocate memory and thus cause another GC cycle, so
+	// remove them from the list before running them.
+	for readyFinalizers != nil {
+		f := readyFinalizers
+		readyFinalizers = f.next
+		callFinalizer(f.fn, unsafe.Pointer(^f.obj), f.context)
+	}
+	runningFinalizers = false
+}
+
+// Finish the mark phase after the roots have been marked.
+func finishMark() {
+	for markStackOverflow {
+		// Some objects were marked without scanning their contents. Scan all
+		// marked objects again until everything reachable has been marked.
+		markStackOverflow = false
+		for block := gcBlock(0); block != endBlock; block++ {
+			if block.state() == blockStateMark {
+				markFrom(block)
+			}
+		}
+	}
+}
+
+// Whether the given word could be a pointer into the heap.
+func looksLikePointer(ptr uintptr) bool {
+	return ptr >= poolStart && ptr < heapEnd && blockFromAddr(ptr) < endBlock
+}
+
+// Mark all objects referenced from the given memory area.
+func markRoots(start, end uintptr) {
+	for addr := start; addr+unsafe.Sizeof(addr) <= end; addr += unsafe.Alignof(addr) {
+		root := *(*uintptr)(unsafe.Pointer(addr))
+		markRoot(root)
+	}
 }
 
+// Mark the object the given word points to (if it is a pointer into the heap)
+// and everything reachable from it.
+func markRoot(root uintptr) {
+	if !looksLikePointer(root) {
+		return
+	}
+	block := blockFromAddr(root).findHead()
+	if block.state() == blockStateFree || block.state() == blockStateMark {
+		return
+	}
+	block.setState(blockStateMark)
+	markFrom(block)
+}
+
+// Scan the (already marked) object starting at the given block for pointers to
+// other objects and mark those recursively. A small stack is used to avoid
+// deep recursion: when it is full, markStackOverflow is set so that GC will
+// rescan the heap.
+func markFrom(root gcBlock) {
+	var stack [markStackSize]gcBlock
+	stack[0] = root
+	stackLen := 1
+	for stackLen != 0 {
+		stackLen--
+		block := stack[stackLen]
+		start := block.address()
+		end := block.findNext().address()
+		for addr := start; addr+unsafe.Sizeof(addr) <= end; addr += unsafe.Alignof(addr) {
+			word := *(*uintptr)(unsafe.Pointer(addr))
+			if !looksLikePointer(word) {
+				continue
+			}
+			referenced := blockFromAddr(word).findHead()
+			if referenced.state() == blockStateFree || referenced.state() == blockStateMark {
+				continue
+			}
+			referenced.setState(blockStateMark)
+			if stackLen == len(stack) {
+				markStackOverflow = true
+				continue
+			}
+			stack[stackLen] = referenced
+			stackLen++
+		}
+	}
+}
+
+// Mark all objects referenced from the stack of the current goroutine. Other
+// goroutines don't have a stack: their state is stored in coroutine frames on
+// the heap.
+func markStack() {
+	// Make sure all callee-saved registers are stored on the stack, so that
+	// pointers that only live in registers are found as well.
+	unwindInit()
+	markRoots(uintptr(stacksave()), stackTop)
+}
+
+// Free all objects that were not marked and unmark the others.
+func sweep() {
+	freeCurrentObject := false
+	for block := gcBlock(0); block != endBlock; block++ {
+		switch block.state() {
+		case blockStateHead:
+			// Unreachable object.
+			block.setState(blockStateFree)
+			freeCurrentObject = true
+		case blockStateTail:
+			if freeCurrentObject {
+				block.setState(blockStateFree)
+			}
+		case blockStateMark:
+			// Reachable object: keep it for the next cycle.
+			block.setState(blockStateHead)
+			freeCurrentObject = false
+		}
+	}
+}
+
+// Force all callee-saved registers to be spilled to the stack in the calling
+// function.
+//go:linkname unwindInit llvm.eh.unwind.init
+func unwindInit()
+
+// Return the current stack pointer.
+//go:linkname stacksave llvm.stacksave
+func stacksave() unsafe.Pointer
+
+// KeepAlive marks its argument as reachable up to this call. The value is
+// stored in a global, which the compiler cannot optimize away, so it stays
+// reachable at least until the next call to KeepAlive.
 func KeepAlive(x interface{}) {
-	// Unimplemented. Only required with SetFinalizer().
+	keepAliveSink = x
 }
 
+// SetFinalizer sets a function that is called with the given object after it
+// has become unreachable. Calls to SetFinalizer are replaced by the compiler
+// with a call to setFinalizer, as the runtime cannot call a function of
+// arbitrary type stored in an interface.
 func SetFinalizer(obj interface{}, finalizer interface{}) {
-	// Unimplemented.
+	runtimePanic("SetFinalizer not lowered by the compiler")
+}
+
+// Set the finalizer of the given object to the given function (which may be a
+// closure with the given context). A nil fn removes the finalizer.
+//
+// This is a compiler intrinsic.
+func setFinalizer(obj, fn, context unsafe.Pointer) {
+	if !looksLikePointer(uintptr(obj)) {
+		// Not allocated on the heap, so it never becomes unreachable.
+		return
+	}
+	// Remove an existing finalizer.
+	for ptr := &finalizers; *ptr != nil; ptr = &(*ptr).next {
+		if (*ptr).obj == ^uintptr(obj) {
+			*ptr = (*ptr).next
+			break
+		}
+	}
+	if fn == nil {
+		return
+	}
+	finalizers = &finalizer{
+		next:    finalizers,
+		obj:     ^uintptr(obj),
+		fn:      fn,
+		context: context,
+	}
 }
+
+// Call the finalizer function fn with the object and the closure context. The
+// body of this function is generated by the compiler.
+func callFinalizer(fn, obj, context unsafe.Pointer)
@@ -0,0 +1,28 @@
+// +build !linux
+
+package runtime
+
+// The heap, the globals and the stack of bare-metal targets are defined by the
+// linker script.
+
+import (
+	"unsafe"
+)
+
+var (
+	_extern__heap_start unsafe.Pointer // defined by the linker
+	_extern__heap_end   unsafe.Pointer // defined by the linker
+	_extern__sdata      unsafe.Pointer // defined by the linker
+	_extern__ebss       unsafe.Pointer // defined by the linker
+	_extern__stack_top  unsafe.Pointer // defined by the linker
+
+	heapStart    = uintptr(unsafe.Pointer(&_extern__heap_start))
+	heapEnd      = uintptr(unsafe.Pointer(&_extern__heap_end))
+	globalsStart = uintptr(unsafe.Pointer(&_extern__sdata))
+	globalsEnd   = uintptr(unsafe.Pointer(&_extern__ebss))
+	stackTop     = uintptr(unsafe.Pointer(&_extern__stack_top))
+)
+
+// The heap region is fixed at link time, so there is nothing to do here.
+func initHeapRegion() {
+}
@@ -11,12 +11,13 @@ import (
 
 // The underlying hashmap structure for Go.
 type hashmap struct {
-	next       *hashmap       // hashmap after evacuate (for iterators)
+	next       *hashmap       // hashmap after evacuate (while growing, see hashmapGrow)
 	buckets    unsafe.Pointer // pointer to array of buckets
 	count      lenType
 	keySize    uint8 // maybe this can store the key type as well? E.g. keysize == 5 means string?
 	valueSize  uint8
 	bucketBits uint8
+	evacuated  uintptr // number of buckets already moved to next (while growing)
 }
 
 // A hashmap bucket. A bucket is a container of 8 key/value pairs: first the
@@ -30,6 +31,19 @@ type hashmapBucket struct {
 	// allocated but as they're of variable size they can't be shown here.
 }
 
+// The state of a range over a map. It is zero-initialized by the compiler before
+// the first call to hashmapNext.
+type hashmapIterator struct {
+	buckets      unsafe.Pointer // buckets of the hashmap when the iteration started
+	numBuckets   uintptr
+	bucketNumber uintptr
+	bucket       *hashmapBucket
+	bucketIndex  uint8
+}
+
+// The maximum average number of entries per bucket before the hashmap grows.
+const hashmapMaxLoad = 6
+
 // Get FNV-1a hash of this key.
 //
 // https://en.wikipedia.org/wiki/Fowler%E2%80%93Noll%E2%80%93Vo_hash_function#FNV-1a_hash
@@ -53,6 +67,15 @@ func hashmapTopHash(hash uint32) uint8 {
 	return tophash
 }
 
+// Return the number of entries in this hashmap, for len(m). A nil map has
+// length 0.
+func hashmapLen(m *hashmap) int {
+	if m == nil {
+		return 0
+	}
+	return int(m.count)
+}
+
 // Create a new hashmap with the given keySize and valueSize.
 func hashmapMake(keySize, valueSize uint8) *hashmap {
 	bucketBufSize := unsafe.Sizeof(hashmapBucket{}) + uintptr(keySize)*8 + uintptr(valueSize)*8
@@ -65,103 +88,289 @@ func hashmapMake(keySize, valueSize uint8) *hashmap {
 	}
 }
 
-// Set a specified key to a given value. Grow the map if necessary.
+// Return the size of a single bucket, including keys and values.
+func (m *hashmap) bucketSize() uintptr {
+	return unsafe.Sizeof(hashmapBucket{}) + uintptr(m.keySize)*8 + uintptr(m.valueSize)*8
+}
+
+// Return the first bucket of the chain with the given number.
+func (m *hashmap) bucket(bucketNumber uintptr) *hashmapBucket {
+	bucketAddr := uintptr(m.buckets) + m.bucketSize()*bucketNumber
+	return (*hashmapBucket)(unsafe.Pointer(bucketAddr))
+}
+
+// Return a pointer to the key in the given slot of a bucket.
+func (m *hashmap) slotKey(bucket *hashmapBucket, i uintptr) unsafe.Pointer {
+	slotKeyOffset := unsafe.Sizeof(hashmapBucket{}) + uintptr(m.keySize)*i
+	return unsafe.Pointer(uintptr(unsafe.Pointer(bucket)) + slotKeyOffset)
+}
+
+// Return a pointer to the value in the given slot of a bucket.
+func (m *hashmap) slotValue(bucket *hashmapBucket, i uintptr) unsafe.Pointer {
+	slotValueOffset := unsafe.Sizeof(hashmapBucket{}) + uintptr(m.keySize)*8 + uintptr(m.valueSize)*i
+	return unsafe.Pointer(uintptr(unsafe.Pointer(bucket)) + slotValueOffset)
+}
+
+// Return the hashmap that contains the key with the given hash. This is the
+// hashmap itself, unless it is growing and the bucket of this key has already
+// been moved to the new hashmap.
+func (m *hashmap) table(hash uint32) *hashmap {
+	if m.next != nil && uintptr(hash)&(uintptr(1)<<m.bucketBits-1) < m.evacuated {
+		return m.next
+	}
+	return m
+}
+
+// Find the slot that contains the given key. Returns the bucket and index of
+// the slot, or a nil bucket if the key could not be found.
 //go:nobounds
-func hashmapSet(m *hashmap, key unsafe.Pointer, value unsafe.Pointer, hash uint32, keyEqual func(x, y unsafe.Pointer, n uintptr) bool) {
+func hashmapFind(m *hashmap, key unsafe.Pointer, hash uint32, keyEqual func(x, y unsafe.Pointer, n uintptr) bool) (*hashmapBucket, uintptr) {
 	numBuckets := uintptr(1) << m.bucketBits
-	bucketNumber := (uintptr(hash) & (numBuckets - 1))
-	bucketSize := unsafe.Sizeof(hashmapBucket{}) + uintptr(m.keySize)*8 + uintptr(m.valueSize)*8
-	bucketAddr := uintptr(m.buckets) + bucketSize*bucketNumber
-	bucket := (*hashmapBucket)(unsafe.Pointer(bucketAddr))
-
+	bucket := m.bucket(uintptr(hash) & (numBuckets - 1))
 	tophash := hashmapTopHash(hash)
-
-	// See whether the key already exists somewhere.
-	var emptySlotKey unsafe.Pointer
-	var emptySlotValue unsafe.Pointer
-	var emptySlotTophash *byte
 	for bucket != nil {
 		for i := uintptr(0); i < 8; i++ {
-			slotKeyOffset := unsafe.Sizeof(hashmapBucket{}) + uintptr(m.keySize)*uintptr(i)
-			slotKey := unsafe.Pointer(bucketAddr + slotKeyOffset)
-			slotValueOffset := unsafe.Sizeof(hashmapBucket{}) + uintptr(m.keySize)*8 + uintptr(m.valueSize)*uintptr(i)
-			slotValue := unsafe.Pointer(bucketAddr + slotValueOffset)
-			if bucket.tophash[i] == 0 && emptySlotKey == nil {
-				// Found an empty slot, store it for if we couldn't find an
-				// existing slot.
-				emptySlotKey = slotKey
-				emptySlotValue = slotValue
-				emptySlotTophash = &bucket.tophash[i]
-			}
 			if bucket.tophash[i] == tophash {
-				// Could be an existing value that's the same.
-				if keyEqual(key, slotKey, uintptr(m.keySize)) {
-					// found same key, replace it
-					memcpy(slotValue, value, uintptr(m.valueSize))
-					return
+				// This could be the key we're looking for.
+				if keyEqual(key, m.slotKey(bucket, i), uintptr(m.keySize)) {
+					return bucket, i
 				}
 			}
 		}
 		bucket = bucket.next
 	}
-	if emptySlotKey != nil {
-		m.count++
-		memcpy(emptySlotKey, key, uintptr(m.keySize))
-		memcpy(emptySlotValue, value, uintptr(m.valueSize))
-		*emptySlotTophash = tophash
-		return
-	}
-	panic("todo: hashmap: grow bucket")
+	return nil, 0
 }
 
-// Get the value of a specified key, or zero the value if not found.
+// Insert a key that is not yet present in the hashmap in the first empty slot
+// of its bucket chain, adding a new bucket to the chain if it is full.
 //go:nobounds
-func hashmapGet(m *hashmap, key unsafe.Pointer, value unsafe.Pointer, hash uint32, keyEqual func(x, y unsafe.Pointer, n uintptr) bool) {
+func hashmapInsert(m *hashmap, key, value unsafe.Pointer, hash uint32) {
 	numBuckets := uintptr(1) << m.bucketBits
-	bucketNumber := (uintptr(hash) & (numBuckets - 1))
-	bucketSize := unsafe.Sizeof(hashmapBucket{}) + uintptr(m.keySize)*8 + uintptr(m.valueSize)*8
-	bucketAddr := uintptr(m.buckets) + bucketSize*bucketNumber
-	bucket := (*hashmapBucket)(unsafe.Pointer(bucketAddr))
+	bucket := m.bucket(uintptr(hash) & (numBuckets - 1))
+	for {
+		for i := uintptr(0); i < 8; i++ {
+			if bucket.tophash[i] == 0 {
+				memcpy(m.slotKey(bucket, i), key, uintptr(m.keySize))
+				memcpy(m.slotValue(bucket, i), value, uintptr(m.valueSize))
+				bucket.tophash[i] = hashmapTopHash(hash)
+				return
+			}
+		}
+		if bucket.next == nil {
+			// All slots in this chain are in use.
+			bucket.next = (*hashmapBucket)(alloc(m.bucketSize()))
+		}
+		bucket = bucket.next
+	}
+}
 
-	tophash := uint8(hash >> 24)
-	if tophash < 1 {
-		// 0 means empty slot, so make it bigger.
-		tophash += 1
+// Start growing the hashmap to twice the number of buckets. The buckets are
+// moved to the new hashmap (stored in m.next) one by one in hashmapEvacuate, so
+// that a single insert never has to move all entries at once.
+func hashmapGrow(m *hashmap) {
+	bucketBits := m.bucketBits + 1
+	m.next = &hashmap{
+		buckets:    alloc(m.bucketSize() << bucketBits),
+		keySize:    m.keySize,
+		valueSize:  m.valueSize,
+		bucketBits: bucketBits,
 	}
+	m.evacuated = 0
+}
 
-	// Try to find the key.
+// Move the next bucket chain of a growing hashmap to the new hashmap. When all
+// buckets have been moved, the new hashmap takes over.
+//
+// The old buckets are left as they are, as they may still be in use by an
+// iterator.
+//go:nobounds
+func hashmapEvacuate(m *hashmap, keyHash func(key unsafe.Pointer, n uintptr) uint32) {
+	bucket := m.bucket(m.evacuated)
 	for bucket != nil {
 		for i := uintptr(0); i < 8; i++ {
-			slotKeyOffset := unsafe.Sizeof(hashmapBucket{}) + uintptr(m.keySize)*uintptr(i)
-			slotKey := unsafe.Pointer(bucketAddr + slotKeyOffset)
-			slotValueOffset := unsafe.Sizeof(hashmapBucket{}) + uintptr(m.keySize)*8 + uintptr(m.valueSize)*uintptr(i)
-			slotValue := unsafe.Pointer(bucketAddr + slotValueOffset)
-			if bucket.tophash[i] == tophash {
-				// This could be the key we're looking for.
-				if keyEqual(key, slotKey, uintptr(m.keySize)) {
-					// Found the key, copy it.
-					memcpy(value, slotValue, uintptr(m.valueSize))
-					return
-				}
+			if bucket.tophash[i] == 0 {
+				continue
 			}
+			key := m.slotKey(bucket, i)
+			hash := keyHash(key, uintptr(m.keySize))
+			hashmapInsert(m.next, key, m.slotValue(bucket, i), hash)
 		}
 		bucket = bucket.next
 	}
+	m.evacuated++
+	if m.evacuated == uintptr(1)<<m.bucketBits {
+		// All buckets have been moved.
+		m.buckets = m.next.buckets
+		m.bucketBits = m.next.bucketBits
+		m.next = nil
+		m.evacuated = 0
+	}
+}
+
+// Set a specified key to a given value. Grow the map if necessary.
+func hashmapSet(m *hashmap, key unsafe.Pointer, value unsafe.Pointer, hash uint32, keyEqual func(x, y unsafe.Pointer, n uintptr) bool, keyHash func(key unsafe.Pointer, n uintptr) uint32) {
+	if m == nil {
+		nilMapPanic()
+	}
+
+	// Move a few buckets when growing, so that growing finishes before the
+	// hashmap needs to grow again.
+	for i := 0; i < 2 && m.next != nil; i++ {
+		hashmapEvacuate(m, keyHash)
+	}
+
+	// See whether the key already exists somewhere.
+	t := m.table(hash)
+	bucket, i := hashmapFind(t, key, hash, keyEqual)
+	if bucket != nil {
+		// found same key, replace it
+		memcpy(t.slotValue(bucket, i), value, uintptr(m.valueSize))
+		return
+	}
 
-	// Did not find the key.
-	memzero(value, uintptr(m.valueSize))
+	if m.next == nil && uintptr(m.count) >= hashmapMaxLoad<<m.bucketBits {
+		// Too many entries for the number of buckets, so bucket chains would
+		// get long.
+		hashmapGrow(m)
+		hashmapEvacuate(m, keyHash)
+		t = m.table(hash)
+	}
+	m.count++
+	hashmapInsert(t, key, value, hash)
+}
+
+// Get the value of a specified key, or zero the value if not found. Returns
+// whether the key was found.
+func hashmapGet(m *hashmap, key unsafe.Pointer, value unsafe.Pointer, hash uint32, keyEqual func(x, y unsafe.Pointer, n uintptr) bool) bool {
+	if m == nil {
+		// Reading from a nil map returns the zero value. The value size is
+		// not known here, so the compiler zeroes the value beforehand.
+		return false
+	}
+	t := m.table(hash)
+	bucket, i := hashmapFind(t, key, hash, keyEqual)
+	if bucket == nil {
+		// Did not find the key.
+		memzero(value, uintptr(m.valueSize))
+		return false
+	}
+	// Found the key, copy it.
+	memcpy(value, t.slotValue(bucket, i), uintptr(m.valueSize))
+	return true
+}
+
+// Delete a given key from the map. No-op when the key does not exist in the
+// map.
+//go:nobounds
+func hashmapDelete(m *hashmap, key unsafe.Pointer, hash uint32, keyEqual func(x, y unsafe.Pointer, n uintptr) bool) {
+	if m == nil {
+		// The delete builtin is a no-op on nil maps.
+		return
+	}
+	t := m.table(hash)
+	bucket, i := hashmapFind(t, key, hash, keyEqual)
+	if bucket == nil {
+		return
+	}
+	// Clear the slot, so that the garbage collector doesn't keep referenced
+	// objects alive.
+	bucket.tophash[i] = 0
+	memzero(t.slotKey(bucket, i), uintptr(m.keySize))
+	memzero(t.slotValue(bucket, i), uintptr(m.valueSize))
+	m.count--
+}
+
+// Iterate over a hashmap. Stores the next key and value and returns true, or
+// returns false when all entries have been visited.
+//
+// The iterator walks over the buckets as they were when the iteration started.
+// When the hashmap has grown in the meantime, the entries are looked up again
+// to skip deleted entries and to return the current value.
+//go:nobounds
+func hashmapNext(m *hashmap, it *hashmapIterator, key, value unsafe.Pointer, keyEqual func(x, y unsafe.Pointer, n uintptr) bool, keyHash func(key unsafe.Pointer, n uintptr) uint32) bool {
+	if m == nil {
+		// Ranging over a nil map does nothing.
+		return false
+	}
+	if it.buckets == nil {
+		// First call: make sure all entries are in the same buckets array.
+		for m.next != nil {
+			hashmapEvacuate(m, keyHash)
+		}
+		it.buckets = m.buckets
+		it.numBuckets = uintptr(1) << m.bucketBits
+		it.bucket = m.bucket(0)
+	}
+	bucketSize := m.bucketSize()
+	for {
+		if it.bucketIndex >= 8 {
+			// Continue with the next bucket in the chain.
+			it.bucket = it.bucket.next
+			it.bucketIndex = 0
+		}
+		if it.bucket == nil {
+			// Continue with the next bucket chain.
+			it.bucketNumber++
+			if it.bucketNumber >= it.numBuckets {
+				// All buckets have been visited.
+				return false
+			}
+			bucketAddr := uintptr(it.buckets) + bucketSize*it.bucketNumber
+			it.bucket = (*hashmapBucket)(unsafe.Pointer(bucketAddr))
+		}
+		i := uintptr(it.bucketIndex)
+		it.bucketIndex++
+		if it.bucket.tophash[i] == 0 {
+			// Empty slot.
+			continue
+		}
+
+		memcpy(key, m.slotKey(it.bucket, i), uintptr(m.keySize))
+		if it.buckets == m.buckets && m.next == nil {
+			// The hashmap hasn't grown, so this is the current value.
+			memcpy(value, m.slotValue(it.bucket, i), uintptr(m.valueSize))
+			return true
+		}
+		if hashmapGet(m, key, value, keyHash(key, uintptr(m.keySize)), keyEqual) {
+			return true
+		}
+		// This entry was deleted after the hashmap started growing.
+	}
+}
+
+func nilMapPanic() {
+	runtimePanic("assignment to entry in nil map")
 }
 
 // Hashmap with plain binary data keys (not containing strings etc.).
 
 func hashmapBinarySet(m *hashmap, key, value unsafe.Pointer) {
+	if m == nil {
+		nilMapPanic()
+	}
 	hash := hashmapHash(key, uintptr(m.keySize))
-	hashmapSet(m, key, value, hash, memequal)
+	hashmapSet(m, key, value, hash, memequal, hashmapHash)
 }
 
-func hashmapBinaryGet(m *hashmap, key, value unsafe.Pointer) {
+func hashmapBinaryGet(m *hashmap, key, value unsafe.Pointer) bool {
+	if m == nil {
+		return false
+	}
 	hash := hashmapHash(key, uintptr(m.keySize))
-	hashmapGet(m, key, value, hash, memequal)
+	return hashmapGet(m, key, value, hash, memequal)
+}
+
+func hashmapBinaryDelete(m *hashmap, key unsafe.Pointer) {
+	if m == nil {
+		return
+	}
+	hash := hashmapHash(key, uintptr(m.keySize))
+	hashmapDelete(m, key, hash, memequal)
+}
+
+func hashmapBinaryNext(m *hashmap, it *hashmapIterator, key, value unsafe.Pointer) bool {
+	return hashmapNext(m, it, key, value, memequal, hashmapHash)
 }
 
 // Hashmap with string keys (a common case).
@@ -175,12 +384,88 @@ func hashmapStringHash(s string) uint32 {
 	return hashmapHash(unsafe.Pointer(_s.ptr), uintptr(_s.length))
 }
 
+func hashmapStringPtrHash(key unsafe.Pointer, n uintptr) uint32 {
+	return hashmapStringHash(*(*string)(key))
+}
+
 func hashmapStringSet(m *hashmap, key string, value unsafe.Pointer) {
 	hash := hashmapStringHash(key)
-	hashmapSet(m, unsafe.Pointer(&key), value, hash, hashmapStringEqual)
+	hashmapSet(m, unsafe.Pointer(&key), value, hash, hashmapStringEqual, hashmapStringPtrHash)
+}
+
+func hashmapStringGet(m *hashmap, key string, value unsafe.Pointer) bool {
+	hash := hashmapStringHash(key)
+	return hashmapGet(m, unsafe.Pointer(&key), value, hash, hashmapStringEqual)
 }
 
-func hashmapStringGet(m *hashmap, key string, value unsafe.Pointer) {
+func hashmapStringDelete(m *hashmap, key string) {
 	hash := hashmapStringHash(key)
-	hashmapGet(m, unsafe.Pointer(&key), value, hash, hashmapStringEqual)
+	hashmapDelete(m, unsafe.Pointer(&key), hash, hashmapStringEqual)
+}
+
+func hashmapStringNext(m *hashmap, it *hashmapIterator, key, value unsafe.Pointer) bool {
+	return hashmapNext(m, it, key, value, hashmapStringEqual, hashmapStringPtrHash)
+}
+
+// Hashmap with keys that cannot be compared as plain binary data, like floats,
+// interfaces and structs containing strings. The hash and equality functions
+// of the key type are generated by the compiler.
+
+func hashmapGenericSet(m *hashmap, key, value unsafe.Pointer, keyEqual func(x, y unsafe.Pointer, n uintptr) bool, keyHash func(key unsafe.Pointer, n uintptr) uint32) {
+	if m == nil {
+		nilMapPanic()
+	}
+	hash := keyHash(key, uintptr(m.keySize))
+	hashmapSet(m, key, value, hash, keyEqual, keyHash)
+}
+
+func hashmapGenericGet(m *hashmap, key, value unsafe.Pointer, keyEqual func(x, y unsafe.Pointer, n uintptr) bool, keyHash func(key unsafe.Pointer, n uintptr) uint32) bool {
+	if m == nil {
+		return false
+	}
+	hash := keyHash(key, uintptr(m.keySize))
+	return hashmapGet(m, key, value, hash, keyEqual)
+}
+
+func hashmapGenericDelete(m *hashmap, key unsafe.Pointer, keyEqual func(x, y unsafe.Pointer, n uintptr) bool, keyHash func(key unsafe.Pointer, n uintptr) uint32) {
+	if m == nil {
+		return
+	}
+	hash := keyHash(key, uintptr(m.keySize))
+	hashmapDelete(m, key, hash, keyEqual)
+}
+
+func hashmapGenericNext(m *hashmap, it *hashmapIterator, key, value unsafe.Pointer, keyEqual func(x, y unsafe.Pointer, n uintptr) bool, keyHash func(key unsafe.Pointer, n uintptr) uint32) bool {
+	return hashmapNext(m, it, key, value, keyEqual, keyHash)
+}
+
+// Hash a float32 key. Positive and negative zero are equal, so they must have
+// the same hash. NaN is never equal to anything, so any hash will do.
+func hashmapFloat32Hash(ptr unsafe.Pointer, n uintptr) uint32 {
+	f := *(*float32)(ptr)
+	if f == 0 {
+		f = 0 // -0 to +0
+	}
+	return hashmapHash(unsafe.Pointer(&f), 4)
+}
+
+// Hash a float64 key, see hashmapFloat32Hash.
+func hashmapFloat64Hash(ptr unsafe.Pointer, n uintptr) uint32 {
+	f := *(*float64)(ptr)
+	if f == 0 {
+		f = 0 // -0 to +0
+	}
+	return hashmapHash(unsafe.Pointer(&f), 8)
+}
+
+// Hash a complex64 key: both parts are hashed like a float32.
+func hashmapComplex64Hash(ptr unsafe.Pointer, n uintptr) uint32 {
+	hash := hashmapFloat32Hash(ptr, 4)
+	return hash*16777619 ^ hashmapFloat32Hash(unsafe.Pointer(uintptr(ptr)+4), 4)
+}
+
+// Hash a complex128 key: both parts are hashed like a float64.
+func hashmapComplex128Hash(ptr unsafe.Pointer, n uintptr) uint32 {
+	hash := hashmapFloat64Hash(ptr, 8)
+	return hash*16777619 ^ hashmapFloat64Hash(unsafe.Pointer(uintptr(ptr)+8), 8)
 }
@@ -9,7 +9,9 @@ package runtime
 // contain the name and the signature of the function (to save space), think of
 // signatures as interned strings at compile time.
 //
-// The typecode is a small number unique for the Go type. All typecodes <
+// The typecode is a small number unique for the Go type. It has the size of a
+// pointer, so that large programs don't run out of typecodes while small targets
+// (like AVR, with 16-bit pointers) don't waste space. All typecodes <
 // firstTypeWithMethods do not have any methods and typecodes >=
 // firstTypeWithMethods all have at least one method. This means that
 // methodSetRanges does not need to contain types without methods and is thus
@@ -18,37 +20,38 @@ package runtime
 // To further conserve some space, the methodSetRange (as the name indicates)
 // doesn't contain a list of methods and function pointers directly, but instead
 // just indexes into methodSetSignatures and methodSetFunctions which contains
-// the mapping from uniqued signature to function pointer.
+// the mapping from uniqued signature to function pointer. Method IDs, interface
+// IDs and the indices in these tables have the same size as the typecode.
 
 type _interface struct {
-	typecode uint16
+	typecode uintptr
 	value    *uint8
 }
 
 // This struct indicates the range of methods in the methodSetSignatures and
 // methodSetFunctions arrays that belong to this named type.
 type methodSetRange struct {
-	index  uint16 // start index into interfaceSignatures and interfaceFunctions
-	length uint16 // number of methods
+	index  uintptr // start index into interfaceSignatures and interfaceFunctions
+	length uintptr // number of methods
 }
 
 // Global constants that will be set by the compiler. The arrays are of size 0,
 // which is a dummy value, but will be bigger after the compiler has filled them
 // in.
 var (
-	firstTypeWithMethods uint16            // the lowest typecode that has at least one method
+	firstTypeWithMethods uintptr           // the lowest typecode that has at least one method
 	methodSetRanges      [0]methodSetRange // indices into methodSetSignatures and methodSetFunctions
-	methodSetSignatures  [0]uint16         // uniqued method ID
+	methodSetSignatures  [0]uintptr        // uniqued method ID
 	methodSetFunctions   [0]*uint8         // function pointer of method
-	interfaceIndex       [0]uint16         // mapping from interface ID to an index in interfaceMethods
-	interfaceLengths     [0]uint8          // mapping from interface ID to the number of methods it has
-	interfaceMethods     [0]uint16         // the method an interface implements (list of method IDs)
+	interfaceIndex       [0]uintptr        // mapping from interface ID to an index in interfaceMethods
+	interfaceLengths     [0]uintptr        // mapping from interface ID to the number of methods it has
+	interfaceMethods     [0]uintptr        // the method an interface implements (list of method IDs)
 )
 
 // Get the function pointer for the method on the interface.
 // This is a compiler intrinsic.
 //go:nobounds
-func interfaceMethod(itf _interface, method uint16) *uint8 {
+func interfaceMethod(itf _interface, method uintptr) *uint8 {
 	// This function doesn't do bounds checking as the supplied method must be
 	// in the list of signatures. The compiler will only emit
 	// runtime.interfaceMethod calls when the method actually exists on this
@@ -72,23 +75,56 @@ func interfaceEqual(x, y _interface) bool {
 		// Both interfaces are nil, so they are equal.
 		return true
 	}
-	// TODO: depends on reflection.
-	panic("unimplemented: interface equality")
+	// Same dynamic type, so compare the values. This panics when the type is
+	// not comparable.
+	return interfaceValueEqual(x.typecode, x.value, y.value)
+}
+
+// Return a hash of the interface, for interfaces used as map keys. Interfaces
+// that are equal according to interfaceEqual have the same hash.
+func interfaceHash(itf _interface) uint32 {
+	if itf.typecode == 0 {
+		// nil interface
+		return 0
+	}
+	return interfaceValueHash(itf.typecode, itf.value) ^ uint32(itf.typecode)
+}
+
+// Compare the values of two interfaces with the same (non-nil) dynamic type.
+// The value is either stored directly in the interface or, when it doesn't fit,
+// is a pointer to the value. The body of this function is generated by the
+// compiler.
+func interfaceValueEqual(typecode uintptr, x, y *uint8) bool
+
+// Hash the value of an interface with the given (non-nil) dynamic type, see
+// interfaceValueEqual. The body of this function is generated by the compiler.
+func interfaceValueHash(typecode uintptr, value *uint8) uint32
+
+// Called from interfaceValueEqual and interfaceValueHash when the dynamic type
+// is not comparable, like a slice or map.
+func interfaceUncomparable() {
+	runtimePanic("comparing uncomparable type")
 }
 
 // Return true iff the type implements all methods needed by the interface. This
 // means the type satisfies the interface.
 // This is a compiler intrinsic.
 //go:nobounds
-func interfaceImplements(typecode, interfaceNum uint16) bool {
+func interfaceImplements(typecode, interfaceNum uintptr) bool {
+	if typecode == 0 {
+		// A nil interface doesn't implement any interface, not even the empty
+		// interface.
+		return false
+	}
+
 	// method set indices of the interface
 	itfIndex := interfaceIndex[interfaceNum]
-	itfIndexEnd := itfIndex + uint16(interfaceLengths[interfaceNum])
+	itfIndexEnd := itfIndex + interfaceLengths[interfaceNum]
 
 	if itfIndex == itfIndexEnd {
-		// This interface has no methods, so it satisfies all types.
-		// TODO: this should be figured out at compile time (as it is known at
-		// compile time), so that this check is unnecessary at runtime.
+		// This interface has no methods, so it satisfies all types. The
+		// compiler already handles the empty interface without calling this
+		// function, so this is just a safety check.
 		return true
 	}
 
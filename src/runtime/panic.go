@@ -1,7 +1,57 @@
 package runtime
 
+// Panics are implemented using defer frames. Every function with a defer
+// statement has a deferFrame on the stack, which holds the list of deferred
+// calls of that function and a jump buffer. These frames form a stack. A panic
+// runs the deferred calls of each frame, starting at the top. When a deferred
+// call recovers, the panic jumps back into the function of that frame (using
+// llvm.eh.sjlj.longjmp), which then returns from its recover block.
+//
+// Blocking functions (goroutines) and targets without support for
+// setjmp/longjmp (like AVR) don't have defer frames: their deferred calls are
+// only run on a regular return. The compiler rejects blocking functions that
+// defer a call to a function using recover(), as it could never recover
+// anything.
+
+import (
+	"unsafe"
+)
+
+// The Error interface identifies a run time error.
+type Error interface {
+	error
+
+	// RuntimeError is a no-op function but serves to distinguish types that
+	// are run time errors from ordinary errors.
+	RuntimeError()
+}
+
+// A run time error, as passed to recover() for panics like index out of range.
+type runtimeError string
+
+func (e runtimeError) Error() string {
+	return "runtime error: " + string(e)
+}
+
+func (e runtimeError) RuntimeError() {}
+
+type deferFrame struct {
+	jumpBuffer [5]unsafe.Pointer // used by llvm.eh.sjlj.setjmp and longjmp
+	previous   *deferFrame       // the frame of the calling function
+	deferred   *_defer           // deferred calls of this function
+	panicking  bool              // running deferred calls for a panic that has not been recovered
+	panicValue interface{}       // the value passed to panic()
+	outerPanic *deferFrame       // frame of the panic that was running when this one started
+}
+
+var (
+	currentDeferFrame *deferFrame // the top of the stack of defer frames
+	panickingFrame    *deferFrame // frame of the innermost running panic
+)
+
 // Builtin function panic(msg), used as a compiler intrinsic.
 func _panic(message interface{}) {
+	unwind(message)
 	printstring("panic: ")
 	printitf(message)
 	printnl()
@@ -10,11 +60,100 @@ func _panic(message interface{}) {
 
 // Cause a runtime panic, which is (currently) always a string.
 func runtimePanic(msg string) {
+	unwind(runtimeError(msg))
 	printstring("panic: runtime error: ")
 	println(msg)
 	abort()
 }
 
+// Print a fatal error and exit, without running deferred calls. Used for errors
+// that can't be recovered from (like in gc), in particular those of the heap
+// allocator: unlike runtimePanic, this doesn't allocate the panic value on the
+// heap, which would fail again when the heap is full.
+func runtimeFatal(msg string) {
+	printstring("fatal error: ")
+	printstring(msg)
+	printnl()
+	abort()
+}
+
+// The function that a deferred call is about to call, see isDeferredCall. It
+// is set by the $defer wrappers generated by the compiler.
+var deferredFunc unsafe.Pointer
+
+// Builtin function recover(), used as a compiler intrinsic. It stops the
+// innermost running panic and returns its value, or returns nil when there is
+// no panic or when the function calling recover() wasn't called directly by a
+// deferred call (direct, see isDeferredCall).
+func _recover(direct bool) interface{} {
+	frame := panickingFrame
+	if !direct || frame == nil || !frame.panicking {
+		return nil
+	}
+	frame.panicking = false
+	return frame.panicValue
+}
+
+// Return whether the function fn was called directly by a deferred call. It
+// is called at the start of every function that calls recover(), before it can
+// call anything else.
+//
+// This is a compiler intrinsic.
+func isDeferredCall(fn unsafe.Pointer) bool {
+	direct := deferredFunc == fn
+	deferredFunc = nil
+	return direct
+}
+
+// Run the deferred calls of all defer frames, starting at the top. When one of
+// them recovers, jump back into the function of that frame; otherwise return
+// so that the caller can abort the program.
+func unwind(value interface{}) {
+	outer := panickingFrame
+	for currentDeferFrame != nil {
+		frame := currentDeferFrame
+		if frame == outer {
+			// This panic happened in a deferred call run by an outer panic,
+			// and it has now reached the frame of that panic. The outer panic
+			// is replaced by this one.
+			outer = frame.outerPanic
+		}
+		frame.outerPanic = outer
+		frame.panicking = true
+		frame.panicValue = value
+		panickingFrame = frame
+		rundefers(&frame.deferred)
+		if !frame.panicking {
+			// Recovered. Continue the outer panic (if any) once this function
+			// has returned.
+			panickingFrame = frame.outerPanic
+			deferLongjmp(frame)
+		}
+		currentDeferFrame = frame.previous
+	}
+}
+
+// Push a new defer frame on the stack.
+//
+// This is a compiler intrinsic.
+func pushDeferFrame(frame *deferFrame) {
+	frame.previous = currentDeferFrame
+	frame.deferred = nil
+	frame.panicking = false
+	currentDeferFrame = frame
+}
+
+// Remove the defer frame from the stack when its function returns.
+//
+// This is a compiler intrinsic.
+func popDeferFrame(frame *deferFrame) {
+	currentDeferFrame = frame.previous
+}
+
+// Jump back into the function of the given frame, which continues in its
+// recover block. The body of this function is generated by the compiler.
+func deferLongjmp(frame *deferFrame)
+
 // Check for bounds in *ssa.Index, *ssa.IndexAddr and *ssa.Lookup.
 func lookupBoundsCheck(length, index int) {
 	if index < 0 || index >= length {
@@ -22,9 +161,18 @@ func lookupBoundsCheck(length, index int) {
 	}
 }
 
-// Check for bounds in *ssa.Slice.
-func sliceBoundsCheck(length, low, high uint) {
-	if !(0 <= low && low <= high && high <= length) {
+// Check for bounds in *ssa.Slice. Strings don't have a capacity, so for them
+// capacity is the length and max is the same as high.
+func sliceBoundsCheck(capacity, low, high, max uint) {
+	if !(0 <= low && low <= high && high <= max && max <= capacity) {
+		runtimePanic("slice out of range")
+	}
+}
+
+// Check that an index of *ssa.Slice that is wider than the length type fits
+// in it, before it is truncated. It doesn't fit when it is too big or negative.
+func sliceIndexCheck(fits bool) {
+	if !fits {
 		runtimePanic("slice out of range")
 	}
 }
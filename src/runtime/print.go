@@ -39,7 +39,7 @@ func printuint16(n uint16) {
 	printuint32(uint32(n))
 }
 
-func printint16(n uint16) {
+func printint16(n int16) {
 	printint32(int32(n))
 }
 
@@ -174,6 +174,20 @@ func printfloat64(v float64) {
 	}
 }
 
+func printcomplex64(c complex64) {
+	putchar('(')
+	printfloat32(real(c))
+	printfloat32(imag(c))
+	printstring("i)")
+}
+
+func printcomplex128(c complex128) {
+	putchar('(')
+	printfloat64(real(c))
+	printfloat64(imag(c))
+	printstring("i)")
+}
+
 func printspace() {
 	putchar(' ')
 }
@@ -183,6 +197,26 @@ func printnl() {
 	putchar('\n')
 }
 
+// Print an interface value as its typecode and value, like gc does.
+func printinterface(itf _interface) {
+	putchar('(')
+	printptr(uintptr(itf.typecode))
+	putchar(',')
+	printptr(uintptr(unsafe.Pointer(itf.value)))
+	putchar(')')
+}
+
+// Print a slice as its length, capacity and pointer to the backing array,
+// like gc does.
+func printslice(ptr uintptr, length, capacity lenType) {
+	putchar('[')
+	print(length)
+	putchar('/')
+	print(capacity)
+	putchar(']')
+	printptr(ptr)
+}
+
 func printitf(msg interface{}) {
 	switch msg := msg.(type) {
 	case string:
@@ -198,29 +232,24 @@ func printitf(msg interface{}) {
 	}
 }
 
-func printmap(m *hashmap) {
-	print("map[")
-	if m == nil {
-		print("nil")
-	} else {
-		print(m.count)
-	}
-	putchar(']')
-}
-
+// Print a pointer in hexadecimal without leading zeroes, so a nil pointer is
+// printed as 0x0.
 func printptr(ptr uintptr) {
-	if ptr == 0 {
-		print("nil")
-		return
-	}
 	putchar('0')
 	putchar('x')
-	for i := 0; i < int(unsafe.Sizeof(ptr))*2; i++ {
+	numDigits := int(unsafe.Sizeof(ptr)) * 2
+	started := false
+	for i := 0; i < numDigits; i++ {
 		nibble := byte(ptr >> (unsafe.Sizeof(ptr)*8 - 4))
-		if nibble < 10 {
-			putchar(nibble + '0')
-		} else {
-			putchar(nibble - 10 + 'a')
+		if nibble != 0 || i == numDigits-1 {
+			started = true
+		}
+		if started {
+			if nibble < 10 {
+				putchar(nibble + '0')
+			} else {
+				putchar(nibble - 10 + 'a')
+			}
 		}
 		ptr <<= 4
 	}
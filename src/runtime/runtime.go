@@ -43,6 +43,9 @@ func Sleep(d Duration) {
 	// This function is treated specially by the compiler: when goroutines are
 	// used, it is transformed into a llvm.coro.suspend() call.
 	// When goroutines are not used this function behaves as normal.
+	if d <= 0 {
+		return
+	}
 	sleep(d)
 }
 
@@ -111,3 +114,37 @@ func sliceCopy(dst, src unsafe.Pointer, dstLen, srcLen lenType, elemSize uintptr
 	memmove(dst, src, uintptr(n)*elemSize)
 	return n
 }
+
+// Builtin append(src, elements...) function: append elements to src and return
+// the new backing array, length and capacity. The backing array is grown when
+// it doesn't have enough capacity.
+func sliceAppend(srcBuf, elemsBuf unsafe.Pointer, srcLen, srcCap, elemsLen lenType, elemSize uintptr) (unsafe.Pointer, lenType, lenType) {
+	if elemsLen == 0 {
+		// Nothing to append, return the input slice.
+		return srcBuf, srcLen, srcCap
+	}
+	newLen := srcLen + elemsLen
+	if newLen < srcLen {
+		// The length doesn't fit in lenType.
+		runtimePanic("growslice: len out of range")
+	}
+	if newLen > srcCap {
+		// Allocate a new backing array. Double the capacity (at least), so
+		// that appending in a loop takes amortized constant time.
+		newCap := srcCap * 2
+		if newCap < srcCap || newCap < newLen {
+			// Doubling overflowed or isn't enough.
+			newCap = newLen
+		}
+		if elemSize != 0 && uintptr(newCap) > ^uintptr(0)/elemSize {
+			// The size of the backing array doesn't fit in uintptr.
+			runtimePanic("growslice: cap out of range")
+		}
+		buf := alloc(uintptr(newCap) * elemSize)
+		memmove(buf, srcBuf, uintptr(srcLen)*elemSize)
+		srcBuf = buf
+		srcCap = newCap
+	}
+	memmove(unsafe.Pointer(uintptr(srcBuf)+uintptr(srcLen)*elemSize), elemsBuf, uintptr(elemsLen)*elemSize)
+	return srcBuf, newLen, srcCap
+}
@@ -8,8 +8,6 @@ import (
 
 const BOARD = "arduino"
 
-const Microsecond = 1
-
 var currentTime uint64
 
 func init() {
@@ -55,10 +53,27 @@ func putchar(c byte) {
 // once in a while.
 func sleep(d Duration) {
 	currentTime += uint64(d)
-	d /= 16384 // about 16ms
-	for d != 0 {
+	periods := d / (16 * Millisecond)
+	for periods != 0 {
 		sleepWDT(WDT_PERIOD_16MS)
-		d -= 1
+		periods -= 1
+	}
+}
+
+// Sleep until the given duration has passed or the scheduler is woken up by an
+// interrupt, whichever comes first. Any interrupt wakes up the CPU from the WDT
+// sleep, so the flag is checked between each period.
+func idleSleep(d Duration) {
+	const period = 16 * Millisecond
+	for d > 0 && !schedulerWoken {
+		if d < period {
+			// Like sleep, don't actually sleep for the remainder.
+			currentTime += uint64(d)
+			return
+		}
+		sleepWDT(WDT_PERIOD_16MS)
+		currentTime += uint64(period)
+		d -= period
 	}
 }
 
@@ -94,6 +109,13 @@ func monotime() uint64 {
 	return currentTime
 }
 
+// Return the wall clock time. There is no real-time clock, so this is the time
+// since reset.
+func walltime() (sec int64, nsec int32) {
+	t := monotime()
+	return int64(t / 1e9), int32(t % 1e9)
+}
+
 func abort() {
 	avr.Asm("cli")
 	for {
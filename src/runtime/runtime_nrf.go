@@ -7,8 +7,6 @@ import (
 	"device/nrf"
 )
 
-const Microsecond = 1
-
 //go:export _start
 func _start() {
 	main()
@@ -49,31 +47,61 @@ func putchar(c byte) {
 }
 
 func sleep(d Duration) {
-	ticks64 := d / 32
+	sleepTicks(d, false)
+}
+
+// Sleep until the given duration has passed or the scheduler is woken up by an
+// interrupt, whichever comes first.
+func idleSleep(d Duration) {
+	sleepTicks(d, true)
+}
+
+// Sleep using the RTC. The CPU waits for interrupts in the mean time. When
+// interruptible is set, it returns early when wakeScheduler has been called.
+func sleepTicks(d Duration, interruptible bool) {
+	// The RTC runs at 32768Hz, so one tick is 1e9/32768 = 1953125/64
+	// nanoseconds.
+	ticks64 := uint64(d) * 64 / 1953125
 	for ticks64 != 0 {
-		monotime()                          // update timestamp
-		ticks := uint32(ticks64) & 0x7fffff // 23 bits (to be on the safe side)
-		rtc_sleep(ticks)                    // TODO: not accurate (must be d / 30.5175...)
-		ticks64 -= Duration(ticks)
+		if interruptible && bool(schedulerWoken) {
+			return
+		}
+		monotime() // update timestamp
+		ticks := uint32(ticks64)
+		if ticks64 > 0x7fffff {
+			ticks = 0x7fffff // 23 bits (to be on the safe side)
+		}
+		rtc_sleep(ticks, interruptible)
+		ticks64 -= uint64(ticks)
 	}
 }
 
 var (
-	timestamp      uint64 // microseconds since boottime
+	rtcTicks       uint64 // RTC ticks since boottime
 	rtcLastCounter uint32 // 24 bits ticks
 )
 
-// Monotonically increasing numer of microseconds since start.
+// Monotonically increasing number of nanoseconds since start.
 //
 // Note: very long pauses between measurements (more than 8 minutes) may
 // overflow the counter, leading to incorrect results. This might be fixed by
-// handling the overflow event.
+// handling the overflow event. Long sleeps are not affected, as sleep() updates
+// the timestamp regularly.
 func monotime() uint64 {
 	rtcCounter := uint32(nrf.RTC0.COUNTER)
-	offset := (rtcCounter - rtcLastCounter) % 0xffffff // change since last measurement
+	offset := (rtcCounter - rtcLastCounter) & 0xffffff // change since last measurement
 	rtcLastCounter = rtcCounter
-	timestamp += uint64(offset * 32) // TODO: not precise
-	return timestamp
+	rtcTicks += uint64(offset)
+	// Convert ticks to nanoseconds (ticks * 1953125 / 64) without overflowing
+	// the multiplication.
+	return rtcTicks/64*1953125 + rtcTicks%64*1953125/64
+}
+
+// Return the wall clock time. There is no real-time clock, so this is the time
+// since reset.
+func walltime() (sec int64, nsec int32) {
+	t := monotime()
+	return int64(t / 1e9), int32(t % 1e9)
 }
 
 func abort() {
@@ -87,11 +115,9 @@ func align(ptr uintptr) uintptr {
 	return (ptr + 3) &^ 3
 }
 
-type __volatile bool
-
 var rtc_wakeup __volatile
 
-func rtc_sleep(ticks uint32) {
+func rtc_sleep(ticks uint32, interruptible bool) {
 	nrf.RTC0.INTENSET = nrf.RTC0_INTENSET_COMPARE0_Msk
 	rtc_wakeup = false
 	if ticks == 1 {
@@ -101,9 +127,21 @@ func rtc_sleep(ticks uint32) {
 		ticks = 2
 	}
 	nrf.RTC0.CC[0] = (nrf.RTC0.COUNTER + nrf.RegValue(ticks)) & 0x00ffffff
-	for !rtc_wakeup {
+	for {
+		// Check the wakeup conditions with interrupts disabled, so that an
+		// interrupt can't happen between the check and the wfi instruction.
+		// A pending interrupt still wakes up the CPU from wfi and is handled
+		// as soon as interrupts are enabled again.
+		arm.Asm("cpsid i")
+		if bool(rtc_wakeup) || (interruptible && bool(schedulerWoken)) {
+			arm.Asm("cpsie i")
+			break
+		}
 		arm.Asm("wfi")
+		arm.Asm("cpsie i")
 	}
+	// Disable the RTC interrupt in case it hasn't fired yet.
+	nrf.RTC0.INTENCLR = nrf.RTC0_INTENSET_COMPARE0_Msk
 }
 
 //go:export RTC0_IRQHandler
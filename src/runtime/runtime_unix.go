@@ -6,13 +6,12 @@ import (
 	"unsafe"
 )
 
-const Microsecond = 1
-
 func _Cfunc_putchar(c int) int
 func _Cfunc_usleep(usec uint) int
 func _Cfunc_calloc(nmemb, size uintptr) unsafe.Pointer
 func _Cfunc_exit(status int)
 func _Cfunc_clock_gettime(clk_id uint, ts *timespec)
+func _Cfunc_getenv(name *byte) *byte
 
 // TODO: Linux/amd64-specific
 type timespec struct {
@@ -20,24 +19,48 @@ type timespec struct {
 	tv_nsec int64
 }
 
-const CLOCK_MONOTONIC_RAW = 4
+const (
+	CLOCK_REALTIME      = 0
+	CLOCK_MONOTONIC_RAW = 4
+)
 
 func putchar(c byte) {
 	_Cfunc_putchar(int(c))
 }
 
 func sleep(d Duration) {
-	_Cfunc_usleep(uint(d))
+	// usleep takes a 32-bit number of microseconds and may not accept values
+	// of a second or more, so sleep in chunks of at most a second.
+	for d > 0 {
+		chunk := d
+		if chunk > Second {
+			chunk = Second
+		}
+		_Cfunc_usleep(uint(chunk / Microsecond))
+		d -= chunk
+	}
+}
+
+// Sleep until the given duration has passed. There are no interrupts to wake
+// up the scheduler, so this is the same as sleep.
+func idleSleep(d Duration) {
+	sleep(d)
 }
 
-// Return monotonic time in microseconds.
+// Return monotonic time in nanoseconds.
 //
-// TODO: use nanoseconds?
 // TODO: noescape
 func monotime() uint64 {
 	ts := timespec{}
 	_Cfunc_clock_gettime(CLOCK_MONOTONIC_RAW, &ts)
-	return uint64(ts.tv_sec)*1000*1000 + uint64(ts.tv_nsec)/1000
+	return uint64(ts.tv_sec)*1000*1000*1000 + uint64(ts.tv_nsec)
+}
+
+// Return the wall clock time as seconds and nanoseconds since the Unix epoch.
+func walltime() (sec int64, nsec int32) {
+	ts := timespec{}
+	_Cfunc_clock_gettime(CLOCK_REALTIME, &ts)
+	return ts.tv_sec, int32(ts.tv_nsec)
 }
 
 func abort() {
@@ -45,26 +68,70 @@ func abort() {
 	_Cfunc_exit(2)
 }
 
-func alloc(size uintptr) unsafe.Pointer {
-	buf := _Cfunc_calloc(1, size)
-	if buf == nil {
-		runtimePanic("cannot allocate memory")
-	}
-	return buf
-}
+// Default size of the heap. Memory is allocated with calloc, which maps pages
+// of zeroes for large allocations: parts of the heap that are never used do
+// not take up any memory. The heap cannot grow, but programs that need more
+// memory can set the TINYGOHEAP environment variable to the size in bytes,
+// optionally followed by K, M or G.
+const defaultHeapSize = 64 * 1024 * 1024
 
-func free(ptr unsafe.Pointer) {
-	//C.free(ptr) // TODO
-}
+// Name of the environment variable with the heap size, as a C string. It is a
+// global because the heap doesn't exist yet when it is needed.
+var heapSizeEnv = "TINYGOHEAP\x00"
 
-func GC() {
-	// Unimplemented.
-}
+var (
+	_extern___data_start     unsafe.Pointer // start of .data, defined by the linker
+	_extern__end             unsafe.Pointer // end of .bss, defined by the linker
+	_extern___libc_stack_end unsafe.Pointer // top of the stack, set by libc
 
-func KeepAlive(x interface{}) {
-	// Unimplemented. Only required with SetFinalizer().
+	heapStart    uintptr
+	heapEnd      uintptr
+	globalsStart uintptr
+	globalsEnd   uintptr
+	stackTop     uintptr
+)
+
+// Allocate the heap and determine where the globals and the stack are, for
+// the garbage collector.
+func initHeapRegion() {
+	heapSize := uintptr(defaultHeapSize)
+	if size, ok := parseHeapSize(_Cfunc_getenv((*_string)(unsafe.Pointer(&heapSizeEnv)).ptr)); ok {
+		heapSize = size
+	}
+	heapStart = uintptr(_Cfunc_calloc(1, heapSize))
+	if heapStart == 0 {
+		runtimePanic("cannot allocate heap")
+	}
+	heapEnd = heapStart + heapSize
+	globalsStart = uintptr(unsafe.Pointer(&_extern___data_start))
+	globalsEnd = uintptr(unsafe.Pointer(&_extern__end))
+	stackTop = uintptr(_extern___libc_stack_end)
 }
 
-func SetFinalizer(obj interface{}, finalizer interface{}) {
-	// Unimplemented.
+// Parse the heap size in the given C string, see defaultHeapSize. It returns
+// false when the string is missing or invalid.
+func parseHeapSize(s *byte) (uintptr, bool) {
+	if s == nil {
+		return 0, false
+	}
+	size := uintptr(0)
+	digits := 0
+	for ; *s >= '0' && *s <= '9'; s = (*byte)(unsafe.Pointer(uintptr(unsafe.Pointer(s)) + 1)) {
+		size = size*10 + uintptr(*s-'0')
+		digits++
+	}
+	switch *s {
+	case 'K', 'k':
+		size *= 1024
+	case 'M', 'm':
+		size *= 1024 * 1024
+	case 'G', 'g':
+		size *= 1024 * 1024 * 1024
+	case 0:
+		return size, digits != 0 && size != 0
+	default:
+		return 0, false
+	}
+	s = (*byte)(unsafe.Pointer(uintptr(unsafe.Pointer(s)) + 1))
+	return size, digits != 0 && size != 0 && *s == 0
 }
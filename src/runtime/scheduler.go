@@ -50,18 +50,26 @@ func (t *coroutine) promise() *taskState {
 
 // State/promise of a task. Internally represented as:
 //
-//     {i8 state, i32 data, i8* next}
+//     {i8 state, i32 data, i8* next, i8* prev, i64 wakeup, %runtime._string function, i8* parent, i1 parked}
 type taskState struct {
-	state uint8
-	data  uint32
-	next  *coroutine
+	state    uint8
+	data     uint32
+	next     *coroutine
+	prev     *coroutine // previous task in parkedTasks
+	wakeup   uint64     // monotime() timestamp at which a sleeping task is woken up
+	function string     // name of the function, only set when compiled with debug info
+	parent   *coroutine // calling coroutine, only set when compiled with debug info
+	parked   bool       // whether the task is in parkedTasks
 }
 
 // Various states a task can be in.
 const (
 	TASK_STATE_RUNNABLE = iota
 	TASK_STATE_SLEEP
-	TASK_STATE_CALL // waiting for a sub-coroutine
+	TASK_STATE_CALL      // waiting for a sub-coroutine
+	TASK_STATE_CHAN      // waiting for a channel operation
+	TASK_STATE_SYNC      // waiting for a semaphore or sync.Cond, see sync.go
+	TASK_STATE_INTERRUPT // waiting for an interrupt, see waitForInterrupt
 )
 
 // Queues used by the scheduler.
@@ -69,12 +77,21 @@ const (
 // TODO: runqueueFront can be removed by making the run queue a circular linked
 // list. The runqueueBack will simply refer to the front in the 'next' pointer.
 var (
-	runqueueFront      *coroutine
-	runqueueBack       *coroutine
-	sleepQueue         *coroutine
-	sleepQueueBaseTime uint64
+	runqueueFront    *coroutine
+	runqueueBack     *coroutine
+	sleepQueue       *coroutine // sorted by wakeup time, earliest first
+	parkedTasks      *coroutine // waiting for a call, channel or sync primitive
+	interruptWaiters *coroutine // waiting for wakeScheduler
 )
 
+// Loads and stores of a value with this (magic) type name are volatile, so
+// that they are not optimized away when the value is changed in an interrupt.
+type __volatile bool
+
+// Set by wakeScheduler, to make idleSleep return early. Cleared by the scheduler
+// when it makes the goroutines in interruptWaiters runnable.
+var schedulerWoken __volatile
+
 // Simple logging, for debugging.
 func scheduleLog(msg string) {
 	if schedulerDebug {
@@ -94,11 +111,16 @@ func scheduleLogTask(msg string, t *coroutine) {
 // This is a compiler intrinsic.
 func sleepTask(caller *coroutine, duration Duration) {
 	if schedulerDebug {
-		println("  set state sleep:", caller, uint32(duration))
+		println("  set state sleep:", caller, duration)
 	}
 	promise := caller.promise()
+	if duration <= 0 {
+		// Nothing to wait for, only yield to other tasks.
+		promise.state = TASK_STATE_RUNNABLE
+		return
+	}
 	promise.state = TASK_STATE_SLEEP
-	promise.data = uint32(duration) // TODO: longer durations
+	promise.wakeup = monotime() + uint64(duration)
 }
 
 // Wait for the result of an async call. This means that the parent goroutine
@@ -123,8 +145,18 @@ func yieldToScheduler(t *coroutine) {
 	promise := t.promise()
 	if promise.state == TASK_STATE_CALL {
 		scheduleLogTask("  set waiting for call:", t)
-		return // calling an async task, the subroutine will re-active the parent
-	} else if promise.state == TASK_STATE_SLEEP && promise.data != 0 {
+		parkTask(t) // calling an async task, the subroutine will re-active the parent
+	} else if promise.state == TASK_STATE_CHAN {
+		scheduleLogTask("  set waiting for channel:", t)
+		parkTask(t) // blocked on a channel, the other side will re-activate it
+	} else if promise.state == TASK_STATE_SYNC {
+		scheduleLogTask("  set waiting for sync:", t)
+		parkTask(t) // blocked in the sync package, the releasing goroutine will re-activate it
+	} else if promise.state == TASK_STATE_INTERRUPT {
+		scheduleLogTask("  set waiting for interrupt:", t)
+		promise.next = interruptWaiters
+		interruptWaiters = t
+	} else if promise.state == TASK_STATE_SLEEP {
 		scheduleLogTask("  set sleeping:", t)
 		addSleepTask(t)
 	} else {
@@ -133,6 +165,140 @@ func yieldToScheduler(t *coroutine) {
 	}
 }
 
+// Make a task that is waiting for a call, a channel operation or a sync
+// primitive runnable again.
+//
+// This is a compiler intrinsic.
+func activateTask(t *coroutine) {
+	if t == nil {
+		return
+	}
+	scheduleLogTask("  activate task:", t)
+	promise := t.promise()
+	promise.state = TASK_STATE_RUNNABLE
+	if !promise.parked {
+		// Activated before it suspended, for example when a blocking function
+		// that it called returned without blocking. It is still running, and
+		// will be added to the runqueue by yieldToScheduler once it suspends.
+		scheduleLogTask("  not yet suspended:", t)
+		return
+	}
+	unparkTask(t)
+	runqueuePushBack(t)
+}
+
+// Add a task to the list of parked tasks. They are only kept in this list to
+// be able to report them when there is a deadlock. The list is doubly linked,
+// so that a task can be removed from it in constant time when it is activated.
+func parkTask(t *coroutine) {
+	promise := t.promise()
+	promise.parked = true
+	promise.prev = nil
+	promise.next = parkedTasks
+	if parkedTasks != nil {
+		parkedTasks.promise().prev = t
+	}
+	parkedTasks = t
+}
+
+// Remove a task from the list of parked tasks.
+func unparkTask(t *coroutine) {
+	promise := t.promise()
+	if schedulerDebug {
+		if !promise.parked {
+			panic("runtime: unparkTask: task not parked")
+		}
+	}
+	promise.parked = false
+	if promise.prev != nil {
+		promise.prev.promise().next = promise.next
+	} else {
+		parkedTasks = promise.next
+	}
+	if promise.next != nil {
+		promise.next.promise().prev = promise.prev
+	}
+	promise.next = nil
+	promise.prev = nil
+}
+
+// Wake up the scheduler when it is waiting in idleSleep for the next task to
+// wake up or timer to fire, and make all goroutines that wait in
+// waitForInterrupt runnable. The machine package calls this from its interrupt
+// handlers.
+//
+// Interrupts can happen at any time, also while the scheduler or a goroutine is
+// in the middle of changing some data structure. So interrupt handlers must not
+// allocate memory, use channels, maps or the sync package, print, or call
+// anything else that touches the heap or the scheduler state. They may read and
+// write device registers and volatile variables, and call wakeScheduler. Waking
+// up a goroutine is done by the scheduler itself, outside of the interrupt.
+//
+//go:linkname wakeScheduler machine.wakeScheduler
+func wakeScheduler() {
+	schedulerWoken = true
+}
+
+// Wait until an interrupt handler calls wakeScheduler. This may also return
+// when an interrupt happened just before, or when an interrupt for another
+// goroutine happened, so the caller has to check whether the event it waits for
+// has actually happened (like with sync.Cond).
+//
+//go:linkname waitForInterrupt machine.waitForInterrupt
+func waitForInterrupt() {
+	interruptWaitTask(nil)
+}
+
+// Park the current goroutine until the scheduler has been woken up. Without a
+// scheduler, the CPU sleeps until an interrupt calls wakeScheduler instead.
+//
+// This is a compiler intrinsic.
+func interruptWaitTask(t *coroutine) {
+	if t == nil {
+		for !schedulerWoken {
+			idleSleep(Second)
+		}
+		schedulerWoken = false
+		return
+	}
+	t.promise().state = TASK_STATE_INTERRUPT
+}
+
+// Called when a goroutine needs to block while there is no scheduler, or when
+// the scheduler finds that all goroutines are blocked. Nobody can unblock them
+// anymore, so print all parked goroutines (like gc) and exit.
+//
+// A goroutine consists of a chain of coroutines: each blocking call parks the
+// caller in TASK_STATE_CALL. So only the innermost coroutine of each goroutine
+// is printed as a goroutine, followed by its callers (the call stack).
+func deadlock() {
+	printstring("fatal error: all goroutines are asleep - deadlock!\n")
+	for t := parkedTasks; t != nil; t = t.promise().next {
+		promise := t.promise()
+		if promise.state == TASK_STATE_CALL {
+			// Printed as part of the goroutine that is blocked in this call.
+			continue
+		}
+		printstring("\ngoroutine ")
+		printptr(uintptr(unsafe.Pointer(t)))
+		switch promise.state {
+		case TASK_STATE_CHAN:
+			printstring(" [waiting for channel]:\n")
+		case TASK_STATE_SYNC:
+			printstring(" [waiting for sync]:\n")
+		default:
+			printstring(" [unknown state]:\n")
+		}
+		for frame := t; frame != nil; frame = frame.promise().parent {
+			if function := frame.promise().function; function != "" {
+				printstring(function)
+				printstring("()\n")
+			}
+		}
+	}
+	abort()
+}
+
 // Add this task to the end of the run queue. May also destroy the task if it's
 // done.
 func runqueuePushBack(t *coroutine) {
@@ -194,86 +360,105 @@ func addSleepTask(t *coroutine) {
 			panic("runtime: addSleepTask: task not sleeping")
 		}
 	}
-	now := monotime()
-	if sleepQueue == nil {
-		scheduleLog("  -> sleep new queue")
-		// Create new linked list for the sleep queue.
-		sleepQueue = t
-		sleepQueueBaseTime = now
-		return
-	}
-
-	// Make sure promise.data is relative to the queue time base.
 	promise := t.promise()
 
 	// Insert at front of sleep queue.
-	if promise.data < sleepQueue.promise().data {
+	if sleepQueue == nil || promise.wakeup < sleepQueue.promise().wakeup {
 		scheduleLog("  -> sleep at start")
-		sleepQueue.promise().data -= promise.data
 		promise.next = sleepQueue
 		sleepQueue = t
 		return
 	}
 
-	// Add to sleep queue (in the middle or at the end).
+	// Add to sleep queue (in the middle or at the end), after all tasks that
+	// wake up at the same time or earlier.
 	queueIndex := sleepQueue
 	for {
-		promise.data -= queueIndex.promise().data
-		if queueIndex.promise().next == nil || queueIndex.promise().data > promise.data {
-			if queueIndex.promise().next == nil {
-				scheduleLog("  -> sleep at end")
-				promise.next = nil
-			} else {
-				scheduleLog("  -> sleep in middle")
-				promise.next = queueIndex.promise().next
-				promise.next.promise().data -= promise.data
-			}
+		next := queueIndex.promise().next
+		if next == nil || promise.wakeup < next.promise().wakeup {
+			scheduleLog("  -> sleep in middle or at end")
+			promise.next = next
 			queueIndex.promise().next = t
 			break
 		}
-		queueIndex = queueIndex.promise().next
+		queueIndex = next
 	}
 }
 
-// Run the scheduler until all tasks have finished.
-// It takes an initial task (main.main) to bootstrap.
+// Run the scheduler until main.main returns, like gc does. It takes an initial
+// task (main.main) to bootstrap.
 func scheduler(main *coroutine) {
+	if main.done() {
+		// main.main returned without blocking.
+		return
+	}
+
 	// Initial task.
 	yieldToScheduler(main)
 
 	// Main scheduler loop.
 	for {
 		scheduleLog("\n  schedule")
+		if schedulerWoken {
+			// An interrupt handler called wakeScheduler. Let all goroutines
+			// that wait for an interrupt check whether theirs has happened.
+			// Clear the flag first, so that an interrupt in the mean time
+			// isn't missed.
+			schedulerWoken = false
+			for interruptWaiters != nil {
+				t := interruptWaiters
+				promise := t.promise()
+				interruptWaiters = promise.next
+				promise.next = nil
+				promise.state = TASK_STATE_RUNNABLE
+				runqueuePushBack(t)
+			}
+		}
 		now := monotime()
 
 		// Add tasks that are done sleeping to the end of the runqueue so they
 		// will be executed soon.
-		if sleepQueue != nil && now-sleepQueueBaseTime >= uint64(sleepQueue.promise().data) {
+		for sleepQueue != nil && now >= sleepQueue.promise().wakeup {
 			t := sleepQueue
 			scheduleLogTask("  awake:", t)
 			promise := t.promise()
-			sleepQueueBaseTime += uint64(promise.data)
 			sleepQueue = promise.next
 			promise.state = TASK_STATE_RUNNABLE
 			promise.next = nil
 			runqueuePushBack(t)
 		}
 
+		// Fire expired timers. This may make tasks runnable that are waiting
+		// on a timer channel.
+		fireTimers(now)
+
 		t := runqueuePopFront()
 		if t == nil {
-			if sleepQueue == nil {
-				// No more tasks to execute.
-				// It would be nice if we could detect deadlocks here, because
-				// there might still be functions waiting on each other in a
-				// deadlock.
+			if sleepQueue == nil && timerQueue == nil && interruptWaiters == nil {
+				// No more tasks to execute, while main.main hasn't returned
+				// yet (the scheduler stops when it does). So all remaining
+				// goroutines, including main, are waiting on each other.
 				scheduleLog("  no tasks left!")
-				return
+				deadlock()
 			}
-			timeLeft := uint64(sleepQueue.promise().data) - (now - sleepQueueBaseTime)
+			// Sleep until the first task wakes up or the first timer fires,
+			// whichever comes first. An interrupt may cut the sleep short.
+			var wakeup uint64
+			if sleepQueue != nil {
+				wakeup = sleepQueue.promise().wakeup
+			}
+			if timerQueue != nil && (sleepQueue == nil || uint64(timerQueue.when) < wakeup) {
+				wakeup = uint64(timerQueue.when)
+			}
+			if sleepQueue == nil && timerQueue == nil {
+				// Only waiting for an interrupt.
+				wakeup = now + uint64(Second)
+			}
+			timeLeft := wakeup - now
 			if schedulerDebug {
-				println("  sleeping...", sleepQueue, uint32(timeLeft))
+				println("  sleeping...", sleepQueue, timeLeft)
 			}
-			sleep(Duration(timeLeft))
+			idleSleep(Duration(timeLeft))
 			continue
 		}
 
@@ -281,6 +466,13 @@ func scheduler(main *coroutine) {
 		scheduleLog("  <- runqueuePopFront")
 		scheduleLogTask("  run:", t)
 		t.resume()
+		if t == main && t.done() {
+			// Like gc, exit when main.main returns, even when there are still
+			// other goroutines or active timers (like a time.Ticker that was
+			// never stopped).
+			scheduleLog("  main returned")
+			return
+		}
 
 		// Add the just resumed task to the run queue or the sleep queue.
 		yieldToScheduler(t)
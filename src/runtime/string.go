@@ -66,6 +66,44 @@ func stringToBytes(x _string) (slice struct {
 	return
 }
 
+// Create a string from a []rune slice.
+func stringFromRunes(runeSlice []rune) (s _string) {
+	// Count the number of bytes first, to allocate the string at once.
+	for _, r := range runeSlice {
+		_, numBytes := encodeUTF8(r)
+		s.length += numBytes
+	}
+	buf := alloc(uintptr(s.length))
+	s.ptr = (*byte)(buf)
+	index := uintptr(0)
+	for _, r := range runeSlice {
+		array, numBytes := encodeUTF8(r)
+		memcpy(unsafe.Pointer(uintptr(buf)+index), unsafe.Pointer(&array), uintptr(numBytes))
+		index += uintptr(numBytes)
+	}
+	return
+}
+
+// Convert a string to a []rune slice.
+func stringToRunes(s string) []rune {
+	// Count the number of runes first, to allocate the slice at once.
+	n := 0
+	for i := 0; i < len(s); {
+		_, numBytes := decodeUTF8(s, i)
+		i += numBytes
+		n++
+	}
+	runes := make([]rune, n)
+	n = 0
+	for i := 0; i < len(s); {
+		x, numBytes := decodeUTF8(s, i)
+		runes[n] = x
+		i += numBytes
+		n++
+	}
+	return runes
+}
+
 // Create a string from a Unicode code point.
 func stringFromUnicode(x rune) _string {
 	array, length := encodeUTF8(x)
@@ -80,6 +118,9 @@ func encodeUTF8(x rune) ([4]byte, lenType) {
 	// https://stackoverflow.com/questions/6240055/manually-converting-unicode-codepoints-into-utf-8-and-utf-16
 	// Note: this code can probably be optimized (in size and speed).
 	switch {
+	case x < 0 || 0xd800 <= x && x <= 0xdfff:
+		// Invalid Unicode code point (negative or a surrogate half).
+		return [4]byte{0xef, 0xbf, 0xbd, 0}, 3
 	case x <= 0x7f:
 		return [4]byte{byte(x), 0, 0, 0}, 1
 	case x <= 0x7ff:
@@ -102,3 +143,45 @@ func encodeUTF8(x rune) ([4]byte, lenType) {
 		return [4]byte{0xef, 0xbf, 0xbd, 0}, 3
 	}
 }
+
+// Decode the UTF-8 encoded code point in the string at the given index. Returns
+// the code point and the number of bytes it uses. An invalid encoding is
+// decoded as a single byte with code point U+FFFD, like in a range over a
+// string.
+func decodeUTF8(s string, index int) (rune, int) {
+	remaining := len(s) - index
+	b0 := s[index]
+	switch {
+	case b0&0x80 == 0:
+		return rune(b0), 1
+	case b0&0xe0 == 0xc0 && remaining >= 2:
+		b1 := s[index+1]
+		if b1&0xc0 == 0x80 {
+			x := rune(b0&0x1f)<<6 | rune(b1&0x3f)
+			if x >= 0x80 {
+				return x, 2
+			}
+		}
+	case b0&0xf0 == 0xe0 && remaining >= 3:
+		b1 := s[index+1]
+		b2 := s[index+2]
+		if b1&0xc0 == 0x80 && b2&0xc0 == 0x80 {
+			x := rune(b0&0x0f)<<12 | rune(b1&0x3f)<<6 | rune(b2&0x3f)
+			if x >= 0x800 && !(0xd800 <= x && x <= 0xdfff) {
+				return x, 3
+			}
+		}
+	case b0&0xf8 == 0xf0 && remaining >= 4:
+		b1 := s[index+1]
+		b2 := s[index+2]
+		b3 := s[index+3]
+		if b1&0xc0 == 0x80 && b2&0xc0 == 0x80 && b3&0xc0 == 0x80 {
+			x := rune(b0&0x07)<<18 | rune(b1&0x3f)<<12 | rune(b2&0x3f)<<6 | rune(b3&0x3f)
+			if x >= 0x10000 && x <= 0x10ffff {
+				return x, 4
+			}
+		}
+	}
+	// Invalid encoding.
+	return 0xfffd, 1
+}
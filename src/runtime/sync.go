@@ -1,6 +1,42 @@
 package runtime
 
 // This file contains support code for the sync package.
+//
+// Goroutines that wait for a semaphore (used by sync.Mutex, sync.WaitGroup,
+// etc.) or for a notification of a sync.Cond are parked (TASK_STATE_SYNC) in a
+// list of waiters. The goroutine that releases the semaphore or signals the
+// condition makes them runnable again.
+//
+// Like channel operations, waiting is implemented together with the compiler.
+// The compiler emits a call to semacquireTask or notifyListWaitTask followed by
+// a suspend of the current coroutine. Without a scheduler, the sync package
+// calls the functions below directly, and there is nobody to wait for.
+
+import (
+	"unsafe"
+)
+
+// A goroutine waiting for a semaphore or a notify list.
+type syncWaiter struct {
+	next   *syncWaiter
+	t      *coroutine
+	sema   *uint32 // semaphore this goroutine is waiting for
+	ticket uint32  // notify list ticket this goroutine is waiting for
+}
+
+// Goroutines waiting for a semaphore, in the order in which they started
+// waiting.
+var semaWaiters *syncWaiter
+
+// Mirror of sync.notifyList in the standard library. The layout must be kept
+// in sync, which is checked in notifyListCheck.
+type notifyList struct {
+	wait   uint32      // ticket of the next goroutine to call Wait
+	notify uint32      // ticket of the next goroutine to be notified
+	lock   uintptr     // unused
+	head   *syncWaiter // goroutines waiting for a notification
+	tail   unsafe.Pointer
+}
 
 //go:linkname registerPoolCleanup sync.runtime_registerPoolCleanup
 func registerPoolCleanup(cleanup func()) {
@@ -9,5 +45,150 @@ func registerPoolCleanup(cleanup func()) {
 
 //go:linkname notifyListCheck sync.runtime_notifyListCheck
 func notifyListCheck(size uintptr) {
-	// Ignore.
+	if size != unsafe.Sizeof(notifyList{}) {
+		runtimePanic("sync.notifyList size mismatch")
+	}
+}
+
+//go:linkname syncSemacquire sync.runtime_Semacquire
+func syncSemacquire(sema *uint32) {
+	semacquireTask(nil, sema)
+}
+
+//go:linkname syncSemacquireMutex sync.runtime_SemacquireMutex
+func syncSemacquireMutex(sema *uint32, lifo bool) {
+	semacquireTask(nil, sema)
+}
+
+//go:linkname syncSemrelease sync.runtime_Semrelease
+func syncSemrelease(sema *uint32, handoff bool) {
+	*sema++
+
+	// Hand the semaphore over to the first goroutine that is waiting for it, if
+	// there is one.
+	for ptr := &semaWaiters; *ptr != nil; ptr = &(*ptr).next {
+		w := *ptr
+		if w.sema == sema {
+			*ptr = w.next
+			*sema--
+			activateTask(w.t)
+			return
+		}
+	}
+}
+
+// Acquire a semaphore: wait until it is greater than zero and decrement it.
+// When the semaphore is not available, the goroutine is parked until
+// syncSemrelease hands it over.
+//
+// This is a compiler intrinsic.
+func semacquireTask(t *coroutine, sema *uint32) {
+	if *sema > 0 {
+		*sema--
+		return
+	}
+	if t == nil {
+		deadlock()
+	}
+	w := &syncWaiter{t: t, sema: sema}
+	ptr := &semaWaiters
+	for *ptr != nil {
+		ptr = &(*ptr).next
+	}
+	*ptr = w
+	t.promise().state = TASK_STATE_SYNC
+}
+
+//go:linkname notifyListAdd sync.runtime_notifyListAdd
+func notifyListAdd(l *notifyList) uint32 {
+	ticket := l.wait
+	l.wait++
+	return ticket
+}
+
+//go:linkname notifyListWait sync.runtime_notifyListWait
+func notifyListWait(l *notifyList, ticket uint32) {
+	notifyListWaitTask(nil, l, ticket)
+}
+
+// Wait for a notification with the given ticket (from notifyListAdd). The
+// goroutine is parked until it is notified, unless that already happened.
+//
+// This is a compiler intrinsic.
+func notifyListWaitTask(t *coroutine, l *notifyList, ticket uint32) {
+	if int32(ticket-l.notify) < 0 {
+		// Already notified (taking wraparound into account).
+		return
+	}
+	if t == nil {
+		deadlock()
+	}
+	w := &syncWaiter{t: t, ticket: ticket}
+	ptr := &l.head
+	for *ptr != nil {
+		ptr = &(*ptr).next
+	}
+	*ptr = w
+	t.promise().state = TASK_STATE_SYNC
+}
+
+//go:linkname notifyListNotifyAll sync.runtime_notifyListNotifyAll
+func notifyListNotifyAll(l *notifyList) {
+	l.notify = l.wait
+	for l.head != nil {
+		w := l.head
+		l.head = w.next
+		activateTask(w.t)
+	}
+}
+
+//go:linkname notifyListNotifyOne sync.runtime_notifyListNotifyOne
+func notifyListNotifyOne(l *notifyList) {
+	if l.wait == l.notify {
+		// Nobody to notify.
+		return
+	}
+	ticket := l.notify
+	l.notify++
+
+	// The goroutine with this ticket may not have called Wait yet. In that
+	// case, it will see that it has been notified when it does.
+	for ptr := &l.head; *ptr != nil; ptr = &(*ptr).next {
+		w := *ptr
+		if w.ticket == ticket {
+			*ptr = w.next
+			activateTask(w.t)
+			return
+		}
+	}
+}
+
+//go:linkname syncCanSpin sync.runtime_canSpin
+func syncCanSpin(i int) bool {
+	// There are no other threads that could release a lock while spinning.
+	return false
+}
+
+//go:linkname syncDoSpin sync.runtime_doSpin
+func syncDoSpin() {
+}
+
+//go:linkname syncNanotime sync.runtime_nanotime
+func syncNanotime() int64 {
+	return int64(monotime())
+}
+
+//go:linkname syncThrow sync.throw
+func syncThrow(s string) {
+	runtimePanic(s)
+}
+
+//go:linkname procPin sync.runtime_procPin
+func procPin() int {
+	// There is only one P.
+	return 0
+}
+
+//go:linkname procUnpin sync.runtime_procUnpin
+func procUnpin() {
 }
@@ -1,11 +1,108 @@
 package runtime
 
-// TODO: use the time package for this.
+// Duration is the time between two instants, in nanoseconds. It has the same
+// representation as time.Duration, so that durations can be converted between
+// the two without loss.
+type Duration int64
 
-type Duration uint64
-
-// Use microseconds as the smallest time unit
+// Common durations. All timestamps in the runtime (see monotime) are in
+// nanoseconds as well.
 const (
-	Millisecond = Microsecond * 1000
-	Second      = Millisecond * 1000
+	Nanosecond  Duration = 1
+	Microsecond          = 1000 * Nanosecond
+	Millisecond          = 1000 * Microsecond
+	Second               = 1000 * Millisecond
+	Minute               = 60 * Second
+	Hour                 = 60 * Minute
 )
+
+// Mirror of time.runtimeTimer in the standard library. The layout must be kept
+// in sync. The first field (tb) isn't used by the time package, it is used here
+// to link active timers together.
+type timer struct {
+	next   *timer
+	i      int
+	when   int64 // monotime() timestamp at which the timer fires
+	period int64
+	f      func(interface{}, uintptr)
+	arg    interface{}
+	seq    uintptr
+}
+
+// Active timers, sorted by the time they fire, earliest first. They are fired
+// by the scheduler.
+var timerQueue *timer
+
+//go:linkname timeSleep time.Sleep
+func timeSleep(d int64) {
+	// Like runtime.Sleep, calls to this function are transformed by the
+	// compiler into a suspend of the calling goroutine when goroutines are
+	// used. Don't call Sleep here, as that would make this function blocking.
+	if d <= 0 {
+		return
+	}
+	sleep(Duration(d))
+}
+
+//go:linkname timeNow time.now
+func timeNow() (sec int64, nsec int32, mono int64) {
+	sec, nsec = walltime()
+	return sec, nsec, int64(monotime())
+}
+
+//go:linkname timeRuntimeNano time.runtimeNano
+func timeRuntimeNano() int64 {
+	return int64(monotime())
+}
+
+//go:linkname startTimer time.startTimer
+func startTimer(t *timer) {
+	addTimer(t)
+}
+
+//go:linkname stopTimer time.stopTimer
+func stopTimer(t *timer) bool {
+	return removeTimer(t)
+}
+
+// Add this timer to the timer queue, after all timers that fire at the same
+// time or earlier.
+func addTimer(t *timer) {
+	ptr := &timerQueue
+	for *ptr != nil && (*ptr).when <= t.when {
+		ptr = &(*ptr).next
+	}
+	t.next = *ptr
+	*ptr = t
+}
+
+// Remove this timer from the timer queue. It returns whether the timer was
+// active, that is, whether it was stopped before it fired.
+func removeTimer(t *timer) bool {
+	for ptr := &timerQueue; *ptr != nil; ptr = &(*ptr).next {
+		if *ptr == t {
+			*ptr = t.next
+			t.next = nil
+			return true
+		}
+	}
+	return false
+}
+
+// Fire all timers that expire at or before the given timestamp. For the timers
+// of the time package this sends the current time on the timer channel (without
+// blocking) or starts a goroutine for time.AfterFunc.
+func fireTimers(now uint64) {
+	for timerQueue != nil && timerQueue.when <= int64(now) {
+		t := timerQueue
+		timerQueue = t.next
+		t.next = nil
+		if t.period > 0 {
+			// Periodic timer (time.Ticker). Like gc, skip the ticks that were
+			// missed.
+			t.when += t.period * (1 + (int64(now)-t.when)/t.period)
+			addTimer(t)
+		}
+		t.f(t.arg, t.seq)
+	}
+}